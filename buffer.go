@@ -0,0 +1,269 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Buffer error messages
+	errorNoSuchBuffer       = "No matching buffer"
+	errorMultipleBuffers    = "More than one match"
+	errorNoWriteBuffer      = "No write since last change for buffer"
+	errorNoWriteBufferForce = "(add ! to override)"
+)
+
+// Buffer is a file or scratch text open in the editor. Each buffer keeps its own file format,
+// highlighting, options and undo history, and remembers the cursor, scroll position and options of
+// the window that last showed it, so switching between buffers returns to where editing left off.
+type Buffer struct {
+	id int // Buffer number, shown by :ls and taken by :b
+
+	// Text buffer and the position it was last viewed at
+	text              TextBuffer    // Text buffer: lines of runes stored in a piece table
+	lastViewport      viewport      // Cursor and scroll position when a window last stopped showing the buffer
+	lastWindowOptions windowOptions // Window options when a window last stopped showing the buffer
+
+	// File management
+	filename string     // Name of the loaded file, or "" for a buffer without a file
+	modified bool       // True if the buffer has changes that were not saved
+	format   textFormat // Line endings, final newline and BOM to write back on save
+
+	// Syntax highlighting
+	highlighter *SyntaxHighlighter
+
+	// Options
+	bufferOptions                       // Values of the buffer options, such as tabstop, for the buffer
+	overriddenOptions map[string]string // Values of the options its file type replaced
+
+	// Undo and redo
+	history *History // Reversible record of buffer edits
+
+	// Visual mode
+	lastSelection *selection // Last selection made in the buffer, for the '< and '> line addresses
+}
+
+// newBuffer returns an empty buffer with one empty line.
+// Parameters:
+// - id: The buffer number.
+// - highlighter: The syntax highlighter of the buffer.
+// - options: The buffer options the buffer starts with.
+// - windowOptions: The window options the buffer is first shown with.
+func newBuffer(id int, highlighter *SyntaxHighlighter, options bufferOptions, windowOptions windowOptions) *Buffer {
+	return &Buffer{
+		id:                id,
+		text:              NewPieceTable(nil), // Start with one empty line
+		lastWindowOptions: windowOptions,
+		highlighter:       highlighter,
+		bufferOptions:     options,
+		overriddenOptions: map[string]string{},
+		history:           NewHistory(),
+		format:            defaultTextFormat,
+	}
+}
+
+// name returns the file name of the buffer, or the placeholder for buffers without a file.
+func (b *Buffer) name() string {
+	if b.filename == "" {
+		return noNameBuffer
+	}
+	return b.filename
+}
+
+// isEmpty reports whether the buffer is an unmodified buffer without a file or text,
+// which a file can be opened into instead of opening a new buffer.
+func (b *Buffer) isEmpty() bool {
+	return b.filename == "" && !b.modified && b.text.LineCount() == 1 && b.text.LineLen(0) == 0
+}
+
+// addBuffer opens a new empty buffer after the others, without switching to it.
+func (e *Editor) addBuffer() *Buffer {
+	e.lastBufferID++
+	b := newBuffer(e.lastBufferID, e.highlighter.Clone(), e.bufferDefaults, e.windowDefaults)
+	e.buffers = append(e.buffers, b)
+	return b
+}
+
+// switchBuffer shows b in the current window.
+func (e *Editor) switchBuffer(b *Buffer) {
+	if b == e.Buffer {
+		return
+	}
+	e.history.endGroup() // The current undo step belongs to the buffer being left
+	e.show(b)
+	e.pendingKeys = nil
+	e.dirty = true // Mark as dirty to trigger a redraw
+}
+
+// openFile switches to the buffer of a file, loading it into a new buffer if it is not open yet.
+// An empty buffer without a file is reused instead of opening a new one.
+// Parameters:
+// - arg: The file name, optionally followed by ":line" or ":line:col".
+// Returns:
+// - error: An error if the file cannot be loaded; the current buffer is then kept.
+func (e *Editor) openFile(arg string) error {
+	filename, line, col := parseFilePosition(arg)
+	for _, b := range e.buffers {
+		if b.filename == filename {
+			e.switchBuffer(b)
+			if line >= 0 && line < e.text.LineCount() {
+				e.cursorX, e.cursorY = max(0, min(col, e.text.LineLen(line))), line
+			}
+			return nil
+		}
+	}
+
+	if e.isEmpty() {
+		return e.loadFile(arg)
+	}
+	previous := e.Buffer
+	e.switchBuffer(e.addBuffer())
+	if err := e.loadFile(arg); err != nil {
+		e.buffers = e.buffers[:len(e.buffers)-1]
+		e.lastBufferID--
+		e.switchBuffer(previous)
+		return err
+	}
+	return nil
+}
+
+// findBuffer returns the buffer with a number, or the only buffer whose file name contains a text.
+func (e *Editor) findBuffer(arg string) (*Buffer, error) {
+	if id, err := strconv.Atoi(arg); err == nil {
+		for _, b := range e.buffers {
+			if b.id == id {
+				return b, nil
+			}
+		}
+		return nil, errors.New(errorNoSuchBuffer + ": " + arg)
+	}
+	var found *Buffer
+	for _, b := range e.buffers {
+		if b.filename == arg {
+			return b, nil // An exact match wins over partial ones
+		}
+		if strings.Contains(b.filename, arg) {
+			if found != nil {
+				return nil, errors.New(errorMultipleBuffers + ": " + arg)
+			}
+			found = b
+		}
+	}
+	if found == nil {
+		return nil, errors.New(errorNoSuchBuffer + ": " + arg)
+	}
+	return found, nil
+}
+
+// cycleBuffer switches to the buffer n places after the current one, wrapping around;
+// negative n switches to earlier buffers.
+func (e *Editor) cycleBuffer(n int) {
+	count := len(e.buffers)
+	e.switchBuffer(e.buffers[((slices.Index(e.buffers, e.Buffer)+n)%count+count)%count])
+}
+
+// deleteBuffer closes a buffer. Windows showing it switch to the next buffer;
+// closing the last buffer leaves a new empty buffer.
+// Parameters:
+// - b: The buffer to close.
+// - force: True to close the buffer even if its changes would be lost (:bd!).
+// Returns:
+// - error: An error if the buffer has unsaved changes.
+func (e *Editor) deleteBuffer(b *Buffer, force bool) error {
+	if b.modified && !force {
+		return fmt.Errorf("%s %d %s", errorNoWriteBuffer, b.id, errorNoWriteBufferForce)
+	}
+	i := slices.Index(e.buffers, b)
+	if len(e.buffers) == 1 {
+		e.addBuffer()
+	}
+	next := e.buffers[max(i-1, 0)]
+	if i+1 < len(e.buffers) {
+		next = e.buffers[i+1]
+	}
+	for _, w := range e.windows() {
+		if w.Buffer != b {
+			continue
+		}
+		if w == e.Window {
+			e.switchBuffer(next)
+		} else {
+			w.show(next)
+		}
+	}
+	e.buffers = slices.Delete(e.buffers, i, i+1)
+	e.dirty = true // Mark as dirty to trigger a redraw
+	return nil
+}
+
+// modifiedBuffer returns a buffer with unsaved changes, preferring the current one, or nil if there is none.
+func (e *Editor) modifiedBuffer() *Buffer {
+	if e.modified {
+		return e.Buffer
+	}
+	for _, b := range e.buffers {
+		if b.modified {
+			return b
+		}
+	}
+	return nil
+}
+
+// listBuffers returns the buffer list shown by :ls, e.g. `1 %+ "main.go"  2    "[No Name]"`:
+// the buffer number, '%' for the current buffer and '+' for unsaved changes, and the name.
+func (e *Editor) listBuffers() string {
+	entries := make([]string, len(e.buffers))
+	for i, b := range e.buffers {
+		flags := []byte("  ")
+		if b == e.Buffer {
+			flags[0] = '%'
+		}
+		if b.modified {
+			flags[1] = '+'
+		}
+		entries[i] = fmt.Sprintf("%d %s %q", b.id, flags, b.name())
+	}
+	return strings.Join(entries, "  ")
+}
+
+// executeBufferCommand processes the buffer commands: :ls, :b, :bn, :bp and :bd.
+// Parameters:
+// - name: The command name, e.g. "bn" or "bd!".
+// - args: The arguments of the command: a buffer number or part of a file name for :b and :bd.
+// Returns:
+// - error: An error if the buffer does not exist or has unsaved changes.
+func (e *Editor) executeBufferCommand(name string, args []string) error {
+	if len(args) > 1 {
+		return errors.New(errorInvalidArgument + ": " + strings.Join(args, " "))
+	}
+	switch name {
+	case "ls", "buffers", "files":
+		e.showStatus(e.listBuffers())
+	case "b", "buffer":
+		if len(args) == 0 {
+			return nil // Stay on the current buffer, like vim
+		}
+		b, err := e.findBuffer(args[0])
+		if err != nil {
+			return err
+		}
+		e.switchBuffer(b)
+	case "bn", "bnext":
+		e.cycleBuffer(1)
+	case "bp", "bprevious", "bN", "bNext":
+		e.cycleBuffer(-1)
+	case "bd", "bdelete", "bd!", "bdelete!":
+		b := e.Buffer
+		if len(args) == 1 {
+			var err error
+			if b, err = e.findBuffer(args[0]); err != nil {
+				return err
+			}
+		}
+		return e.deleteBuffer(b, strings.HasSuffix(name, "!"))
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// clipboardTool is a command line tool that copies to and pastes from the system clipboard.
+type clipboardTool struct {
+	env   string   // Environment variable set when the display server of the tool is available
+	copy  []string // Command that copies its standard input to the clipboard
+	paste []string // Command that writes the clipboard to its standard output
+}
+
+// clipboardTools are the clipboard tools used when installed, in order of preference.
+var clipboardTools = []clipboardTool{
+	{env: "WAYLAND_DISPLAY", copy: []string{"wl-copy"}, paste: []string{"wl-paste", "--no-newline"}},
+	{env: "DISPLAY", copy: []string{"xclip", "-selection", "clipboard"}, paste: []string{"xclip", "-selection", "clipboard", "-o"}},
+}
+
+// findClipboardTool returns the first clipboard tool that is installed and whose display server
+// is available, or nil. Over SSH there is usually none, and only OSC 52 reaches the clipboard.
+func findClipboardTool() *clipboardTool {
+	for i, tool := range clipboardTools {
+		if os.Getenv(tool.env) == "" {
+			continue
+		}
+		if _, err := exec.LookPath(tool.copy[0]); err == nil {
+			return &clipboardTools[i]
+		}
+	}
+	return nil
+}
+
+// copyToClipboard copies text to the system clipboard. It is sent to the terminal with the
+// OSC 52 escape sequence, which works over SSH without any tool; as terminals that do not support
+// it ignore it, the text is also copied with a clipboard tool if one is available.
+// Returns: An error if the clipboard tool failed.
+func (e *Editor) copyToClipboard(text []rune) error {
+	data := string(text)
+	e.screen.SetClipboard([]byte(data))
+	tool := findClipboardTool()
+	if tool == nil {
+		return nil
+	}
+	cmd := exec.Command(tool.copy[0], tool.copy[1:]...)
+	cmd.Stdin = strings.NewReader(data)
+	return cmd.Run()
+}
+
+// pasteFromClipboard returns the text on the system clipboard, read with a clipboard tool.
+// Terminals rarely allow reading the clipboard with OSC 52, so without a tool it cannot be read.
+// Returns: The text, whether a clipboard tool was available, and an error if it failed.
+func pasteFromClipboard() (string, bool, error) {
+	tool := findClipboardTool()
+	if tool == nil {
+		return "", false, nil
+	}
+	output, err := exec.Command(tool.paste[0], tool.paste[1:]...).Output()
+	return string(output), true, err
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/BurntSushi/toml"
+	"github.com/gdamore/tcell/v2"
+)
+
+// configFile is the name of the config file in goed's configuration directory.
+const configFile = "config.toml"
+
+// Modes key mappings apply in
+const (
+	modeNormal = "normal"
+	modeInsert = "insert"
+)
+
+// Config is the user configuration, e.g.
+//
+//	colorscheme = "light"
+//
+//	[options]
+//	number = true
+//	tabstop = 4
+//
+//	[filetype.yaml]
+//	tabstop = 2
+//	expandtab = true
+//
+//	[keys.normal]
+//	"<C-s>" = ":w<CR>"
+type Config struct {
+	Colorscheme string                       `toml:"colorscheme"` // Theme to start with
+	Options     map[string]any               `toml:"options"`     // Option values, by the names :set takes
+	Filetypes   map[string]map[string]any    `toml:"filetype"`    // Option values for a file type, by file type
+	Keys        map[string]map[string]string `toml:"keys"`        // Key mappings by mode, from a key to the keys it types
+}
+
+// configDir returns goed's directory in the user's configuration directory.
+func configDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "goed"), nil
+}
+
+// loadConfig reads a config file. A missing file is not an error; it returns an empty configuration.
+func loadConfig(path string) (*Config, error) {
+	var cfg Config
+	meta, err := toml.DecodeFile(path, &cfg)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &Config{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("%s: unknown setting %s", path, undecoded[0])
+	}
+	return &cfg, nil
+}
+
+// applyConfig applies a configuration to the editor. Settings with errors are skipped;
+// all the errors are returned together.
+func (e *Editor) applyConfig(cfg *Config) error {
+	var errs []error
+	if cfg.Colorscheme != "" {
+		if theme, err := loadTheme(cfg.Colorscheme); err != nil {
+			errs = append(errs, err)
+		} else {
+			e.setTheme(theme)
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(cfg.Options)) {
+		full := optionName(name)
+		if full == "" {
+			errs = append(errs, errors.New(errorUnknownOption+": "+name))
+		} else if err := e.setOption(full, fmt.Sprint(cfg.Options[name])); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	e.filetypeOptions = map[string]map[string]string{}
+	for filetype, options := range cfg.Filetypes {
+		e.filetypeOptions[filetype] = map[string]string{}
+		for name, value := range options {
+			switch full := optionName(name); full {
+			case "", optionFileType:
+				errs = append(errs, fmt.Errorf("%s for file type %s: %s", errorUnknownOption, filetype, name))
+			default:
+				e.filetypeOptions[filetype][full] = fmt.Sprint(value)
+			}
+		}
+	}
+
+	e.keymaps = map[string]keymap{}
+	for mode, mappings := range cfg.Keys {
+		if mode != modeNormal && mode != modeInsert {
+			errs = append(errs, fmt.Errorf("key mappings for unknown mode %q", mode))
+			continue
+		}
+		e.keymaps[mode] = keymap{}
+		for from, to := range mappings {
+			keys, err := parseKeys(from)
+			if err == nil && len(keys) != 1 {
+				err = fmt.Errorf("mapping %q: only single keys can be mapped", from)
+			}
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if e.keymaps[mode][strokeOf(keys[0])], err = parseKeys(to); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	e.applyFiletypeOptions()
+	return errors.Join(errs...)
+}
+
+// keyStroke identifies a key for mappings: a special key, or a rune with the Alt modifier or not.
+type keyStroke struct {
+	key tcell.Key
+	r   rune
+	alt bool
+}
+
+// keymap maps a key to the keys it types instead.
+type keymap map[keyStroke][]*tcell.EventKey
+
+// strokeOf returns the key stroke of a key event.
+func strokeOf(ev *tcell.EventKey) keyStroke {
+	switch ev.Key() {
+	case tcell.KeyRune:
+		return keyStroke{key: tcell.KeyRune, r: ev.Rune(), alt: ev.Modifiers()&tcell.ModAlt != 0}
+	case tcell.KeyBackspace:
+		return keyStroke{key: tcell.KeyBackspace2} // Terminals send either for the backspace key
+	}
+	return keyStroke{key: ev.Key()}
+}
+
+// keyNames are the special keys of the key notation, by lowercase name.
+var keyNames = map[string]tcell.Key{
+	"esc":      tcell.KeyEsc,
+	"cr":       tcell.KeyEnter,
+	"enter":    tcell.KeyEnter,
+	"return":   tcell.KeyEnter,
+	"tab":      tcell.KeyTab,
+	"bs":       tcell.KeyBackspace2,
+	"del":      tcell.KeyDelete,
+	"up":       tcell.KeyUp,
+	"down":     tcell.KeyDown,
+	"left":     tcell.KeyLeft,
+	"right":    tcell.KeyRight,
+	"home":     tcell.KeyHome,
+	"end":      tcell.KeyEnd,
+	"pageup":   tcell.KeyPgUp,
+	"pagedown": tcell.KeyPgDn,
+}
+
+// keyRunes are the keys of the key notation that type a rune, by lowercase name.
+var keyRunes = map[string]rune{
+	"space": ' ',
+	"lt":    '<',
+	"bar":   '|',
+}
+
+// parseKeys parses keys in vim's key notation: runes stand for themselves, and names in
+// angle brackets for special keys, e.g. "<Esc>", "<CR>", "<C-s>", "<M-x>", "<F5>" or "<lt>".
+// A '<' that does not start a key name is a literal '<'.
+func parseKeys(text string) ([]*tcell.EventKey, error) {
+	var keys []*tcell.EventKey
+	for text != "" {
+		if text[0] == '<' {
+			if end := strings.IndexByte(text, '>'); end > 1 {
+				key, err := parseKeyName(text[1:end])
+				if err != nil {
+					return nil, err
+				}
+				keys = append(keys, key)
+				text = text[end+1:]
+				continue
+			}
+		}
+		r, size := utf8.DecodeRuneInString(text)
+		keys = append(keys, tcell.NewEventKey(tcell.KeyRune, r, tcell.ModNone))
+		text = text[size:]
+	}
+	return keys, nil
+}
+
+// parseKeyName parses the name of a key between angle brackets, without the brackets.
+func parseKeyName(name string) (*tcell.EventKey, error) {
+	lower := strings.ToLower(name)
+	if key, ok := keyNames[lower]; ok {
+		return tcell.NewEventKey(key, 0, tcell.ModNone), nil
+	}
+	if r, ok := keyRunes[lower]; ok {
+		return tcell.NewEventKey(tcell.KeyRune, r, tcell.ModNone), nil
+	}
+	if n, err := strconv.Atoi(strings.TrimPrefix(lower, "f")); err == nil && lower[0] == 'f' && n >= 1 && n <= 64 {
+		return tcell.NewEventKey(tcell.KeyF1+tcell.Key(n-1), 0, tcell.ModNone), nil
+	}
+	if len(lower) == 3 && lower[1] == '-' {
+		switch c := rune(lower[2]); lower[0] {
+		case 'c':
+			if c >= 'a' && c <= 'z' {
+				return tcell.NewEventKey(tcell.KeyCtrlA+tcell.Key(c-'a'), 0, tcell.ModCtrl), nil
+			}
+		case 'm', 'a':
+			return tcell.NewEventKey(tcell.KeyRune, rune(name[2]), tcell.ModAlt), nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key <%s>", name)
+}
+
+// mode returns the mode key mappings apply in, or "" while a command line or prompt is shown.
+func (e *Editor) mode() string {
+	switch {
+	case len(e.cmd) > 0:
+		return ""
+	case e.inCommandMode:
+		return modeNormal
+	}
+	return modeInsert
+}
+
+// pollEvent waits for the next event. Keys of a mapping that was typed come first;
+// a key typed in a mode it is mapped in is replaced by the keys it maps to.
+// The keys a mapping types are not mapped again.
+func (e *Editor) pollEvent() tcell.Event {
+	for {
+		if len(e.mappedKeys) > 0 {
+			key := e.mappedKeys[0]
+			e.mappedKeys = e.mappedKeys[1:]
+			return key
+		}
+		ev := e.screen.PollEvent()
+		key, ok := ev.(*tcell.EventKey)
+		if !ok {
+			return ev
+		}
+		mapped, ok := e.keymaps[e.mode()][strokeOf(key)]
+		if !ok {
+			return ev
+		}
+		e.mappedKeys = slices.Clone(mapped) // An empty mapping disables the key
+	}
+}
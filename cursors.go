@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+// statusNoMoreMatches is shown when every occurrence of the word already has a cursor.
+const statusNoMoreMatches = "No more matches"
+
+// cursor is the position of one of the additional cursors of a window.
+type cursor struct {
+	x, y int
+}
+
+// before reports whether the cursor comes before the position (x, y) in the buffer.
+func (c cursor) before(x, y int) bool {
+	return c.y < y || (c.y == y && c.x < x)
+}
+
+// moved returns where the cursor is after an edit replaced the text from (x0, y0) to (x1, y1) with
+// text ending at (endX, endY), so it stays on the same text. A cursor in replaced text moves to its start.
+func (c cursor) moved(x0, y0, x1, y1, endX, endY int) cursor {
+	switch {
+	case c.before(x0, y0):
+		return c
+	case c.before(x1, y1):
+		return cursor{x: x0, y: y0}
+	case c.y == y1:
+		return cursor{x: endX + c.x - x1, y: endY}
+	default:
+		return cursor{x: c.x, y: c.y + endY - y1}
+	}
+}
+
+// moveCursors keeps the additional cursors of the windows showing the buffer on the same text
+// after an edit replaced the text from (x0, y0) to (x1, y1) with text ending at (endX, endY).
+// Cursors in replaced text move to its start.
+func (e *Editor) moveCursors(x0, y0, x1, y1, endX, endY int) {
+	for _, w := range e.windows() {
+		if w.Buffer != e.Buffer {
+			continue
+		}
+		for i, c := range w.cursors {
+			w.cursors[i] = c.moved(x0, y0, x1, y1, endX, endY)
+		}
+	}
+}
+
+// forEachCursor runs f with the editor cursor at each cursor of the current window in turn, the
+// main cursor first, and keeps the positions f moves them to. Edits f makes at one cursor move
+// the others along with the text. Cursors that end up at the same position are merged.
+func (e *Editor) forEachCursor(f func()) {
+	if len(e.cursors) == 0 {
+		f()
+		return
+	}
+
+	// The main cursor joins the others while f runs, so edits at the other cursors move it too
+	e.cursors = slices.Insert(e.cursors, 0, cursor{x: e.cursorX, y: e.cursorY})
+	for i := range e.cursors {
+		e.cursorX, e.cursorY = e.cursors[i].x, e.cursors[i].y
+		f()
+		e.cursors[i] = cursor{x: e.cursorX, y: e.cursorY}
+	}
+	e.cursorX, e.cursorY = e.cursors[0].x, e.cursors[0].y
+	e.cursors = e.cursors[1:]
+	e.mergeCursors()
+}
+
+// mergeCursors removes additional cursors at the position of the main cursor or of another cursor.
+func (e *Editor) mergeCursors() {
+	main := cursor{x: e.cursorX, y: e.cursorY}
+	var merged []cursor
+	for _, c := range e.cursors {
+		if c != main && !slices.Contains(merged, c) {
+			merged = append(merged, c)
+		}
+	}
+	e.cursors = merged
+	e.dirty = true // Mark as dirty to trigger a redraw
+}
+
+// addCursor adds a cursor to the current window, unless one is already at the position.
+// Returns: True if the cursor was added.
+func (e *Editor) addCursor(c cursor) bool {
+	if c == (cursor{x: e.cursorX, y: e.cursorY}) || slices.Contains(e.cursors, c) {
+		return false
+	}
+	e.cursors = append(e.cursors, c)
+	e.showStatus(fmt.Sprintf("%d cursors", len(e.cursors)+1))
+	return true
+}
+
+// collapseCursors removes the additional cursors, keeping the main one.
+func (e *Editor) collapseCursors() {
+	e.cursors = nil
+	e.dirty = true // Mark as dirty to trigger a redraw
+}
+
+// addCursorVertically adds a cursor on the line below the lowest cursor (down) or above the
+// highest one, in the column of the main cursor or at the end of shorter lines.
+// Parameters:
+// - down: True to add the cursor below, false to add it above.
+func (e *Editor) addCursorVertically(down bool) {
+	y := e.cursorY
+	for _, c := range e.cursors {
+		if (down && c.y > y) || (!down && c.y < y) {
+			y = c.y
+		}
+	}
+	if down {
+		y++
+	} else {
+		y--
+	}
+	if y < 0 || y >= e.text.LineCount() {
+		return
+	}
+	x := e.cursorX
+	if e.inCommandMode {
+		x = min(x, max(e.text.LineLen(y)-1, 0))
+	} else {
+		x = min(x, e.text.LineLen(y))
+	}
+	e.addCursor(cursor{x: x, y: y})
+}
+
+// addCursorAtNextMatch adds a cursor at the next occurrence of the word under the main cursor,
+// searching from the cursor added last and wrapping around the end of the buffer. The cursor is
+// placed at the same column within the occurrence as the main cursor is within the word.
+func (e *Editor) addCursorAtNextMatch() {
+	line := e.text.Line(e.cursorY)
+	start, end := e.cursorX, e.cursorX
+	for start > 0 && start <= len(line) && runeClass(line[start-1]) == classWord {
+		start--
+	}
+	for end < len(line) && runeClass(line[end]) == classWord {
+		end++
+	}
+	if start == end {
+		return // Not on a word
+	}
+	word := line[start:end]
+
+	from := cursor{x: start, y: e.cursorY}
+	if len(e.cursors) > 0 {
+		last := e.cursors[len(e.cursors)-1]
+		from = cursor{x: last.x - (e.cursorX - start), y: last.y}
+	}
+	// Search line by line from the last occurrence, around the buffer and back to it
+	count := e.text.LineCount()
+	for i := 0; i <= count; i++ {
+		y := (from.y + i) % count
+		line := e.text.Line(y)
+		for _, x := range findAll(line, word) {
+			if (i == 0 && x <= from.x) || (i == count && x >= from.x) {
+				continue
+			}
+			if (x > 0 && runeClass(line[x-1]) == classWord) || (x+len(word) < len(line) && runeClass(line[x+len(word)]) == classWord) {
+				continue // Only whole words match
+			}
+			if e.addCursor(cursor{x: x + e.cursorX - start, y: y}) {
+				return
+			}
+		}
+	}
+	e.showStatus(statusNoMoreMatches)
+}
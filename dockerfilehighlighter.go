@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Lexer states carried between lines of Dockerfiles
+const (
+	dockerStateInstruction LexState = iota // At the start of an instruction
+	dockerStateContinued                   // Continuing an instruction after a trailing backslash
+)
+
+var dockerInstructions = wordSet(`FROM RUN CMD LABEL MAINTAINER EXPOSE ENV ADD COPY ENTRYPOINT VOLUME USER
+	WORKDIR ARG ONBUILD STOPSIGNAL HEALTHCHECK SHELL`)
+
+// DockerfileHighlighter implements syntax highlighting for Dockerfiles.
+// Instruction arguments are styled as shell commands.
+type DockerfileHighlighter struct {
+	styles syntaxStyles
+	shell  *ShellHighlighter
+}
+
+// NewDockerfileHighlighter initializes a new DockerfileHighlighter with default styles.
+func NewDockerfileHighlighter(styles syntaxStyles) *DockerfileHighlighter {
+	return &DockerfileHighlighter{styles: styles, shell: NewShellHighlighter(styles)}
+}
+
+// HighlightLine returns the styled spans of a given Dockerfile line.
+// Instructions continue on the next line when the line ends with a backslash.
+func (dh *DockerfileHighlighter) HighlightLine(src []rune, state LexState) ([]StyleSpan, LexState) {
+	l := newLineLexer(src)
+	l.skipWhile(unicode.IsSpace)
+	if l.peek(0) == '#' {
+		l.emitRest(dh.styles.comment)
+		return l.spans, state // Comments do not end a continued instruction
+	}
+
+	if state == dockerStateInstruction {
+		start := l.pos
+		if word := l.word(); dockerInstructions[strings.ToUpper(word)] {
+			l.emit(start, dh.styles.keyword)
+		}
+	}
+	dh.shell.lex(l, shStateCode)
+
+	if strings.HasSuffix(strings.TrimRightFunc(string(src), unicode.IsSpace), `\`) {
+		return l.spans, dockerStateContinued
+	}
+	return l.spans, dockerStateInstruction
+}
@@ -17,101 +17,139 @@ const (
 	defaultShowLineNumbers      = true
 	defaultHighlightCurrentLine = true
 	defaultSpacesPerTab         = 4
+	defaultAutoIndent           = true
+	defaultSmartIndent          = true
 
 	// Error messages
-	errorNoFilename     = "No filename specified"
-	errorUnknownCommand = "Unknown command"
-	errorOpeningFile    = "Error opening file"
-	errorWritingFile    = "Error writing to file"
-	errorReadingFile    = "Error reading file"
+	errorNoFilename      = "No filename specified"
+	errorUnknownCommand  = "Unknown command"
+	errorOpeningFile     = "Error opening file"
+	errorWritingFile     = "Error writing to file"
+	errorReadingFile     = "Error reading file"
+	errorNoWrite         = "No write since last change (add ! to override)"
+	errorUnknownOption   = "Unknown option"
+	errorInvalidArgument = "Invalid argument"
+
+	// Status line
+	noNameBuffer   = "[No Name]" // Shown in the status line for buffers without a file
+	modifiedMarker = " [+]"      // Shown in the status line when the buffer has unsaved changes
 
 	// Command parsing
 	minCommandLength = 2 // Minimum length for a valid command (e.g., ":q")
 )
 
 // Editor holds all state for the text editor.
-// This struct encapsulates the text buffer, cursor positions, viewport offsets, and other editor settings.
-// It also manages the syntax highlighter and command input buffer.
+// This struct encapsulates the open buffers, the windows showing them, the screen, and other editor settings.
+// The fields of the current window and its buffer, such as the cursor and the text, are promoted
+// from the embedded Window. It also manages the command input buffer.
 type Editor struct {
-	// Text buffer and cursor positions
-	lines            [][]rune // Text buffer: each line is a slice of runes
-	cursorX, cursorY int      // Cursor position in the buffer
-	offsetX, offsetY int      // Viewport offset for scrolling
+	// Buffers and windows
+	*Window                  // Current window, whose buffer and cursor the editor works on
+	layout       *layoutNode // Windows on the screen
+	buffers      []*Buffer   // Open buffers, in the order they were opened
+	lastBufferID int         // Number of the most recently opened buffer
+	windowKey    bool        // True after Ctrl-W, while the key of a window command is awaited
+	windowCount  int         // Count typed before Ctrl-W
 
 	// Screen and rendering
 	screen tcell.Screen
-	style  tcell.Style
-	w, h   int // Screen dimensions (width and height)
+	theme  *Theme      // Colors of the text, gutter, status bar and highlights, fitted to the screen
+	style  tcell.Style // Default style of the theme
+	w, h   int         // Screen dimensions (width and height)
 
-	// File management
-	currentFilename string // Name of the currently loaded file
-	dirty           bool   // True if the buffer or viewport has changed
+	dirty bool // True if the buffer or viewport has changed
 
 	// Command mode
-	inCommandMode bool   // True if in command mode (like Vim)
+	inCommandMode bool   // True if in command (normal) mode (like Vim)
 	cmd           []rune // Command line input buffer
-
-	// Status and settings
-	status               string // Status message to display
-	showLineNumbers      bool   // True if line numbers should be displayed
-	highlightCurrentLine bool   // True if the current line should be highlighted
-	spacesPerTab         int    // Number of spaces to render for a tab character
-
-	// Syntax highlighting
-	highlighter *SyntaxHighlighter
+	pendingKeys   []rune // Normal mode keys typed so far for an incomplete command
+
+	// Visual mode
+	visual           visualMode   // Kind of the selection being made, or visualNone outside visual mode
+	visualX, visualY int          // Where the selection was started; the cursor is its other end
+	blockInsert      *blockInsert // Insert on the first line of a block, to repeat on its other lines
+
+	// Normal mode editing
+	registers       map[rune]register // Yanked and deleted text, by register name
+	registerName    rune              // Register named for the command being run, or 0 for the unnamed register
+	lastChange      *normalCommand    // Last repeatable change, for '.'
+	insertKeys      []*tcell.EventKey // Keys typed in insert mode after lastChange
+	recordingInsert bool              // True while insert mode keys are recorded into insertKeys
+	repeating       bool              // True while '.' replays the last change
+
+	// Status
+	status string // Status message to display
+
+	// Configuration
+	bufferDefaults  bufferOptions                // Buffer options new buffers start with, as :set last changed them
+	windowDefaults  windowOptions                // Window options new buffers are first shown with, as :set last changed them
+	filetypeOptions map[string]map[string]string // Option values by file type, from the config file
+	keymaps         map[string]keymap            // Key remappings by mode, from the config file
+	mappedKeys      []*tcell.EventKey            // Keys of an expanded mapping that were not handled yet
+
+	// Search
+	searchPattern     []rune // Last search pattern, highlighted in the viewport
+	searchForward     bool   // True if the last search was forward ('/'), false if backward ('?')
+	hideSearchMatches bool   // True if matches of searchPattern should not be highlighted
+
+	// Substitution
+	confirmMatch *matchRange // Match awaiting confirmation during :s with the 'c' flag
 }
 
 // NewEditor initializes a new Editor instance.
 // It sets up the text buffer, syntax highlighter, and default settings.
 // Parameters:
 // - screen: The tcell screen instance for rendering.
-// - style: The default style for the editor.
+// - theme: The color theme, reduced to the colors the screen supports.
 // Returns: A pointer to the newly created Editor instance.
-func NewEditor(screen tcell.Screen, style tcell.Style) *Editor {
-	highlighter := NewSyntaxHighlighter(style)
+func NewEditor(screen tcell.Screen, theme *Theme) *Editor {
+	theme = theme.forColors(screen.Colors())
+	style := theme.Style(scopeDefault)
+	highlighter := NewSyntaxHighlighter(theme)
 	tcell.StyleDefault = style // Set tcell.StyleDefault to e.style
+	screen.SetStyle(style)
+	w, h := screen.Size()
+	buffer := newBuffer(1, highlighter, defaultBufferOptions, defaultWindowOptions) // Start with one empty buffer in one window
+	window := &Window{Buffer: buffer, windowOptions: defaultWindowOptions, width: w, height: h}
 	return &Editor{
-		lines:                [][]rune{{}}, // Start with one empty line
-		cursorX:              0,
-		cursorY:              0,
-		offsetX:              0,
-		offsetY:              0,
-		inCommandMode:        false, // Start in edit (insert) mode, not command mode
-		screen:               screen,
-		style:                style,
-		dirty:                true, // Initial state is dirty to trigger a full draw
-		highlighter:          highlighter,
-		cmd:                  []rune{}, // Initialize command buffer
-		showLineNumbers:      defaultShowLineNumbers,
-		highlightCurrentLine: defaultHighlightCurrentLine,
-		spacesPerTab:         defaultSpacesPerTab, // Default to 4 spaces per tab
-	}
-}
-
-// adjustOffsets ensures the cursor is always visible in the viewport.
-// It adjusts the horizontal and vertical offsets based on the cursor position.
-func (e *Editor) adjustOffsets() {
-	// Ensure the cursor is visible horizontally
-	if cursorX := e.cursorX; cursorX < e.offsetX {
-		e.offsetX = cursorX
-		e.dirty = true // Mark as dirty to trigger a redraw
-	} else if cursorX := e.cursorX; cursorX >= e.offsetX+e.w {
-		e.offsetX = cursorX - e.w + 1
-		e.dirty = true // Mark as dirty to trigger a redraw
+		Window:         window,
+		layout:         &layoutNode{window: window},
+		buffers:        []*Buffer{buffer},
+		lastBufferID:   buffer.id,
+		inCommandMode:  false, // Start in edit (insert) mode, not command mode
+		screen:         screen,
+		theme:          theme,
+		style:          style,
+		w:              w,
+		h:              h,
+		dirty:          true,     // Initial state is dirty to trigger a full draw
+		cmd:            []rune{}, // Initialize command buffer
+		registers:      map[rune]register{},
+		bufferDefaults: defaultBufferOptions,
+		windowDefaults: defaultWindowOptions,
 	}
+}
 
-	// Ensure the cursor is visible vertically
-	if e.cursorY < e.offsetY {
-		e.offsetY = e.cursorY
-		e.dirty = true // Mark as dirty to trigger a redraw
-	} else if e.cursorY >= e.offsetY+e.h-1 {
-		e.offsetY = e.cursorY - e.h + 1
-		e.dirty = true // Mark as dirty to trigger a redraw
+// adjustOffsets ensures the cursor is always visible in the viewport of every window.
+// It adjusts the horizontal and vertical offsets based on the cursor position.
+func (e *Editor) adjustOffsets() {
+	for _, w := range e.windows() {
+		var changed bool
+		if w.wrapLines {
+			changed = e.scrollToWrappedCursor(w)
+		} else {
+			line := w.text.Line(w.cursorY)
+			column := w.bufferToVirtualX(line, w.cursorX)
+			changed = w.scrollToCursor(column, clusterAt(line, w.cursorX, w.spacesPerTab).width, e.textWidth(w))
+		}
+		if changed {
+			e.dirty = true // Mark as dirty to trigger a redraw
+		}
 	}
 }
 
-// draw renders the buffer and cursor to the screen, with Go syntax highlighting using AST.
-// It handles line numbers, current line highlighting, and the status/command bar.
+// draw renders the windows and the cursor to the screen, with syntax highlighting.
+// It handles line numbers, current line highlighting, window status lines and the status/command bar.
 // This function skips rendering if the editor is not marked as dirty.
 func (e *Editor) draw() {
 	if !e.dirty {
@@ -119,84 +157,182 @@ func (e *Editor) draw() {
 	}
 
 	e.screen.Clear()
+	for _, w := range e.windows() {
+		e.drawWindow(w)
+	}
 
-	// Calculate gutter width once
-	gutterWidth := 0
-	if e.showLineNumbers {
-		gutterWidth = len(fmt.Sprintf("%d", len(e.lines)))
+	// Draw status or command line
+	if len(e.cmd) > 0 {
+		e.drawCmd(e.cmd)
+	} else {
+		e.drawStatus()
+
+		e.screen.ShowCursor(e.cursorScreenPosition(e.Window))
 	}
 
-	// Draw visible lines
-	for y := 0; y < e.h && y+e.offsetY < len(e.lines); y++ {
-		// Reserve the last line for the status or command bar only if needed
-		if (e.inCommandMode || e.status != "") && y == e.h-1 {
-			break
-		}
+	e.screen.Show()
+	e.dirty = false // Reset dirty flag after drawing
+}
 
-		lineIndex := y + e.offsetY
-		line := e.lines[lineIndex]
-		highlightMap := e.highlighter.GetHighlightMap(line)
+// textLeft returns the screen column where the text of a window starts, after its line numbers.
+func (e *Editor) textLeft(w *Window) int {
+	if w.showLineNumbers {
+		return w.left + w.gutterWidth() + 1
+	}
+	return w.left
+}
 
-		if e.showLineNumbers {
-			// Draw line number gutter
-			lineNumber := fmt.Sprintf("%*d ", gutterWidth, lineIndex+1)
-			for x, r := range lineNumber {
-				if e.highlightCurrentLine && lineIndex == e.cursorY {
-					e.screen.SetContent(x, y, r, nil, e.style.Background(tcell.Color18))
-				} else {
-					e.screen.SetContent(x, y, r, nil, e.style)
-				}
+// gutterWidth returns the width of the line numbers of the window's buffer.
+func (w *Window) gutterWidth() int {
+	return len(fmt.Sprintf("%d", w.text.LineCount()))
+}
+
+// drawWindow renders the visible lines of a window, its status line if there are several windows,
+// and the separator to its right if another window is next to it.
+func (e *Editor) drawWindow(w *Window) {
+	current := w == e.Window
+	right := w.left + w.width
+	gutterWidth := 0
+	if w.showLineNumbers {
+		gutterWidth = w.gutterWidth()
+	}
+
+	// Draw visible lines, reserving the last line for the status line
+	left := e.textLeft(w)
+	y := 0 // Screen row within the window
+	for lineIndex := w.offsetY; y < w.textHeight() && lineIndex < w.text.LineCount(); lineIndex++ {
+		line := w.text.Line(lineIndex)
+		spans := w.highlighter.GetHighlightSpans(w.text, lineIndex)
+		var matched []bool
+		if !e.hideSearchMatches {
+			matched = e.searchMatches(line)
+		}
+		if m := e.confirmMatch; m != nil && current && m.y == lineIndex {
+			if matched == nil {
+				matched = make([]bool, len(line))
+			}
+			for i := m.start; i < m.end; i++ {
+				matched[i] = true
 			}
 		}
+		cursorLine := w.highlightCurrentLine && current && lineIndex == w.cursorY
+		selectedFrom, selectedTo := 0, 0
+		if current && e.visual != visualNone {
+			selectedFrom, selectedTo = e.selection().columns(lineIndex, line, e.spacesPerTab)
+		}
+
+		gutterStyle := e.theme.Style(scopeGutter)
+		blankStyle := e.style // Style of the space after the text of rows a wrapped line continues on
+		if cursorLine {
+			gutterStyle = e.theme.Layer(scopeCursorLine, gutterStyle)
+			blankStyle = e.theme.Layer(scopeCursorLine, blankStyle)
+		}
 
-		// Adjust starting position for content rendering
-		startX := 0
-		if e.showLineNumbers {
-			startX = gutterWidth + 1
+		// styleAt returns the style of the character at rune index i, or of the space past the end of the line
+		styleAt := func(i int) tcell.Style {
+			style := spanStyle(spans, i, e.style)
+			if cursorLine {
+				style = e.theme.Layer(scopeCursorLine, style)
+			}
+			if i < len(matched) && matched[i] {
+				style = e.theme.Layer(scopeSearch, style)
+			}
+			if i >= selectedFrom && i < selectedTo {
+				style = e.theme.Layer(scopeVisual, style)
+			}
+			if current && slices.Contains(w.cursors, cursor{x: i, y: lineIndex}) {
+				style = e.theme.Layer(scopeCursor, style)
+			}
+			return style
 		}
 
-		// Draw line content
-		for x, i, r := startX, e.offsetX, ' '; x < e.w; r = ' ' {
-			if i < len(line) {
-				r = line[i]
+		chars := clusters(line, w.spacesPerTab)
+		rows := w.rows(line, right-left)
+		for i, part := range rows {
+			if y >= w.textHeight() {
+				break
 			}
-			style := highlightMap[i]
-			if e.highlightCurrentLine && lineIndex == e.cursorY {
-				style = style.Background(tcell.Color18)
+			if w.showLineNumbers {
+				// Draw line number gutter, blank on the rows a wrapped line continues on
+				lineNumber := fmt.Sprintf("%*d ", gutterWidth, lineIndex+1)
+				if i > 0 {
+					lineNumber = fmt.Sprintf("%*s ", gutterWidth, "")
+				}
+				for x, r := range lineNumber {
+					if w.left+x < right {
+						e.screen.SetContent(w.left+x, w.top+y, r, nil, gutterStyle)
+					}
+				}
 			}
-			if r == '\t' {
-				// Render tab as spaces but treat as one character for layout
-				for range e.spacesPerTab {
-					if x < e.w {
-						e.screen.SetContent(x, y, ' ', nil, style)
+
+			x := left - w.offsetX
+			if i > 0 {
+				// Draw the wrap indicator
+				showBreak := []rune(w.showBreak)
+				for _, c := range clusters(showBreak, 1) {
+					if x+c.width <= right {
+						e.screen.SetContent(x, w.top+y, showBreak[c.start], showBreak[c.start+1:c.end], gutterStyle)
+					}
+					x += c.width
+				}
+			}
+
+			// Draw the row one character (grapheme cluster) at a time, from the scrolled column
+			for _, c := range chars {
+				if c.start < part.start || c.start >= part.end {
+					continue
+				}
+				if x >= right {
+					break
+				}
+				style := styleAt(c.start)
+				if line[c.start] == '\t' || x < left || x+c.width > right {
+					// Render tabs as spaces, and characters cut off by the edges of the window as blanks
+					for range c.width {
+						if x >= left && x < right {
+							e.screen.SetContent(x, w.top+y, ' ', nil, style)
+						}
 						x++
 					}
+					continue
+				}
+				e.screen.SetContent(x, w.top+y, line[c.start], line[c.start+1:c.end], style)
+				x += c.width
+			}
+			for k := len(line); x < right; k++ {
+				style := blankStyle
+				if i == len(rows)-1 {
+					style = styleAt(k)
+				}
+				if x >= left {
+					e.screen.SetContent(x, w.top+y, ' ', nil, style)
 				}
-				i++ // Move to the next character in the line
-				continue
+				x++
 			}
-			e.screen.SetContent(x, y, r, nil, style)
-			x++
-			i++
+			y++
 		}
 	}
 
-	// Draw status or command line
-	if e.inCommandMode {
-		e.drawCmd(e.cmd)
-	} else {
-		e.drawStatus()
-
-		cursorOffsetX := e.calculateCursorOffsetX(e.lines[e.cursorY])
-		cursorX := e.cursorX + cursorOffsetX - e.offsetX
-		if e.showLineNumbers {
-			cursorX += gutterWidth + 1
+	if e.layout.window == nil {
+		// With several windows, each has its own status line
+		style := e.theme.Style(scopeStatusLineInactive)
+		if current {
+			style = e.theme.Style(scopeStatusLine)
+		}
+		status := []rune(w.statusLine())
+		for x := range w.width {
+			r := ' '
+			if x < len(status) {
+				r = status[x]
+			}
+			e.screen.SetContent(w.left+x, w.top+w.height-1, r, nil, style)
+		}
+	}
+	if right < e.w {
+		for y := range w.height {
+			e.screen.SetContent(right, w.top+y, windowSeparator, nil, e.theme.Style(scopeStatusLineInactive))
 		}
-		e.screen.ShowCursor(cursorX, e.cursorY-e.offsetY)
 	}
-
-	e.screen.Show()
-	e.dirty = false // Reset dirty flag after drawing
 }
 
 // drawCmd draws the command line at the bottom of the screen.
@@ -209,25 +345,50 @@ func (e *Editor) drawCmd(cmd []rune) {
 
 // drawStatus draws the status message on the status bar.
 // It clears the status message after rendering.
+// Without a message and with a single window, it shows the file name and whether the buffer was modified;
+// with several windows, that is shown in each window's status line.
 func (e *Editor) drawStatus() {
 	if e.status != "" {
 		e.drawStatusBar(e.status)
 		e.status = "" // Clear status after drawing
+		return
 	}
+	if e.layout.window == nil {
+		e.drawStatusBar("")
+		return
+	}
+	e.drawStatusBar(e.statusLine())
+}
+
+// statusLine returns the file information shown in the status line of a window showing the buffer.
+func (b *Buffer) statusLine() string {
+	name := b.name()
+	if b.modified {
+		name += modifiedMarker
+	}
+	if b.format.fileFormat != fileFormatUnix {
+		name += " [" + b.format.fileFormat + "]"
+	}
+	if !b.format.finalNewline {
+		name += " [noeol]"
+	}
+	return name
 }
 
 func (e *Editor) drawStatusBar(content string) {
+	style := e.theme.Style(scopeStatusBar)
 	for x := range e.w {
-		e.screen.SetContent(x, e.h-1, ' ', nil, e.style)
+		e.screen.SetContent(x, e.h-1, ' ', nil, style)
 	}
 	for x, ch := range content {
 		if x < e.w {
-			e.screen.SetContent(x, e.h-1, ch, nil, e.style)
+			e.screen.SetContent(x, e.h-1, ch, nil, style)
 		}
 	}
 }
 
-// executeEditCommand processes the :e command to load a new file.
+// executeEditCommand processes the :e command to open a file in its own buffer.
+// The current buffer and its unsaved changes are kept.
 // Parameters:
 // - command: The full command string, including the filename.
 func (e *Editor) executeEditCommand(command string) {
@@ -236,27 +397,118 @@ func (e *Editor) executeEditCommand(command string) {
 		e.showStatus(errorNoFilename + " for :e command")
 		return
 	}
-	if err := e.loadFile(filename); err != nil {
+	if err := e.openFile(filename); err != nil {
 		e.showStatus(fmt.Sprintf("%s: %v", errorOpeningFile, err))
 	}
 }
 
-// executeQuitCommand exits the editor and cleans up resources.
-func (e *Editor) executeQuitCommand() {
+// executeQuitCommand closes the current window, or exits the editor and cleans up resources
+// if it is the last window. Buffers stay open when their window is closed.
+// It refuses to exit while any buffer has unsaved changes, unless forced.
+// Parameters:
+// - force: True to quit even if changes would be lost (:q!).
+// Returns:
+// - error: An error if a buffer has unsaved changes.
+func (e *Editor) executeQuitCommand(force bool) error {
+	if e.layout.window == nil {
+		return e.closeWindow(e.Window)
+	}
+	return e.executeQuitAllCommand(force)
+}
+
+// executeQuitAllCommand exits the editor, closing all windows (:qa).
+// It refuses to quit while any buffer has unsaved changes, unless forced.
+// Parameters:
+// - force: True to quit even if changes would be lost (:qa!).
+// Returns:
+// - error: An error if a buffer has unsaved changes.
+func (e *Editor) executeQuitAllCommand(force bool) error {
+	if b := e.modifiedBuffer(); b != nil && !force {
+		if b == e.Buffer {
+			return errors.New(errorNoWrite)
+		}
+		return fmt.Errorf("%s %d %s", errorNoWriteBuffer, b.id, errorNoWriteBufferForce)
+	}
 	e.screen.Fini()
 	os.Exit(0)
+	return nil
 }
 
-// executeReloadCommand reloads the currently loaded file.
-// If no file is loaded, it displays an error message.
-func (e *Editor) executeReloadCommand() {
-	if e.currentFilename != "" {
-		if err := e.loadFile(e.currentFilename); err != nil {
-			e.showStatus(fmt.Sprintf("%s: %v", errorReadingFile, err))
+// executeWriteQuitCommand saves the buffer and exits the editor (:wq, :x and ZZ).
+// The editor is only exited if the buffer was saved successfully.
+// Parameters:
+// - filename: The file to save to, or "" for the currently loaded file.
+// - onlyIfModified: True to skip writing when there are no unsaved changes (:x).
+// Returns:
+// - error: An error if the buffer cannot be saved.
+func (e *Editor) executeWriteQuitCommand(filename string, onlyIfModified bool) error {
+	if filename == "" {
+		filename = e.filename
+	}
+	if !onlyIfModified || e.modified {
+		if filename == "" {
+			return errors.New(errorNoFilename)
 		}
-	} else {
+		if err := e.saveFile(filename); err != nil {
+			return fmt.Errorf("%s: %w", errorWritingFile, err)
+		}
+	}
+	return e.executeQuitCommand(false)
+}
+
+// executeReloadCommand reloads the currently loaded file (:e).
+// It refuses to discard unsaved changes, unless forced. If no file is loaded, it displays an error message.
+// Parameters:
+// - force: True to reload even if changes would be lost (:e!).
+// Returns:
+// - error: An error if the buffer has unsaved changes.
+func (e *Editor) executeReloadCommand(force bool) error {
+	if e.filename == "" {
 		e.showStatus(errorNoFilename + " for :e command")
+		return nil
+	}
+	if e.modified && !force {
+		return errors.New(errorNoWrite)
 	}
+	if err := e.loadFile(e.filename); err != nil {
+		e.showStatus(fmt.Sprintf("%s: %v", errorReadingFile, err))
+	}
+	return nil
+}
+
+// executeColorschemeCommand processes the :colorscheme command to switch the color theme.
+// Without an argument it shows the name of the current theme.
+// Parameters:
+// - args: The name of the theme, bundled or from the user's theme directory.
+// Returns:
+// - error: An error if there are several arguments or the theme cannot be loaded.
+func (e *Editor) executeColorschemeCommand(args []string) error {
+	switch len(args) {
+	case 0:
+		e.showStatus(e.theme.Name())
+		return nil
+	case 1:
+	default:
+		return errors.New(errorInvalidArgument + ": " + strings.Join(args, " "))
+	}
+	theme, err := loadTheme(args[0])
+	if err != nil {
+		return err
+	}
+	e.setTheme(theme)
+	return nil
+}
+
+// setTheme switches the editor and the highlighters to a theme, reduced to the colors the screen supports.
+func (e *Editor) setTheme(theme *Theme) {
+	e.theme = theme.forColors(e.screen.Colors())
+	e.style = e.theme.Style(scopeDefault)
+	tcell.StyleDefault = e.style
+	e.screen.SetStyle(e.style)
+	for _, b := range e.buffers {
+		b.highlighter.SetTheme(e.theme)
+	}
+	e.dirty = true // Mark as dirty to trigger a redraw
 }
 
 // executeSaveAsCommand processes the :w command to save the buffer to a new file.
@@ -276,8 +528,8 @@ func (e *Editor) executeSaveAsCommand(filename string) {
 // executeSaveCommand saves the buffer to the currently loaded file.
 // If no file is loaded, it displays an error message.
 func (e *Editor) executeSaveCommand() {
-	if e.currentFilename != "" {
-		if err := e.saveFile(e.currentFilename); err != nil {
+	if e.filename != "" {
+		if err := e.saveFile(e.filename); err != nil {
 			e.showStatus(fmt.Sprintf("%s: %v", errorWritingFile, err))
 		}
 	} else {
@@ -288,19 +540,21 @@ func (e *Editor) executeSaveCommand() {
 // handleBackspace removes the character before the cursor position.
 // If the cursor is at the beginning of the line, it merges the current line with the previous line.
 func (e *Editor) handleBackspace() {
-	if e.cursorY < len(e.lines) && e.cursorX > 0 {
-		line := e.lines[e.cursorY]
-		e.lines[e.cursorY] = slices.Delete(line, e.cursorX-1, e.cursorX)
-		e.cursorX--
-		e.dirty = true // Mark as dirty
+	if x := e.indentBackspaceX(); x >= 0 {
+		// Remove a whole level of indentation made of spaces
+		e.deleteText(x, e.cursorY, e.cursorX, e.cursorY)
+		e.cursorX = x
+	} else if e.cursorY < e.text.LineCount() && e.cursorX > 0 {
+		// Remove the whole character, including its combining marks
+		x := prevCharX(e.text.Line(e.cursorY), e.cursorX)
+		e.deleteText(x, e.cursorY, e.cursorX, e.cursorY)
+		e.cursorX = x
 	} else if e.cursorY > 0 {
 		// Merge with previous line
-		prevLine := e.lines[e.cursorY-1]
-		e.cursorX = len(prevLine) // Set cursor position to the end of the previous line
-		e.lines[e.cursorY-1] = append(prevLine, e.lines[e.cursorY]...)
-		e.lines = slices.Delete(e.lines, e.cursorY, e.cursorY+1)
+		prevLen := e.text.LineLen(e.cursorY - 1)
+		e.deleteText(prevLen, e.cursorY-1, 0, e.cursorY)
+		e.cursorX = prevLen // Set cursor position to the end of the previous line
 		e.cursorY--
-		e.dirty = true // Mark as dirty
 	}
 }
 
@@ -309,7 +563,7 @@ func (e *Editor) handleBackspace() {
 func (e *Editor) handleCommandInput() {
 	for inCmd := true; inCmd; {
 		e.draw()
-		ev := e.screen.PollEvent()
+		ev := e.pollEvent()
 		switch ev := ev.(type) {
 		case *tcell.EventKey:
 			switch ev.Key() {
@@ -317,7 +571,6 @@ func (e *Editor) handleCommandInput() {
 				// Exit command input, redraw main buffer
 				e.cmd = []rune{}
 				inCmd = false
-				e.inCommandMode = false
 				e.dirty = true // Mark as dirty to trigger a redraw
 			case tcell.KeyEnter:
 				// Execute command
@@ -326,7 +579,6 @@ func (e *Editor) handleCommandInput() {
 				}
 				e.cmd = []rune{}
 				inCmd = false
-				e.inCommandMode = false
 				e.dirty = true // Mark as dirty to trigger a redraw
 			case tcell.KeyBackspace, tcell.KeyBackspace2:
 				// Remove last character from command
@@ -367,29 +619,61 @@ func (e *Editor) executeCommand(command string) error {
 		return errors.New(errorUnknownCommand + ": " + command)
 	}
 
+	if isSubstituteCommand(cmd) {
+		return e.executeSubstituteCommand(cmd)
+	}
+	if isFilterCommand(cmd) {
+		return e.executeFilterCommand(cmd)
+	}
+
 	switch parts[0] {
-	case "e":
+	case "e", "e!":
 		if len(parts) == 1 {
-			e.executeReloadCommand()
-		} else {
-			e.executeEditCommand(command)
+			return e.executeReloadCommand(parts[0] == "e!")
 		}
+		// Opening another file keeps the changes in their buffer, so :e! opens it like :e
+		e.executeEditCommand(strings.Replace(command, "e!", "e", 1))
+
 	case "w":
 		if len(parts) == 1 {
 			e.executeSaveCommand()
 		} else {
 			e.executeSaveAsCommand(strings.Join(parts[1:], " "))
 		}
-	case "q":
-		if len(parts) == 1 {
-			e.executeQuitCommand()
-		} else {
+	case "q", "q!":
+		if len(parts) > 1 {
 			return errors.New(errorUnknownCommand + ": " + command)
 		}
+		return e.executeQuitCommand(parts[0] == "q!")
+	case "qa", "qa!", "qall", "qall!":
+		if len(parts) > 1 {
+			return errors.New(errorUnknownCommand + ": " + command)
+		}
+		return e.executeQuitAllCommand(strings.HasSuffix(parts[0], "!"))
+	case "wq", "x":
+		return e.executeWriteQuitCommand(strings.Join(parts[1:], " "), parts[0] == "x")
+	case "u", "undo":
+		e.undo()
+	case "red", "redo":
+		e.redo()
+	case "set", "se":
+		return e.executeSetCommand(parts[1:])
+	case "noh", "nohlsearch":
+		e.clearSearchHighlight()
 	case "ln":
 		e.toggleShowLineNumbers()
 	case "hl":
 		e.toggleHighlightCurrentLine()
+	case "ls", "buffers", "files", "b", "buffer", "bn", "bnext", "bp", "bprevious", "bN", "bNext",
+		"bd", "bdelete", "bd!", "bdelete!":
+		return e.executeBufferCommand(parts[0], parts[1:])
+	case "sp", "split", "vs", "vsp", "vsplit", "clo", "close", "clo!", "close!", "on", "only", "on!", "only!",
+		"res", "resize", "vert", "vertical":
+		return e.executeWindowCommand(parts[0], parts[1:])
+	case "reg", "registers", "di", "display":
+		e.showStatus(e.listRegisters(strings.Join(parts[1:], "")))
+	case "colo", "colorscheme":
+		return e.executeColorschemeCommand(parts[1:])
 	default:
 		return errors.New(errorUnknownCommand + ": " + command)
 	}
@@ -397,58 +681,105 @@ func (e *Editor) executeCommand(command string) error {
 	return nil
 }
 
-// handleCommandMode processes key events in command mode.
-// It handles switching to insert mode and processing ':' commands.
+// handleCommandMode processes key events in command (normal) mode.
+// Runes are collected into vim-style commands with counts, operators and motions;
+// ':' commands and '/' and '?' searches are entered the same way.
 // Parameters:
 // - ev: The key event to process.
 func (e *Editor) handleCommandMode(ev *tcell.EventKey) {
+	if e.windowKey {
+		e.windowKey = false
+		e.handleWindowKey(ev, e.windowCount)
+		return
+	}
+	if e.visual != visualNone {
+		e.handleVisualMode(ev)
+		return
+	}
 	switch ev.Key() {
 	case tcell.KeyEsc:
+		if len(e.pendingKeys) > 0 {
+			// Cancel the pending command
+			e.pendingKeys = nil
+			return
+		}
+		if len(e.cursors) > 0 {
+			// Go back to a single cursor
+			e.collapseCursors()
+			return
+		}
 		// Switch to insert mode
 		e.inCommandMode = false
 		e.dirty = true // Mark as dirty to trigger a redraw
-	case tcell.KeyRune:
-		if ev.Rune() == ':' {
-			e.cmd = []rune{':'}
-			e.dirty = true // Mark as dirty to trigger a redraw
-			e.handleCommandInput()
+	case tcell.KeyCtrlR:
+		// Redo the last undone change
+		e.redo()
+		e.clampCursor()
+	case tcell.KeyCtrlV:
+		// Start a block selection
+		e.enterVisualMode(visualBlock)
+	case tcell.KeyCtrlN:
+		// Add a cursor at the next occurrence of the word under the cursor
+		e.pendingKeys = nil
+		e.addCursorAtNextMatch()
+	case tcell.KeyCtrlW:
+		// The next key is a window command, taking the count typed before
+		cmd, state := parseNormalCommand(e.pendingKeys)
+		e.windowCount = 0
+		if state == parseIncomplete && cmd.operator == 0 {
+			e.windowCount = cmd.count
+		}
+		e.pendingKeys = nil
+		e.windowKey = true
+	case tcell.KeyLeft:
+		e.handleNormalKey('h')
+	case tcell.KeyRight:
+		e.handleNormalKey('l')
+	case tcell.KeyUp:
+		if ev.Modifiers()&tcell.ModCtrl != 0 {
+			e.addCursorVertically(false)
+			return
 		}
+		e.handleNormalKey('k')
+	case tcell.KeyDown:
+		if ev.Modifiers()&tcell.ModCtrl != 0 {
+			e.addCursorVertically(true)
+			return
+		}
+		e.handleNormalKey('j')
+	case tcell.KeyHome:
+		e.handleNormalKey('0')
+	case tcell.KeyEnd:
+		e.handleNormalKey('$')
+	case tcell.KeyPgUp:
+		e.handlePageUp()
+		e.clampCursor()
+	case tcell.KeyPgDn:
+		e.handlePageDown()
+		e.clampCursor()
+	case tcell.KeyRune:
+		e.handleNormalKey(ev.Rune())
 	}
 }
 
 // handleDelete removes the character at the cursor position.
 // If the cursor is at the end of the line, it merges the current line with the next line.
 func (e *Editor) handleDelete() {
-	if e.cursorY < len(e.lines) && e.cursorX < len(e.lines[e.cursorY]) {
-		line := e.lines[e.cursorY]
-		e.lines[e.cursorY] = slices.Delete(line, e.cursorX, e.cursorX+1)
-		e.dirty = true // Mark as dirty
-	} else if e.cursorY < len(e.lines)-1 {
+	if e.cursorY < e.text.LineCount() && e.cursorX < e.text.LineLen(e.cursorY) {
+		e.deleteText(e.cursorX, e.cursorY, nextCharX(e.text.Line(e.cursorY), e.cursorX), e.cursorY)
+	} else if e.cursorY < e.text.LineCount()-1 {
 		// Merge with next line
-		nextLine := e.lines[e.cursorY+1]
-		e.lines[e.cursorY] = append(e.lines[e.cursorY], nextLine...)
-		e.lines = slices.Delete(e.lines, e.cursorY+1, e.cursorY+2)
-		e.dirty = true // Mark as dirty
-	}
-}
-
-// handleEnter splits the current line at the cursor position.
-// The text after the cursor is moved to a new line.
-func (e *Editor) handleEnter() {
-	if e.cursorY < len(e.lines) {
-		line := e.lines[e.cursorY]
-		newLine := slices.Clone(line[e.cursorX:])
-		e.lines[e.cursorY] = line[:e.cursorX]
-		e.lines = slices.Insert(e.lines, e.cursorY+1, newLine)
-		e.cursorY++
-		e.cursorX = 0
-		e.dirty = true // Mark as dirty to redraw
+		e.deleteText(e.cursorX, e.cursorY, 0, e.cursorY+1)
 	}
 }
 
 // handleExitInsertMode switches the editor from insert mode to command mode.
 func (e *Editor) handleExitInsertMode() {
+	e.finishBlockInsert()
+	e.history.endGroup() // Leaving insert mode ends the current undo step
+	e.recordingInsert = false
 	e.inCommandMode = true
+	e.forEachCursor(e.clampCursor)
 	e.dirty = true // Mark as dirty to trigger a redraw
 }
 
@@ -457,34 +788,47 @@ func (e *Editor) handleExitInsertMode() {
 // Parameters:
 // - ev: The key event to process.
 func (e *Editor) handleInsertMode(ev *tcell.EventKey) {
+	e.recordInsertKey(ev)
+	if len(e.cursors) > 0 && !e.history.grouping {
+		// Edits at several cursors are undone together, like the insert session of a change
+		e.history.beginGroup()
+	}
 	switch ev.Key() {
 	case tcell.KeyEsc:
 		// Switch to command mode
 		e.handleExitInsertMode()
 	case tcell.KeyRune:
 		if r := ev.Rune(); r != 0 {
-			e.handleInsertRune(r)
+			e.forEachCursor(func() { e.handleInsertRune(r) })
 		}
 	case tcell.KeyTab:
-		// Insert a tab character
-		e.handleInsertRune('\t')
+		// Insert a tab character, or spaces with expandtab
+		e.forEachCursor(e.handleTab)
 	case tcell.KeyBackspace, tcell.KeyBackspace2:
 		// Remove character before cursor or merge lines
-		e.handleBackspace()
+		e.forEachCursor(e.handleBackspace)
 	case tcell.KeyDelete:
 		// Remove character at cursor or merge lines
-		e.handleDelete()
+		e.forEachCursor(e.handleDelete)
 	case tcell.KeyEnter:
 		// Split the current line at the cursor position
-		e.handleEnter()
+		e.forEachCursor(e.handleEnter)
 	case tcell.KeyLeft:
-		e.handleMoveLeft() // Mark as dirty to redraw cursor position
+		e.forEachCursor(e.handleMoveLeft) // Mark as dirty to redraw cursor position
 	case tcell.KeyRight:
-		e.handleMoveRight() // Mark as dirty to redraw cursor position
+		e.forEachCursor(e.handleMoveRight) // Mark as dirty to redraw cursor position
 	case tcell.KeyUp:
-		e.handleMoveUp() // Mark as dirty to redraw cursor position
+		if ev.Modifiers()&tcell.ModCtrl != 0 {
+			e.addCursorVertically(false)
+			return
+		}
+		e.forEachCursor(e.handleMoveUp) // Mark as dirty to redraw cursor position
 	case tcell.KeyDown:
-		e.handleMoveDown() // Mark as dirty to redraw cursor position
+		if ev.Modifiers()&tcell.ModCtrl != 0 {
+			e.addCursorVertically(true)
+			return
+		}
+		e.forEachCursor(e.handleMoveDown) // Mark as dirty to redraw cursor position
 	case tcell.KeyPgUp:
 		// Scroll up one page minus one row
 		e.handlePageUp()
@@ -493,10 +837,16 @@ func (e *Editor) handleInsertMode(ev *tcell.EventKey) {
 		e.handlePageDown()
 	case tcell.KeyHome:
 		// Move cursor to the beginning of the current line
-		e.handleMoveToStart() // Mark as dirty to redraw
+		e.forEachCursor(e.handleMoveToStart) // Mark as dirty to redraw
 	case tcell.KeyEnd:
 		// Move cursor to the end of the current line
-		e.handleMoveToEnd() // Mark as dirty to redraw
+		e.forEachCursor(e.handleMoveToEnd) // Mark as dirty to redraw
+	case tcell.KeyCtrlZ:
+		// Undo the last change
+		e.undo()
+	case tcell.KeyCtrlY:
+		// Redo the last undone change
+		e.redo()
 	}
 }
 
@@ -505,74 +855,103 @@ func (e *Editor) handleInsertMode(ev *tcell.EventKey) {
 // - r: The rune to insert.
 func (e *Editor) handleInsertRune(r rune) {
 	// Insert character at cursor position
-	if e.cursorY >= len(e.lines) {
-		e.lines = append(e.lines, []rune{})
+	if e.cursorX > e.text.LineLen(e.cursorY) {
+		e.cursorX = e.text.LineLen(e.cursorY)
 	}
-	line := e.lines[e.cursorY]
-	if e.cursorX > len(line) {
-		e.cursorX = len(line)
+	e.dedentForCloser(r)
+	e.cursorX, e.cursorY = e.insertText(e.cursorX, e.cursorY, []rune{r})
+}
+
+// insertText inserts text at the given buffer position and records it in the undo history.
+// Parameters:
+// - x, y: The buffer position to insert at.
+// - text: The text to insert; '\n' runes split the line.
+// Returns: The buffer position right after the inserted text.
+func (e *Editor) insertText(x, y int, text []rune) (int, int) {
+	text = slices.Clone(text)
+	e.history.record(editOp{insert: true, x: x, y: y, text: text}, e.cursorX, e.cursorY)
+	return e.applyInsert(x, y, text)
+}
+
+// deleteText removes the text between two buffer positions and records it in the undo history.
+// Parameters:
+// - x0, y0: The start of the range (inclusive).
+// - x1, y1: The end of the range (exclusive).
+// Returns: The removed text, with '\n' runes for removed line breaks.
+func (e *Editor) deleteText(x0, y0, x1, y1 int) []rune {
+	text := e.applyDelete(x0, y0, x1, y1)
+	if len(text) > 0 {
+		e.history.record(editOp{insert: false, x: x0, y: y0, text: text}, e.cursorX, e.cursorY)
 	}
-	e.lines[e.cursorY] = slices.Insert(line, e.cursorX, r)
-	e.cursorX++
+	return text
+}
+
+// applyInsert inserts text at the given buffer position without recording it.
+// Returns: The buffer position right after the inserted text.
+func (e *Editor) applyInsert(x, y int, text []rune) (int, int) {
+	e.text.Insert(e.text.Offset(x, y), text)
+	endX, endY := textEnd(x, y, text)
+	e.highlighter.Edit(y, 0, endY-y)
+	e.shiftWindows(x, y, x, y, endX, endY)
+	e.moveCursors(x, y, x, y, endX, endY)
+	e.modified = true
 	e.dirty = true // Mark as dirty
+	return endX, endY
 }
 
-// calculateCursorOffsetX recalculates the virtual cursor offset based on tab widths.
-// Parameters:
-// - line: The line of text to calculate the offset for.
-// Returns: The recalculated cursor offset.
-func (e *Editor) calculateCursorOffsetX(line []rune) int {
-	offset := 0
-	maxX := min(e.cursorX, len(line))
-	for _, r := range line[:maxX] {
-		if r == '\t' {
-			offset += e.spacesPerTab - 1
-		}
+// applyDelete removes the text between two buffer positions without recording it.
+// Returns: The removed text, with '\n' runes for removed line breaks.
+func (e *Editor) applyDelete(x0, y0, x1, y1 int) []rune {
+	start := e.text.Offset(x0, y0)
+	removed := e.text.Delete(start, e.text.Offset(x1, y1)-start)
+	if len(removed) > 0 {
+		e.highlighter.Edit(y0, y1-y0, 0)
+		e.shiftWindows(x0, y0, x1, y1, x0, y0)
+		e.moveCursors(x0, y0, x1, y1, x0, y0)
+		e.modified = true
 	}
-	return offset
+	e.dirty = true // Mark as dirty
+	return removed
 }
 
-// bufferToVirtualX converts the buffer X coordinate to the virtual X coordinate.
-// It accounts for tabs by expanding them to the configured number of spaces.
-func (e *Editor) bufferToVirtualX(line []rune, bufferX int) int {
+// bufferToVirtualX converts the buffer X coordinate to the virtual X coordinate: the screen column
+// of the character at bufferX. It accounts for tabs, wide characters and combining marks.
+func (w *Window) bufferToVirtualX(line []rune, bufferX int) int {
 	virtualX := 0
-	for i := 0; i < bufferX && i < len(line); i++ {
-		if line[i] == '\t' {
-			virtualX += e.spacesPerTab
-		} else {
-			virtualX++
+	for _, c := range clusters(line, w.spacesPerTab) {
+		if c.end > bufferX {
+			return virtualX
 		}
+		virtualX += c.width
 	}
-	return virtualX
+	return virtualX + max(bufferX-len(line), 0)
 }
 
-// virtualToBufferX converts the virtual X coordinate to the buffer X coordinate.
-// It accounts for tabs by collapsing them to a single character.
-func (e *Editor) virtualToBufferX(line []rune, virtualX int) int {
-	bufferX := 0
+// virtualToBufferX converts the virtual X coordinate to the buffer X coordinate: the start of
+// the character shown at screen column virtualX, or the end of the line if it is shorter.
+func (w *Window) virtualToBufferX(line []rune, virtualX int) int {
 	currentVirtualX := 0
-	for bufferX < len(line) && currentVirtualX < virtualX {
-		if line[bufferX] == '\t' {
-			currentVirtualX += e.spacesPerTab
-		} else {
-			currentVirtualX++
-		}
+	for _, c := range clusters(line, w.spacesPerTab) {
+		currentVirtualX += c.width
 		if currentVirtualX > virtualX {
-			break
+			return c.start
 		}
-		bufferX++
 	}
-	return bufferX
+	return len(line)
 }
 
 // handleMoveDown moves the cursor down by one line.
 // It adjusts the cursor position to the end of the line if necessary.
 func (e *Editor) handleMoveDown() {
-	if e.cursorY < len(e.lines)-1 {
-		eol := e.cursorX == len(e.lines[e.cursorY])
-		virtualX := e.bufferToVirtualX(e.lines[e.cursorY], e.cursorX)
+	if e.wrapLines {
+		e.moveByRow(true)
+		return
+	}
+	if e.cursorY < e.text.LineCount()-1 {
+		eol := e.cursorX == e.text.LineLen(e.cursorY)
+		virtualX := e.bufferToVirtualX(e.text.Line(e.cursorY), e.cursorX)
 		e.cursorY++
-		nextLine := e.lines[e.cursorY]
+		nextLine := e.text.Line(e.cursorY)
 		if e.cursorX > 0 {
 			if eol || e.cursorX > len(nextLine) {
 				e.cursorX = len(nextLine)
@@ -588,10 +967,10 @@ func (e *Editor) handleMoveDown() {
 // If the cursor is at the beginning of the line, it moves to the end of the previous line.
 func (e *Editor) handleMoveLeft() {
 	if e.cursorX > 0 {
-		e.cursorX--
+		e.cursorX = prevCharX(e.text.Line(e.cursorY), e.cursorX)
 	} else if e.cursorY > 0 {
 		e.cursorY--
-		e.cursorX = len(e.lines[e.cursorY])
+		e.cursorX = e.text.LineLen(e.cursorY)
 	}
 	e.dirty = true // Mark as dirty to trigger a redraw
 }
@@ -599,9 +978,9 @@ func (e *Editor) handleMoveLeft() {
 // handleMoveRight moves the cursor one character to the right.
 // If the cursor is at the end of the line, it moves to the beginning of the next line.
 func (e *Editor) handleMoveRight() {
-	if e.cursorY < len(e.lines) && e.cursorX < len(e.lines[e.cursorY]) {
-		e.cursorX++
-	} else if e.cursorY < len(e.lines)-1 {
+	if e.cursorY < e.text.LineCount() && e.cursorX < e.text.LineLen(e.cursorY) {
+		e.cursorX = nextCharX(e.text.Line(e.cursorY), e.cursorX)
+	} else if e.cursorY < e.text.LineCount()-1 {
 		e.cursorY++
 		e.cursorX = 0
 	}
@@ -611,8 +990,8 @@ func (e *Editor) handleMoveRight() {
 // handleMoveToEnd moves the cursor to the end of the current line.
 // It adjusts the virtual cursor position to account for tab characters.
 func (e *Editor) handleMoveToEnd() {
-	if e.cursorY < len(e.lines) {
-		e.cursorX = len(e.lines[e.cursorY])
+	if e.cursorY < e.text.LineCount() {
+		e.cursorX = e.text.LineLen(e.cursorY)
 	}
 	e.dirty = true // Mark as dirty to trigger a redraw
 }
@@ -626,11 +1005,15 @@ func (e *Editor) handleMoveToStart() {
 // handleMoveUp moves the cursor up by one line.
 // It adjusts the cursor position to the end of the line if necessary.
 func (e *Editor) handleMoveUp() {
+	if e.wrapLines {
+		e.moveByRow(false)
+		return
+	}
 	if e.cursorY > 0 {
-		eol := e.cursorX == len(e.lines[e.cursorY])
-		virtualX := e.bufferToVirtualX(e.lines[e.cursorY], e.cursorX)
+		eol := e.cursorX == e.text.LineLen(e.cursorY)
+		virtualX := e.bufferToVirtualX(e.text.Line(e.cursorY), e.cursorX)
 		e.cursorY--
-		prevLine := e.lines[e.cursorY]
+		prevLine := e.text.Line(e.cursorY)
 		if e.cursorX > 0 {
 			if eol || e.cursorX > len(prevLine) {
 				e.cursorX = len(prevLine)
@@ -645,23 +1028,23 @@ func (e *Editor) handleMoveUp() {
 // handlePageDown scrolls down one page minus one row.
 // It adjusts the cursor position to stay within the visible area.
 func (e *Editor) handlePageDown() {
-	if e.offsetY < len(e.lines)-1 {
-		eol := e.cursorX == len(e.lines[e.cursorY])
-		virtualX := e.bufferToVirtualX(e.lines[e.cursorY], e.cursorX)
-		e.offsetY += e.h - 1
-		if e.offsetY > len(e.lines)-1 {
-			e.offsetY = len(e.lines) - 1
+	if e.offsetY < e.text.LineCount()-1 {
+		eol := e.cursorX == e.text.LineLen(e.cursorY)
+		virtualX := e.bufferToVirtualX(e.text.Line(e.cursorY), e.cursorX)
+		e.offsetY += e.pageLines(e.Window, true)
+		if e.offsetY > e.text.LineCount()-1 {
+			e.offsetY = e.text.LineCount() - 1
 		}
 		// Move cursor to the bottom of the screen
-		e.cursorY = e.offsetY + e.h - 1
-		if e.cursorY >= len(e.lines) {
-			e.cursorY = len(e.lines) - 1
+		e.cursorY = e.offsetY + e.pageLines(e.Window, true) - 1
+		if e.cursorY >= e.text.LineCount() {
+			e.cursorY = e.text.LineCount() - 1
 		}
 		if e.cursorX > 0 {
-			if eol || e.cursorX > len(e.lines[e.cursorY]) {
-				e.cursorX = len(e.lines[e.cursorY])
+			if eol || e.cursorX > e.text.LineLen(e.cursorY) {
+				e.cursorX = e.text.LineLen(e.cursorY)
 			} else {
-				e.cursorX = e.virtualToBufferX(e.lines[e.cursorY], virtualX)
+				e.cursorX = e.virtualToBufferX(e.text.Line(e.cursorY), virtualX)
 			}
 		}
 		e.dirty = true // Mark as dirty to redraw
@@ -672,18 +1055,18 @@ func (e *Editor) handlePageDown() {
 // It adjusts the cursor position to stay within the visible area.
 func (e *Editor) handlePageUp() {
 	if e.offsetY > 0 {
-		eol := e.cursorX == len(e.lines[e.cursorY])
-		virtualX := e.bufferToVirtualX(e.lines[e.cursorY], e.cursorX)
-		e.offsetY -= e.h - 1
+		eol := e.cursorX == e.text.LineLen(e.cursorY)
+		virtualX := e.bufferToVirtualX(e.text.Line(e.cursorY), e.cursorX)
+		e.offsetY -= e.pageLines(e.Window, false)
 		if e.offsetY < 0 {
 			e.offsetY = 0
 		}
 		e.cursorY = e.offsetY
 		if e.cursorX > 0 {
-			if eol || e.cursorX > len(e.lines[e.cursorY]) {
-				e.cursorX = len(e.lines[e.cursorY])
+			if eol || e.cursorX > e.text.LineLen(e.cursorY) {
+				e.cursorX = e.text.LineLen(e.cursorY)
 			} else {
-				e.cursorX = e.virtualToBufferX(e.lines[e.cursorY], virtualX)
+				e.cursorX = e.virtualToBufferX(e.text.Line(e.cursorY), virtualX)
 			}
 		}
 		e.dirty = true // Mark as dirty to trigger a redraw
@@ -697,75 +1080,87 @@ func (e *Editor) handlePageUp() {
 // Returns:
 // - error: An error if the file cannot be opened or read.
 func (e *Editor) loadFile(filename string) error {
-	// Parse line and column from filename
-	var line, col int
-	parts := strings.Split(filename, ":")
-	filename = filepath.Clean(parts[0])
-	if len(parts) > 1 {
-		line, _ = strconv.Atoi(parts[1])
-		line-- // Convert to zero-based index
-	}
-	if len(parts) > 2 {
-		col, _ = strconv.Atoi(parts[2])
-		col-- // Convert to zero-based index
-	}
-
+	filename, line, col := parseFilePosition(filename)
 	file, err := os.Open(filename)
 	if err != nil {
 		return fmt.Errorf("error opening file '%s': %w", filename, err)
 	}
 	defer file.Close()
 
-	e.lines = nil // Clear current buffer
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		e.lines = append(e.lines, []rune(scanner.Text()))
-	}
-	if err := scanner.Err(); err != nil {
+	text, format, err := readText(file)
+	if err != nil {
 		return fmt.Errorf("error reading file '%s': %w", filename, err)
 	}
-	if len(e.lines) == 0 {
-		e.lines = [][]rune{{}}
-	}
+	e.text = NewPieceTable(text) // Replace current buffer
+	e.format = format
 	e.cursorX, e.cursorY = 0, 0 // Reset cursor
-	if line >= 0 && line < len(e.lines) {
+	if line >= 0 && line < e.text.LineCount() {
 		e.cursorY = line
-		if col >= 0 && col < len(e.lines[line]) {
+		if col >= 0 && col < e.text.LineLen(line) {
 			e.cursorX = col
 		}
 	} // Update highlighter
-	e.highlighter.SetFileExtension(filepath.Ext(filename))
-	e.currentFilename = filename
+	e.highlighter.Detect(filename, e.text)
+	e.applyFiletypeOptions()
+	e.history.reset() // Edits to the previous buffer cannot be undone in the new one
+	e.filename = filename
+	e.modified = false
 	e.dirty = true // Mark as dirty to trigger redraw
 
 	return nil
 }
 
+// parseFilePosition splits a "file:line:col" argument into the file name and the zero-based line and column.
+// The line and column are optional; missing ones are returned as -1.
+func parseFilePosition(arg string) (string, int, int) {
+	line, col := -1, -1
+	parts := strings.Split(arg, ":")
+	if len(parts) > 1 {
+		line, _ = strconv.Atoi(parts[1])
+		line-- // Convert to zero-based index
+	}
+	if len(parts) > 2 {
+		col, _ = strconv.Atoi(parts[2])
+		col-- // Convert to zero-based index
+	}
+	return filepath.Clean(parts[0]), line, col
+}
+
 // saveFile saves the buffer to a file (entire file in memory).
-// It writes each line of the buffer to the specified file.
+// It writes each line of the buffer to a temporary file and renames it over the target,
+// so a failed save never truncates the existing file.
 // Parameters:
 // - filename: The path to the file where the buffer will be saved.
 // Returns:
-// - error: An error if the file cannot be opened or written to.
+// - error: An error if the file cannot be written, flushed or replaced.
 func (e *Editor) saveFile(filename string) error {
 	filename = filepath.Clean(filename)
 
-	file, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
-	if err != nil {
-		return fmt.Errorf("error opening file '%s': %w", filename, err)
-	}
-	defer file.Close()
-
-	writer := bufio.NewWriter(file)
-	defer writer.Flush()
-
-	for _, line := range e.lines {
-		if _, err := writer.WriteString(string(line) + "\n"); err != nil {
-			return fmt.Errorf("error writing to file '%s': %w", filename, err)
+	err := writeFileAtomic(filename, func(writer *bufio.Writer) error {
+		if e.format.bom {
+			if _, err := writer.WriteString(utf8BOM); err != nil {
+				return err
+			}
+		}
+		lineEnding := e.format.lineEnding()
+		lastLine := e.text.LineCount() - 1
+		for y := range e.text.LineCount() {
+			line := string(e.text.Line(y))
+			if y < lastLine || e.format.finalNewline {
+				line += lineEnding
+			}
+			if _, err := writer.WriteString(line); err != nil {
+				return err
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	e.currentFilename = filename
+	e.filename = filename
+	e.modified = false
 	e.showStatus("File saved: " + filename)
 	return nil
 }
@@ -798,6 +1193,6 @@ func (e *Editor) updateScreenSize() {
 	w, h := e.screen.Size()
 	if w != e.w || h != e.h {
 		e.w, e.h = w, h
-		e.dirty = true // Mark as dirty to redraw on resize
+		e.layoutWindows() // Marks as dirty to redraw on resize
 	}
 }
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	defaultFileMode fs.FileMode = 0644 // Permissions for newly created files
+
+	// File formats, named after the systems that use their line endings
+	fileFormatUnix = "unix" // Lines end with "\n"
+	fileFormatDos  = "dos"  // Lines end with "\r\n"
+
+	utf8BOM = "\uFEFF" // Byte order mark some tools put at the start of UTF-8 files
+)
+
+// textFormat records how a file's text was encoded on disk so it can be written back the same way.
+type textFormat struct {
+	fileFormat   string // Line ending style: fileFormatUnix or fileFormatDos
+	finalNewline bool   // True if the last line ends with a line break
+	bom          bool   // True if the file starts with a UTF-8 byte order mark
+}
+
+// defaultTextFormat is used for buffers that were not loaded from a file.
+var defaultTextFormat = textFormat{fileFormat: fileFormatUnix, finalNewline: true}
+
+// lineEnding returns the line break written between lines.
+func (f textFormat) lineEnding() string {
+	if f.fileFormat == fileFormatDos {
+		return "\r\n"
+	}
+	return "\n"
+}
+
+// readText reads text with '\n' separated lines and detects its on-disk format.
+// Lines may be of any length; they are never split or truncated.
+// The file is treated as dos only if every line break is "\r\n"; otherwise stray '\r'
+// runes are kept in the text so saving does not change them.
+// Returns: The text without BOM or trailing line break, and its format.
+func readText(r io.Reader) ([]rune, textFormat, error) {
+	var text []rune
+	format := defaultTextFormat // Kept for empty input, which has no line to detect the format from
+	crlf, lf := 0, 0
+
+	reader := bufio.NewReader(r)
+	for y := 0; ; y++ {
+		// ReadString grows its result as needed, so long lines are read whole
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, format, fmt.Errorf("line %d: %w", y+1, err)
+		}
+		if line == "" {
+			break
+		}
+		if y == 0 {
+			line, format.bom = strings.CutPrefix(line, utf8BOM)
+		}
+		format.finalNewline = strings.HasSuffix(line, "\n")
+		if strings.HasSuffix(line, "\r\n") {
+			crlf++
+		} else if format.finalNewline {
+			lf++
+		}
+		text = append(text, []rune(line)...)
+		if err == io.EOF {
+			break
+		}
+	}
+
+	if crlf > 0 && lf == 0 {
+		// Drop the '\r' of every line break; the format restores them on save
+		format.fileFormat = fileFormatDos
+		n := 0
+		for i, r := range text {
+			if r == '\r' && i+1 < len(text) && text[i+1] == '\n' {
+				continue
+			}
+			text[n] = r
+			n++
+		}
+		text = text[:n]
+	}
+	if format.finalNewline && len(text) > 0 {
+		text = text[:len(text)-1] // The buffer has no line after the final line break
+	}
+	return text, format, nil
+}
+
+// writeFileAtomic replaces a file with new content without ever leaving it truncated.
+// The content is written to a temporary file in the same directory, flushed to disk,
+// given the original file's permissions and ownership where possible, and then renamed
+// over the original. Symbolic links are followed so the link itself is preserved.
+// Parameters:
+// - filename: The path of the file to write.
+// - write: Writes the content to the buffered writer.
+// Returns:
+// - error: An error if any step fails; the original file is left untouched in that case.
+func writeFileAtomic(filename string, write func(w *bufio.Writer) error) (err error) {
+	if resolved, err := filepath.EvalSymlinks(filename); err == nil {
+		filename = resolved
+	}
+
+	mode := defaultFileMode
+	info, statErr := os.Stat(filename)
+	if statErr == nil {
+		mode = info.Mode().Perm()
+	} else if !errors.Is(statErr, fs.ErrNotExist) {
+		return fmt.Errorf("error reading file info '%s': %w", filename, statErr)
+	}
+
+	dir, base := filepath.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+	temp, err := os.CreateTemp(dir, "."+base+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("error creating temporary file for '%s': %w", filename, err)
+	}
+	defer func() {
+		if err != nil {
+			temp.Close()
+			os.Remove(temp.Name()) // Discard the partial copy, keeping the original intact
+		}
+	}()
+
+	writer := bufio.NewWriter(temp)
+	if err := write(writer); err != nil {
+		return fmt.Errorf("error writing to file '%s': %w", filename, err)
+	}
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("error writing to file '%s': %w", filename, err)
+	}
+	if err := temp.Sync(); err != nil {
+		return fmt.Errorf("error syncing file '%s': %w", filename, err)
+	}
+	if err := temp.Chmod(mode); err != nil {
+		return fmt.Errorf("error setting permissions of '%s': %w", filename, err)
+	}
+	if statErr == nil {
+		preserveOwner(temp, info) // Best effort: only privileged users can give files away
+	}
+	if err := temp.Close(); err != nil {
+		return fmt.Errorf("error closing file '%s': %w", filename, err)
+	}
+	if err := os.Rename(temp.Name(), filename); err != nil {
+		return fmt.Errorf("error replacing file '%s': %w", filename, err)
+	}
+
+	// Persist the rename itself; failure here does not lose data, so it is not reported
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
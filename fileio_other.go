@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import (
+	"io/fs"
+	"os"
+)
+
+// preserveOwner is a no-op on platforms without Unix file ownership.
+func preserveOwner(file *os.File, info fs.FileInfo) {}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/dlclark/regexp2"
+)
+
+// Names of the file types with a built-in highlighter
+const (
+	filetypeGo         = "go"
+	filetypeGoMod      = "gomod"
+	filetypePython     = "python"
+	filetypeJSON       = "json"
+	filetypeYAML       = "yaml"
+	filetypeMarkdown   = "markdown"
+	filetypeShell      = "sh"
+	filetypeMake       = "make"
+	filetypeDockerfile = "dockerfile"
+)
+
+// filetypeFilenames maps exact file names to file types.
+var filetypeFilenames = map[string]string{
+	"Makefile":    filetypeMake,
+	"makefile":    filetypeMake,
+	"GNUmakefile": filetypeMake,
+	"Dockerfile":  filetypeDockerfile,
+	"go.mod":      filetypeGoMod,
+	"go.work":     filetypeGoMod,
+	".bashrc":     filetypeShell,
+	".profile":    filetypeShell,
+}
+
+// filetypeExtensions maps file extensions to file types.
+var filetypeExtensions = map[string]string{
+	".go":         filetypeGo,
+	".py":         filetypePython,
+	".pyw":        filetypePython,
+	".json":       filetypeJSON,
+	".yaml":       filetypeYAML,
+	".yml":        filetypeYAML,
+	".md":         filetypeMarkdown,
+	".markdown":   filetypeMarkdown,
+	".sh":         filetypeShell,
+	".bash":       filetypeShell,
+	".zsh":        filetypeShell,
+	".mk":         filetypeMake,
+	".dockerfile": filetypeDockerfile,
+}
+
+// filetypeWrapperSuffixes are suffixes added to a file name without changing its contents' language,
+// such as templates and backups. They are stripped before looking at the name again.
+var filetypeWrapperSuffixes = []string{".tmpl", ".tpl", ".template", ".in", ".dist", ".example", ".sample", ".bak", ".orig", "~"}
+
+// filetypeAliases maps alternative names, as used by interpreters, modelines and :set filetype, to file types.
+var filetypeAliases = map[string]string{
+	"golang":       filetypeGo,
+	"go.mod":       filetypeGoMod,
+	"py":           filetypePython,
+	"python2":      filetypePython,
+	"python3":      filetypePython,
+	"md":           filetypeMarkdown,
+	"yml":          filetypeYAML,
+	"bash":         filetypeShell,
+	"zsh":          filetypeShell,
+	"dash":         filetypeShell,
+	"ksh":          filetypeShell,
+	"ash":          filetypeShell,
+	"shell":        filetypeShell,
+	"shell-script": filetypeShell,
+	"makefile":     filetypeMake,
+	"gmake":        filetypeMake,
+	"docker":       filetypeDockerfile,
+}
+
+var (
+	// vimModeline matches modelines like "vim: set ft=python:" or "vi: filetype=sh"
+	vimModeline = regexp.MustCompile(`(?:^|\s)(?:vim?|ex):.*?\b(?:ft|filetype)=([\w.+-]+)`)
+	// emacsModeline matches "-*- mode: python -*-" and the short form "-*- python -*-"
+	emacsModeline = regexp.MustCompile(`-\*-\s*(?:.*?\bmode:\s*)?([\w.+-]+)\s*(?:;.*)?-\*-`)
+	// goPackageClause matches the package clause that starts Go source files
+	goPackageClause = regexp.MustCompile(`^package \w+$`)
+)
+
+// modelineLines is how many lines at the start and at the end of a buffer are searched for a vim modeline.
+const modelineLines = 5
+
+// firstLineMatch detects a file type from a pattern matching the first line of a file.
+type firstLineMatch struct {
+	pattern  *regexp2.Regexp
+	filetype string
+}
+
+// normalizeFiletype returns the file type for a name or alias, or "" if there is no highlighter for it.
+func (sh *SyntaxHighlighter) normalizeFiletype(name string) string {
+	if _, ok := sh.factories[name]; ok {
+		return name
+	}
+	name = strings.ToLower(name)
+	if alias, ok := filetypeAliases[name]; ok {
+		name = alias
+	}
+	if _, ok := sh.factories[name]; ok {
+		return name
+	}
+	return ""
+}
+
+// detectFiletype returns the file type of a buffer, or "" if it is unknown.
+// The sources are tried in order: a modeline, the exact file name, the extension
+// (after stripping template and backup suffixes), the shebang line, the first line
+// patterns of loaded grammars and finally the content.
+func (sh *SyntaxHighlighter) detectFiletype(filename string, text TextBuffer) string {
+	if filetype := sh.filetypeFromModeline(text); filetype != "" {
+		return filetype
+	}
+	if filetype := sh.filetypeFromName(filepath.Base(filename)); filetype != "" {
+		return filetype
+	}
+	if text == nil || text.LineCount() == 0 {
+		return ""
+	}
+	firstLine := string(text.Line(0))
+	if filetype := sh.filetypeFromShebang(firstLine); filetype != "" {
+		return filetype
+	}
+	for _, match := range sh.firstLines {
+		if ok, _ := match.pattern.MatchString(firstLine); ok {
+			return match.filetype
+		}
+	}
+	return filetypeFromContent(text)
+}
+
+// filetypeFromName detects the file type from a file name and its extension.
+func (sh *SyntaxHighlighter) filetypeFromName(base string) string {
+	for base != "" {
+		if filetype, ok := sh.filenames[base]; ok {
+			return filetype
+		}
+		if filetype, ok := sh.extensions[strings.ToLower(filepath.Ext(base))]; ok {
+			return filetype
+		}
+		if strings.HasPrefix(base, "Dockerfile.") || strings.HasSuffix(base, ".Dockerfile") {
+			return filetypeDockerfile
+		}
+		stripped := base
+		for _, suffix := range filetypeWrapperSuffixes {
+			stripped = strings.TrimSuffix(stripped, suffix)
+		}
+		if stripped == base {
+			break
+		}
+		base = stripped
+	}
+	return ""
+}
+
+// filetypeFromShebang detects the file type from a "#!" line naming the interpreter,
+// e.g. "#!/bin/sh" or "#!/usr/bin/env -S python3 -u".
+func (sh *SyntaxHighlighter) filetypeFromShebang(line string) string {
+	if !strings.HasPrefix(line, "#!") {
+		return ""
+	}
+	fields := strings.Fields(line[2:])
+	for i, field := range fields {
+		interpreter := filepath.Base(field)
+		if interpreter == "env" || (i > 0 && strings.HasPrefix(field, "-")) {
+			continue // Look past env and its options at the actual interpreter
+		}
+		return sh.normalizeFiletype(strings.TrimRight(interpreter, "0123456789."))
+	}
+	return ""
+}
+
+// filetypeFromModeline detects the file type from a vim modeline in the first or last lines,
+// or an emacs mode line in the first two lines.
+func (sh *SyntaxHighlighter) filetypeFromModeline(text TextBuffer) string {
+	if text == nil {
+		return ""
+	}
+	n := text.LineCount()
+	for y := range min(2, n) {
+		if m := emacsModeline.FindStringSubmatch(string(text.Line(y))); m != nil {
+			if filetype := sh.normalizeFiletype(m[1]); filetype != "" {
+				return filetype
+			}
+		}
+	}
+	for y := 0; y < n; y++ {
+		if y == modelineLines {
+			y = max(y, n-modelineLines) // Only the first and last lines can hold a modeline
+		}
+		if m := vimModeline.FindStringSubmatch(string(text.Line(y))); m != nil {
+			if filetype := sh.normalizeFiletype(m[1]); filetype != "" {
+				return filetype
+			}
+		}
+	}
+	return ""
+}
+
+// filetypeFromContent guesses the file type from the first non-blank line of the buffer.
+func filetypeFromContent(text TextBuffer) string {
+	for y := range text.LineCount() {
+		line := strings.TrimSpace(string(text.Line(y)))
+		if line == "" {
+			continue
+		}
+		switch {
+		case goPackageClause.MatchString(line):
+			return filetypeGo
+		case line == "---" || strings.HasPrefix(line, "--- ") || strings.HasPrefix(line, "%YAML"):
+			return filetypeYAML
+		case line == "{" || line == "[" || strings.HasPrefix(line, `{"`) || strings.HasPrefix(line, "[{") ||
+			strings.HasPrefix(line, `["`):
+			return filetypeJSON
+		case strings.HasPrefix(line, "FROM ") || strings.HasPrefix(line, "# syntax=docker/"):
+			return filetypeDockerfile
+		}
+		return ""
+	}
+	return ""
+}
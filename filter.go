@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// errorShellCommand is the error message of a shell command that failed.
+const errorShellCommand = "Shell command failed"
+
+// isFilterCommand reports whether an ex command (without the ':') is a :! command.
+func isFilterCommand(cmd string) bool {
+	return strings.HasPrefix(strings.TrimLeft(cmd, rangeCharacters), "!")
+}
+
+// runShellCommand runs a command with the user's shell, or sh if $SHELL is not set.
+// Parameters:
+// - command: The command line to run.
+// - input: The text to write to the command's standard input.
+// Returns: The command's standard output, or an error with its standard error output if it failed.
+func runShellCommand(command string, input []byte) ([]byte, error) {
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "sh"
+	}
+	var stderr bytes.Buffer
+	c := exec.Command(shell, "-c", command)
+	c.Stdin = bytes.NewReader(input)
+	c.Stderr = &stderr
+	output, err := c.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, errors.New(errorShellCommand + ": " + msg)
+		}
+		return nil, fmt.Errorf("%s: %w", errorShellCommand, err)
+	}
+	return output, nil
+}
+
+// executeFilterCommand processes the :! command. With a range, such as "'<,'>!sort", the lines are
+// replaced by the output of the shell command they are written to; without one, the command is
+// run and its output shown in the status bar.
+// Parameters:
+// - cmd: The command string after the ':', including the optional range.
+// Returns:
+// - error: An error if the range is invalid or the command fails; the lines are then kept.
+func (e *Editor) executeFilterCommand(cmd string) error {
+	startY, endY, rest, err := e.parseRange(cmd)
+	if err != nil {
+		return err
+	}
+	command := strings.TrimSpace(rest[1:])
+	if command == "" {
+		return errors.New(errorInvalidArgument + ": " + cmd)
+	}
+
+	if rest == cmd {
+		// No range: only run the command
+		output, err := runShellCommand(command, nil)
+		if err != nil {
+			return err
+		}
+		e.showStatus(strings.Join(strings.Fields(string(output)), " "))
+		return nil
+	}
+
+	var input []rune
+	for y := startY; y <= endY; y++ {
+		input = append(append(input, e.text.Line(y)...), '\n')
+	}
+	output, err := runShellCommand(command, []byte(string(input)))
+	if err != nil {
+		return err
+	}
+
+	// The replacement is undone in one step
+	e.history.beginGroup()
+	defer e.history.endGroup()
+
+	lines := endY - startY + 1
+	text := []rune(strings.TrimSuffix(string(output), "\n"))
+	e.deleteText(0, startY, e.text.LineLen(endY), endY)
+	switch {
+	case len(text) > 0:
+		e.insertText(0, startY, text)
+	case startY+1 < e.text.LineCount():
+		e.deleteText(0, startY, 0, startY+1) // No output: remove the lines
+	case startY > 0:
+		e.deleteText(e.text.LineLen(startY-1), startY-1, 0, startY)
+		startY--
+	}
+	e.cursorX, e.cursorY = e.firstNonBlank(startY), startY
+	e.showStatus(fmt.Sprintf("%d line%s filtered", lines, plural(lines)))
+	return nil
+}
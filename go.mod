@@ -3,14 +3,17 @@ module github.com/bkmeneguello/goed
 go 1.23.3
 
 require (
+	github.com/BurntSushi/toml v1.5.0
+	github.com/dlclark/regexp2 v1.11.5
 	github.com/gdamore/tcell/v2 v2.8.1
+	github.com/rivo/uniseg v0.4.7
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/gdamore/encoding v1.0.1 // indirect
 	github.com/lucasb-eyer/go-colorful v1.2.0 // indirect
 	github.com/mattn/go-runewidth v0.0.16 // indirect
-	github.com/rivo/uniseg v0.4.7 // indirect
 	golang.org/x/sys v0.29.0 // indirect
 	golang.org/x/term v0.28.0 // indirect
 	golang.org/x/text v0.21.0 // indirect
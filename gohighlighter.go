@@ -3,6 +3,7 @@ package main
 import (
 	"go/scanner"
 	"go/token"
+	"strings"
 	"unicode/utf8"
 
 	"github.com/gdamore/tcell/v2"
@@ -17,48 +18,80 @@ type GoHighlighter struct {
 	defaultStyle  tcell.Style
 }
 
-// NewGoHighlighter initializes a new GoHighlighter with default styles.
-func NewGoHighlighter(baseStyle tcell.Style) *GoHighlighter {
+// NewGoHighlighter initializes a new GoHighlighter with the styles of a theme.
+func NewGoHighlighter(theme *Theme) *GoHighlighter {
 	return &GoHighlighter{
 		styles: map[token.Token]tcell.Style{
-			token.COMMENT: baseStyle.Foreground(tcell.ColorGray),
-			token.IDENT:   baseStyle.Foreground(tcell.ColorOrange),
-			token.INT:     baseStyle.Foreground(tcell.ColorIndianRed),
-			token.FLOAT:   baseStyle.Foreground(tcell.ColorRed),
-			token.IMAG:    baseStyle.Foreground(tcell.ColorOrangeRed),
-			token.CHAR:    baseStyle.Foreground(tcell.ColorPurple),
-			token.STRING:  baseStyle.Foreground(tcell.ColorGreen),
+			token.COMMENT: theme.Style(scopeComment),
+			token.IDENT:   theme.Style(scopeIdentifier),
+			token.INT:     theme.Style(scopeNumber),
+			token.FLOAT:   theme.Style(scopeNumber),
+			token.IMAG:    theme.Style(scopeNumber),
+			token.CHAR:    theme.Style(scopeCharacter),
+			token.STRING:  theme.Style(scopeString),
 		},
-		literalStyle:  baseStyle.Foreground(tcell.ColorGreen),
-		operatorStyle: baseStyle.Foreground(tcell.ColorBlue),
-		keywordStyle:  baseStyle.Foreground(tcell.ColorBlue),
-		defaultStyle:  baseStyle,
+		literalStyle:  theme.Style(scopeString),
+		operatorStyle: theme.Style(scopeOperator),
+		keywordStyle:  theme.Style(scopeKeyword),
+		defaultStyle:  theme.Style(scopeDefault),
 	}
 }
 
-// GetHighlightMap returns a map of rune positions to styles for a given Go source line.
-func (gh *GoHighlighter) GetHighlightMap(src []rune) map[int]tcell.Style {
+// Lexer states carried between lines of Go source
+const (
+	goStateCode         LexState = iota // Plain code
+	goStateBlockComment                 // Inside a /* ... */ comment
+	goStateRawString                    // Inside a `...` raw string literal
+)
+
+// HighlightLine returns the styled spans of a given Go source line.
+// Block comments and raw strings may span lines: a line starting inside one is styled
+// up to its closing delimiter before the rest is scanned as code.
+func (gh *GoHighlighter) HighlightLine(src []rune, state LexState) ([]StyleSpan, LexState) {
+	var spans []StyleSpan
+
+	// Finish a comment or raw string left open by a previous line
+	start := 0
+	if state != goStateCode {
+		closing, style := []rune("*/"), gh.styles[token.COMMENT]
+		if state == goStateRawString {
+			closing, style = []rune("`"), gh.styles[token.STRING]
+		}
+		end := indexRunes(src, closing)
+		if end < 0 {
+			return appendSpan(spans, 0, len(src), style), state // The whole line is inside the token
+		}
+		start = end + len(closing)
+		spans = appendSpan(spans, 0, start, style)
+	}
+
 	fset := token.NewFileSet()
 	var s scanner.Scanner
-	srcBytes := gh.runesToBytes(src) // Convert []rune to []byte efficiently
+	srcBytes, runeIndex := gh.runesToBytes(src[start:]) // Convert []rune to []byte efficiently
 	file := fset.AddFile("", fset.Base(), len(srcBytes))
 	s.Init(file, srcBytes, nil, scanner.ScanComments)
 
-	highlight := map[int]tcell.Style{}
-
+	state = goStateCode
 	for {
 		posn, tok, lit := s.Scan()
 		if tok == token.EOF {
 			break
 		}
-		start := file.Offset(posn)
-		end := start
+		begin := file.Offset(posn)
+		end := begin
 		if lit == "" {
 			end += len(tok.String())
 		} else {
 			end += len(lit)
 		}
 
+		// Detect comments and raw strings that continue on the next line
+		if tok == token.COMMENT && strings.HasPrefix(lit, "/*") && (len(lit) < 4 || !strings.HasSuffix(lit, "*/")) {
+			state = goStateBlockComment
+		} else if tok == token.STRING && strings.HasPrefix(lit, "`") && (len(lit) < 2 || !strings.HasSuffix(lit, "`")) {
+			state = goStateRawString
+		}
+
 		// Determine style based on token type
 		style := gh.defaultStyle
 		if s, ok := gh.styles[tok]; ok {
@@ -71,22 +104,29 @@ func (gh *GoHighlighter) GetHighlightMap(src []rune) map[int]tcell.Style {
 			style = gh.keywordStyle
 		}
 
-		for i := start; i < end; i++ {
-			highlight[i] = style
+		// Token offsets are in bytes; spans are in runes
+		end = min(end, len(srcBytes))
+		if begin < end && style != gh.defaultStyle {
+			spans = appendSpan(spans, start+runeIndex[begin], start+runeIndex[end-1]+1, style)
 		}
 	}
-	return highlight
+	return spans, state
 }
 
-func (gh *GoHighlighter) runesToBytes(src []rune) []byte {
+// runesToBytes encodes src as UTF-8 and returns, for every byte, the index of the rune it belongs to.
+func (gh *GoHighlighter) runesToBytes(src []rune) ([]byte, []int) {
 	// Allocate enough space: max 4 bytes per rune
 	buf := make([]byte, 0, len(src)*utf8.UTFMax)
+	runeIndex := make([]int, 0, len(src)*utf8.UTFMax)
 
-	for _, r := range src {
+	for i, r := range src {
 		var tmp [utf8.UTFMax]byte
 		n := utf8.EncodeRune(tmp[:], r)
 		buf = append(buf, tmp[:n]...)
+		for range n {
+			runeIndex = append(runeIndex, i)
+		}
 	}
 
-	return buf
+	return buf, runeIndex
 }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+var goModDirectives = wordSet("module go toolchain godebug require replace exclude retract tool ignore")
+
+// GoModHighlighter implements syntax highlighting for go.mod and go.work files.
+type GoModHighlighter struct {
+	styles syntaxStyles
+}
+
+// NewGoModHighlighter initializes a new GoModHighlighter with default styles.
+func NewGoModHighlighter(styles syntaxStyles) *GoModHighlighter {
+	return &GoModHighlighter{styles: styles}
+}
+
+// HighlightLine returns the styled spans of a given go.mod line.
+// Directives are styled as keywords and module versions as numbers.
+func (gh *GoModHighlighter) HighlightLine(src []rune, state LexState) ([]StyleSpan, LexState) {
+	l := newLineLexer(src)
+	for !l.eof() {
+		start := l.pos
+		r := l.peek(0)
+		switch {
+		case l.hasPrefix("//"):
+			l.emitRest(gh.styles.comment)
+		case r == '"' || r == '`':
+			l.pos++
+			l.quoted(string(r), r == '"')
+			l.emit(start, gh.styles.str)
+		case l.hasPrefix("=>"):
+			l.pos += 2
+			l.emit(start, gh.styles.operator)
+		case strings.ContainsRune("()[],", r):
+			l.pos++
+			l.emit(start, gh.styles.operator)
+		case unicode.IsSpace(r):
+			l.skipWhile(unicode.IsSpace)
+		default:
+			word := string(l.src[start : start+l.skipWhile(func(r rune) bool {
+				return !unicode.IsSpace(r) && !strings.ContainsRune(`()[],"`+"`", r)
+			})])
+			switch {
+			case goModDirectives[word] && strings.TrimSpace(string(src[:start])) == "":
+				l.emit(start, gh.styles.keyword)
+			case isGoModVersion(word):
+				l.emit(start, gh.styles.number)
+			}
+		}
+	}
+	return l.spans, state
+}
+
+// isGoModVersion reports whether word is a version such as v1.2.3, v0.0.0-2024... or a go version like 1.23.3.
+func isGoModVersion(word string) bool {
+	word = strings.TrimPrefix(word, "v")
+	return word != "" && unicode.IsDigit(rune(word[0])) && strings.Count(word, ".") >= 1
+}
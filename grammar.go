@@ -0,0 +1,496 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dlclark/regexp2"
+	"github.com/gdamore/tcell/v2"
+)
+
+// grammarMatchTimeout bounds the time a single grammar pattern may spend on a line,
+// so a pathological pattern cannot freeze the editor.
+const grammarMatchTimeout = 50 * time.Millisecond
+
+// grammarMaxEmptyMatches is how many empty matches in a row are allowed at the same position
+// before the lexer skips a rune, guarding against grammars that push and pop without consuming text.
+const grammarMaxEmptyMatches = 32
+
+// grammarMaxStackDepth bounds the number of contexts on the lexer stack. Rules that would push
+// contexts past it match without pushing them, so deeply nested or unbalanced text cannot grow the
+// stack, and with it the lexer states, without bound.
+const grammarMaxStackDepth = 64
+
+// grammarMaxStates bounds the number of context stacks a highlighter remembers as lexer states.
+// Past it, lines continue from the innermost part of their stack that already has a state.
+const grammarMaxStates = 4096
+
+// backReference matches references to begin captures in TextMate end and while patterns, e.g. \1.
+var backReference = regexp.MustCompile(`\\([0-9])`)
+
+// grammar is a language definition loaded from a TextMate or Sublime Text syntax file.
+// Both formats are compiled to a stack machine of contexts: a rule may push contexts,
+// which are left again by their end pattern (TextMate) or by a popping rule (Sublime).
+type grammar struct {
+	name       string                     // Display name, e.g. "Rust"
+	scopeName  string                     // Root scope, e.g. "source.rust"
+	fileTypes  []string                   // File extensions without the dot, or exact file names
+	firstLine  string                     // Pattern matching the first line of files in this language
+	root       *grammarContext            // Context at the start of a file
+	registry   map[string]*grammar        // Loaded grammars by scope name, for includes of other languages
+	repository map[string]*grammarContext // Named contexts, for includes like "source.x#name"
+	contexts   []*grammarContext          // All contexts of the grammar
+}
+
+// grammarContext is a set of rules that are active together, with the scopes applied to its text.
+type grammarContext struct {
+	metaScope    string         // Scope of all text matched while the context is on the stack
+	contentScope string         // Scope of the text between the rules' matches
+	rules        []*grammarRule // Rules in priority order; includes are resolved lazily
+	end          *grammarRule   // Pattern that leaves the context (TextMate begin/end rules)
+	endLast      bool           // True if the end pattern loses ties against the other rules
+	while        *grammarRule   // Pattern each following line must start with to stay in the context
+	flat         []*grammarRule // Rules with includes resolved, once computed
+}
+
+// grammarRule is a pattern with the scopes it applies and how it changes the context stack.
+type grammarRule struct {
+	source   string            // Pattern source; end and while patterns may refer to begin captures
+	regexp   *regexp2.Regexp   // Compiled pattern, or nil if it refers to begin captures or did not compile
+	scope    string            // Scope of the whole match
+	captures map[int]string    // Scopes of capture groups
+	pop      int               // Number of contexts left after the match
+	push     []*grammarContext // Contexts entered after the match, the last one on top
+
+	include      *grammarContext // Context whose rules are included in place of this rule
+	includeScope string          // Scope of another grammar whose rules are included, e.g. "source.js"
+	includeName  string          // Repository entry of that grammar, or "" for its root
+}
+
+// newGrammar creates an empty grammar with a root context.
+func newGrammar(name, scopeName string) *grammar {
+	g := &grammar{name: name, scopeName: scopeName, repository: map[string]*grammarContext{}}
+	g.root = g.newContext()
+	return g
+}
+
+// newContext creates a context of the grammar.
+func (g *grammar) newContext() *grammarContext {
+	c := &grammarContext{}
+	g.contexts = append(g.contexts, c)
+	return c
+}
+
+// filetype returns the file type name under which the grammar is registered,
+// derived from the last element of its scope name, e.g. "rust" for "source.rust".
+func (g *grammar) filetype() string {
+	name := g.scopeName
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+	if name == "" {
+		name = strings.ToLower(strings.ReplaceAll(g.name, " ", "-"))
+	}
+	return name
+}
+
+// compilePattern compiles a grammar pattern, which uses Oniguruma syntax.
+// Returns: nil if the pattern uses a construct that is not supported.
+func compilePattern(source string) *regexp2.Regexp {
+	re, err := regexp2.Compile(source, regexp2.None)
+	if err != nil {
+		return nil
+	}
+	re.MatchTimeout = grammarMatchTimeout
+	return re
+}
+
+// compile compiles every rule pattern that does not depend on begin captures.
+func (g *grammar) compile() {
+	compile := func(r *grammarRule) {
+		if r != nil && r.source != "" && r.regexp == nil && !backReference.MatchString(r.source) {
+			r.regexp = compilePattern(r.source)
+		}
+	}
+	for _, c := range g.contexts {
+		for _, r := range c.rules {
+			compile(r)
+		}
+		compile(c.end)
+		compile(c.while)
+	}
+}
+
+// rules returns the rules of a context with all includes resolved.
+func (g *grammar) rules(c *grammarContext) []*grammarRule {
+	if c.flat == nil {
+		c.flat = g.flatten(c, map[*grammarContext]bool{}, nil)
+	}
+	return c.flat
+}
+
+// flatten appends the rules of a context to rules, replacing includes by the included rules.
+// Contexts already visited are skipped, so recursive includes terminate.
+func (g *grammar) flatten(c *grammarContext, visited map[*grammarContext]bool, rules []*grammarRule) []*grammarRule {
+	if visited[c] {
+		return rules
+	}
+	visited[c] = true
+	for _, r := range c.rules {
+		switch {
+		case r.include != nil:
+			rules = g.flatten(r.include, visited, rules)
+		case r.includeScope != "":
+			other := g.registry[r.includeScope]
+			if other == nil {
+				continue
+			}
+			included := other.root
+			if r.includeName != "" {
+				included = other.repository[r.includeName]
+			}
+			if included != nil {
+				rules = other.flatten(included, visited, rules)
+			}
+		case r.regexp != nil:
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
+
+// grammarFrame is a context on the lexer stack.
+type grammarFrame struct {
+	context *grammarContext
+	end     *grammarRule // End pattern with references to begin captures resolved
+	while   *grammarRule // While pattern with references to begin captures resolved
+}
+
+// GrammarHighlighter implements syntax highlighting driven by a TextMate or Sublime Text grammar.
+// The lexer state is an index into the context stacks seen so far.
+type GrammarHighlighter struct {
+	grammar  *grammar
+	styles   syntaxStyles
+	stacks   [][]grammarFrame        // Context stacks by lexer state
+	states   map[string]LexState     // Lexer states by stack key
+	resolved map[string]*grammarRule // Compiled end and while patterns by source
+	scopes   map[string]scopeStyle   // Styles by scope, once looked up
+}
+
+// scopeStyle is the style of a scope, if it has one.
+type scopeStyle struct {
+	style tcell.Style
+	ok    bool
+}
+
+// NewGrammarHighlighter initializes a new GrammarHighlighter for a loaded grammar.
+func NewGrammarHighlighter(g *grammar, styles syntaxStyles) *GrammarHighlighter {
+	gh := &GrammarHighlighter{
+		grammar:  g,
+		styles:   styles,
+		states:   map[string]LexState{},
+		resolved: map[string]*grammarRule{},
+		scopes:   map[string]scopeStyle{},
+	}
+	gh.state([]grammarFrame{{context: g.root}}) // State zero is the start of a file
+	return gh
+}
+
+// stackKey returns the text identifying a context stack among the lexer states.
+func stackKey(stack []grammarFrame) string {
+	var key strings.Builder
+	for _, f := range stack {
+		fmt.Fprintf(&key, "%p", f.context) // Contexts may come from other grammars
+		if f.end != nil {
+			key.WriteString("\x00" + f.end.source)
+		}
+		if f.while != nil {
+			key.WriteString("\x00" + f.while.source)
+		}
+		key.WriteString("\x01")
+	}
+	return key.String()
+}
+
+// state returns the lexer state for a context stack, registering it if it is new and there is room.
+func (gh *GrammarHighlighter) state(stack []grammarFrame) LexState {
+	key := stackKey(stack)
+	if state, ok := gh.states[key]; ok {
+		return state
+	}
+	if len(gh.stacks) >= grammarMaxStates {
+		for n := len(stack) - 1; n > 1; n-- {
+			if state, ok := gh.states[stackKey(stack[:n])]; ok {
+				return state
+			}
+		}
+		return 0
+	}
+	state := LexState(len(gh.stacks))
+	gh.stacks = append(gh.stacks, stack)
+	gh.states[key] = state
+	return state
+}
+
+// HighlightLine returns the styled spans of a given line according to the grammar.
+func (gh *GrammarHighlighter) HighlightLine(src []rune, state LexState) ([]StyleSpan, LexState) {
+	if int(state) >= len(gh.stacks) {
+		state = 0
+	}
+	stack := append([]grammarFrame(nil), gh.stacks[state]...)
+	line := append(append(make([]rune, 0, len(src)+1), src...), '\n') // Patterns expect the line break
+	l := &grammarLexer{gh: gh, src: src, line: line, matches: map[*grammarRule]*regexp2.Match{}}
+
+	// Contexts with a while pattern are left unless the line continues them
+	for i := 1; i < len(stack); i++ {
+		if stack[i].while == nil {
+			continue
+		}
+		m := l.find(stack[i].while)
+		if m == nil || m.Index != l.pos {
+			stack = stack[:i]
+			break
+		}
+		l.style(stack[:i+1], stack[i].while, m, false)
+		l.pos = m.Index + m.Length
+	}
+
+	empty := 0
+	for l.pos <= len(src) {
+		top := stack[len(stack)-1]
+		rule, m := l.next(top)
+		if m == nil {
+			l.styleText(stack, len(line))
+			break
+		}
+		l.styleText(stack, m.Index)
+		if m.Length == 0 {
+			if empty++; empty > grammarMaxEmptyMatches {
+				if l.pos >= len(src) {
+					break
+				}
+				l.styleText(stack, l.pos+1) // Skip a rune to make progress
+				empty = 0
+				continue
+			}
+		} else {
+			empty = 0
+		}
+
+		// A match of the end pattern is styled as part of the context it leaves
+		l.style(stack, rule, m, rule == top.end)
+		l.pos = m.Index + m.Length
+		if rule == top.end {
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		stack = stack[:max(len(stack)-rule.pop, 1)]
+		for _, c := range rule.push {
+			if len(stack) >= grammarMaxStackDepth {
+				break
+			}
+			stack = append(stack, gh.frame(c, m))
+		}
+	}
+	return l.spans, gh.state(stack)
+}
+
+// frame creates the stack frame for a pushed context, resolving references
+// to the begin captures in its end and while patterns.
+func (gh *GrammarHighlighter) frame(c *grammarContext, begin *regexp2.Match) grammarFrame {
+	return grammarFrame{context: c, end: gh.resolve(c.end, begin), while: gh.resolve(c.while, begin)}
+}
+
+// resolve returns a rule whose pattern has the references to begin captures replaced by the captured text.
+func (gh *GrammarHighlighter) resolve(r *grammarRule, begin *regexp2.Match) *grammarRule {
+	if r == nil || r.regexp != nil || r.source == "" {
+		return r
+	}
+	source := backReference.ReplaceAllStringFunc(r.source, func(ref string) string {
+		n, _ := strconv.Atoi(ref[1:])
+		if g := begin.GroupByNumber(n); g != nil {
+			return regexp2.Escape(g.String())
+		}
+		return ""
+	})
+	if resolved, ok := gh.resolved[source]; ok {
+		return resolved
+	}
+	resolved := &grammarRule{source: source, regexp: compilePattern(source), scope: r.scope, captures: r.captures}
+	gh.resolved[source] = resolved
+	return resolved
+}
+
+// scopeStyle returns the style of the innermost scope in scopes that has one.
+// Each scope may itself be a space separated list of scope names.
+func (gh *GrammarHighlighter) scopeStyle(scopes []string) (tcell.Style, bool) {
+	for i := len(scopes) - 1; i >= 0; i-- {
+		names := strings.Fields(scopes[i])
+		for j := len(names) - 1; j >= 0; j-- {
+			cached, ok := gh.scopes[names[j]]
+			if !ok {
+				cached.style, cached.ok = gh.styles.forScope(names[j])
+				gh.scopes[names[j]] = cached
+			}
+			if cached.ok {
+				return cached.style, true
+			}
+		}
+	}
+	return tcell.Style{}, false
+}
+
+// grammarLexer holds the progress of highlighting one line with a grammar.
+type grammarLexer struct {
+	gh      *GrammarHighlighter
+	src     []rune // The line without its line break
+	line    []rune // The line with a line break, as matched by the patterns
+	pos     int
+	spans   []StyleSpan
+	matches map[*grammarRule]*regexp2.Match // Last match found for each rule on the line, or nil
+}
+
+// find returns the first match of a rule at or after the current position, or nil.
+// As the position only moves forward on a line, the match found by an earlier search is
+// still the first one while the position has not passed it, and no match stays no match;
+// only patterns anchored to the search position with \G are searched again.
+func (l *grammarLexer) find(r *grammarRule) *regexp2.Match {
+	if r == nil || r.regexp == nil {
+		return nil
+	}
+	if m, ok := l.matches[r]; ok && (m == nil || m.Index >= l.pos) {
+		return m
+	}
+	m, err := r.regexp.FindRunesMatchStartingAt(l.line, l.pos)
+	if err != nil {
+		m = nil // Timed out
+	}
+	if !strings.Contains(r.source, `\G`) {
+		l.matches[r] = m
+	}
+	return m
+}
+
+// next returns the rule of the context on top of the stack that matches first, and its match.
+// Ties go to the rule listed first, with the end pattern first unless the context says otherwise.
+func (l *grammarLexer) next(top grammarFrame) (*grammarRule, *regexp2.Match) {
+	rules := l.gh.grammar.rules(top.context)
+	if top.end != nil {
+		if top.context.endLast {
+			rules = append(append([]*grammarRule(nil), rules...), top.end)
+		} else {
+			rules = append([]*grammarRule{top.end}, rules...)
+		}
+	}
+	var best *grammarRule
+	var bestMatch *regexp2.Match
+	for _, r := range rules {
+		m := l.find(r)
+		if m != nil && (bestMatch == nil || m.Index < bestMatch.Index) {
+			best, bestMatch = r, m
+			if m.Index == l.pos {
+				break // Nothing can match earlier
+			}
+		}
+	}
+	return best, bestMatch
+}
+
+// scopes returns the scopes that apply inside a context stack.
+// Without content, the content scope of the top context is left out, as for begin and end matches.
+func scopes(stack []grammarFrame, content bool) []string {
+	var list []string
+	for i, f := range stack {
+		list = append(list, f.context.metaScope)
+		if content || i < len(stack)-1 {
+			list = append(list, f.context.contentScope)
+		}
+	}
+	return list
+}
+
+// styleText styles the text from the current position up to end with the scopes of the stack.
+func (l *grammarLexer) styleText(stack []grammarFrame, end int) {
+	end = min(end, len(l.src))
+	if style, ok := l.gh.scopeStyle(scopes(stack, true)); ok {
+		l.spans = appendSpan(l.spans, l.pos, end, style)
+	}
+	l.pos = max(l.pos, end)
+}
+
+// style styles a match of a rule and its capture groups.
+func (l *grammarLexer) style(stack []grammarFrame, r *grammarRule, m *regexp2.Match, end bool) {
+	base := append(scopes(stack, !end), r.scope)
+	start, stop := m.Index, min(m.Index+m.Length, len(l.src))
+	if start >= stop {
+		return
+	}
+
+	// Captures may nest; later groups are styled over earlier ones
+	styles := make([]*tcell.Style, stop-start)
+	if style, ok := l.gh.scopeStyle(base); ok {
+		for i := range styles {
+			styles[i] = &style
+		}
+	}
+	for _, n := range slices.Sorted(maps.Keys(r.captures)) {
+		g := m.GroupByNumber(n)
+		if g == nil {
+			continue
+		}
+		if style, ok := l.gh.scopeStyle(append(base, r.captures[n])); ok {
+			for i := max(g.Index, start); i < min(g.Index+g.Length, stop); i++ {
+				styles[i-start] = &style
+			}
+		}
+	}
+	for i, style := range styles {
+		if style != nil {
+			l.spans = appendSpan(l.spans, start+i, start+i+1, *style)
+		}
+	}
+}
+
+// forScope returns the style for a TextMate scope name such as "keyword.operator.assignment.go".
+// The longest known prefix of the name decides; false if no prefix has a style.
+func (s syntaxStyles) forScope(scope string) (tcell.Style, bool) {
+	for name := scope; name != ""; {
+		switch name {
+		case "comment", "punctuation.definition.comment":
+			return s.comment, true
+		case "string", "string.regexp", "constant.character.escape":
+			return s.str, true
+		case "constant.numeric":
+			return s.number, true
+		case "constant", "support.constant", "variable.language":
+			return s.constant, true
+		case "keyword.operator":
+			return s.operator, true
+		case "keyword", "storage", "support.type", "entity.name.type", "entity.name.tag":
+			return s.keyword, true
+		case "variable", "support.variable", "punctuation.definition.variable":
+			return s.variable, true
+		case "entity.name", "entity.other.attribute-name", "support.function", "support.type.property-name", "meta.mapping.key":
+			return s.key, true
+		case "markup.heading", "entity.name.section":
+			return s.heading, true
+		case "markup.bold", "markup.italic", "markup.quote":
+			return s.emphasis, true
+		case "markup.raw", "markup.inline.raw", "markup.fenced_code":
+			return s.code, true
+		case "markup.underline.link", "string.other.link", "meta.link":
+			return s.link, true
+		}
+		i := strings.LastIndex(name, ".")
+		if i < 0 {
+			break
+		}
+		name = name[:i]
+	}
+	return tcell.Style{}, false
+}
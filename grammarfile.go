@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// File name suffixes of the grammar formats that can be loaded
+const (
+	textMateSuffix = ".tmLanguage.json"
+	sublimeSuffix  = ".sublime-syntax"
+)
+
+// grammarDir returns the directory user grammars are loaded from: goed/syntax in the user's configuration directory.
+func grammarDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "goed", "syntax"), nil
+}
+
+// LoadGrammars loads every TextMate (.tmLanguage.json) and Sublime Text (.sublime-syntax) grammar in dir
+// and registers a highlighter for the file types each one declares.
+// A missing directory is not an error; files that fail to load are skipped and their errors returned together.
+func (sh *SyntaxHighlighter) LoadGrammars(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, entry := range entries {
+		var parse func([]byte) (*grammar, error)
+		switch name := entry.Name(); {
+		case strings.HasSuffix(name, textMateSuffix):
+			parse = parseTextMateGrammar
+		case strings.HasSuffix(name, sublimeSuffix):
+			parse = parseSublimeSyntax
+		default:
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err == nil {
+			var g *grammar
+			if g, err = parse(data); err == nil {
+				sh.addGrammar(g)
+				continue
+			}
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", entry.Name(), err))
+	}
+	return errors.Join(errs...)
+}
+
+// addGrammar registers a highlighter factory for a grammar, and its file types for detection.
+func (sh *SyntaxHighlighter) addGrammar(g *grammar) {
+	g.registry = sh.grammars
+	sh.grammars[g.scopeName] = g
+
+	filetype := g.filetype()
+	sh.factories[filetype] = func(_ *Theme, styles syntaxStyles) Highlighter { return NewGrammarHighlighter(g, styles) }
+	for _, name := range g.fileTypes {
+		// Grammars list extensions and exact file names alike
+		sh.extensions["."+strings.ToLower(name)] = filetype
+		sh.filenames[name] = filetype
+	}
+	if g.firstLine != "" {
+		if pattern := compilePattern(g.firstLine); pattern != nil {
+			sh.firstLines = append(sh.firstLines, firstLineMatch{pattern: pattern, filetype: filetype})
+		}
+	}
+}
+
+// tmGrammar is the JSON form of a TextMate grammar.
+type tmGrammar struct {
+	Name           string             `json:"name"`
+	ScopeName      string             `json:"scopeName"`
+	FileTypes      []string           `json:"fileTypes"`
+	FirstLineMatch string             `json:"firstLineMatch"`
+	Patterns       []*tmRule          `json:"patterns"`
+	Repository     map[string]*tmRule `json:"repository"`
+}
+
+// tmRule is a pattern of a TextMate grammar: a match, a begin/end or begin/while region,
+// an include, or a group of patterns.
+type tmRule struct {
+	Include             string               `json:"include"`
+	Name                string               `json:"name"`
+	ContentName         string               `json:"contentName"`
+	Match               string               `json:"match"`
+	Begin               string               `json:"begin"`
+	End                 string               `json:"end"`
+	While               string               `json:"while"`
+	Captures            map[string]tmCapture `json:"captures"`
+	BeginCaptures       map[string]tmCapture `json:"beginCaptures"`
+	EndCaptures         map[string]tmCapture `json:"endCaptures"`
+	WhileCaptures       map[string]tmCapture `json:"whileCaptures"`
+	ApplyEndPatternLast any                  `json:"applyEndPatternLast"` // Either a boolean or 0/1
+	Patterns            []*tmRule            `json:"patterns"`
+	Repository          map[string]*tmRule   `json:"repository"`
+}
+
+// tmCapture is the scope of a capture group in a TextMate grammar.
+type tmCapture struct {
+	Name string `json:"name"`
+}
+
+// tmLoader converts a TextMate grammar to contexts and rules.
+type tmLoader struct {
+	g       *grammar
+	entries map[*tmRule]*grammarContext // Contexts of the repository entries converted so far
+}
+
+// parseTextMateGrammar parses a grammar in the TextMate JSON format.
+func parseTextMateGrammar(data []byte) (*grammar, error) {
+	var tm tmGrammar
+	if err := json.Unmarshal(data, &tm); err != nil {
+		return nil, err
+	}
+	if tm.ScopeName == "" {
+		return nil, errors.New("grammar has no scopeName")
+	}
+
+	g := newGrammar(tm.Name, tm.ScopeName)
+	g.fileTypes, g.firstLine = tm.FileTypes, tm.FirstLineMatch
+	ld := &tmLoader{g: g, entries: map[*tmRule]*grammarContext{}}
+	repos := []map[string]*tmRule{tm.Repository}
+	g.root.rules = ld.rules(tm.Patterns, repos)
+	for name, entry := range tm.Repository {
+		g.repository[name] = ld.entry(entry, repos)
+	}
+	g.compile()
+	return g, nil
+}
+
+// rules converts a list of patterns; repos are the repositories in scope, innermost last.
+func (ld *tmLoader) rules(patterns []*tmRule, repos []map[string]*tmRule) []*grammarRule {
+	var rules []*grammarRule
+	for _, p := range patterns {
+		if r := ld.rule(p, repos); r != nil {
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
+
+// entry returns the context holding a repository entry, converting it on first use.
+func (ld *tmLoader) entry(r *tmRule, repos []map[string]*tmRule) *grammarContext {
+	if c, ok := ld.entries[r]; ok {
+		return c
+	}
+	c := ld.g.newContext()
+	ld.entries[r] = c // Before converting, as the entry may include itself
+	if r.Match == "" && r.Begin == "" && r.Include == "" {
+		if r.Repository != nil {
+			repos = append(slices.Clip(repos), r.Repository)
+		}
+		c.rules = ld.rules(r.Patterns, repos)
+	} else if rule := ld.rule(r, repos); rule != nil {
+		c.rules = []*grammarRule{rule}
+	}
+	return c
+}
+
+// rule converts a single pattern, or returns nil if it cannot be used.
+func (ld *tmLoader) rule(r *tmRule, repos []map[string]*tmRule) *grammarRule {
+	if r.Repository != nil {
+		repos = append(slices.Clip(repos), r.Repository)
+	}
+	switch {
+	case r.Include != "":
+		return ld.include(r.Include, repos)
+	case r.Match != "":
+		return &grammarRule{source: r.Match, scope: r.Name, captures: tmCaptures(r.Captures)}
+	case r.Begin != "":
+		c := ld.g.newContext()
+		c.metaScope, c.contentScope = r.Name, r.ContentName
+		c.rules = ld.rules(r.Patterns, repos)
+		switch last := r.ApplyEndPatternLast.(type) {
+		case bool:
+			c.endLast = last
+		case float64:
+			c.endLast = last != 0
+		}
+		if r.While != "" {
+			c.while = &grammarRule{source: r.While, captures: tmCaptures(firstCaptures(r.WhileCaptures, r.Captures))}
+		} else {
+			c.end = &grammarRule{source: r.End, captures: tmCaptures(firstCaptures(r.EndCaptures, r.Captures))}
+		}
+		return &grammarRule{source: r.Begin, scope: r.Name, captures: tmCaptures(firstCaptures(r.BeginCaptures, r.Captures)),
+			push: []*grammarContext{c}}
+	case len(r.Patterns) > 0:
+		return &grammarRule{include: ld.entry(r, repos)}
+	}
+	return nil
+}
+
+// include converts an include of "#name", "$self", "$base", "source.other" or "source.other#name".
+func (ld *tmLoader) include(ref string, repos []map[string]*tmRule) *grammarRule {
+	switch {
+	case ref == "$self" || ref == "$base":
+		return &grammarRule{include: ld.g.root}
+	case strings.HasPrefix(ref, "#"):
+		for i := len(repos) - 1; i >= 0; i-- {
+			if entry, ok := repos[i][ref[1:]]; ok {
+				return &grammarRule{include: ld.entry(entry, repos[:i+1])}
+			}
+		}
+		return nil
+	default:
+		scope, name, _ := strings.Cut(ref, "#")
+		return &grammarRule{includeScope: scope, includeName: name}
+	}
+}
+
+// firstCaptures returns the first of its arguments that is not empty.
+func firstCaptures(captures ...map[string]tmCapture) map[string]tmCapture {
+	for _, c := range captures {
+		if len(c) > 0 {
+			return c
+		}
+	}
+	return nil
+}
+
+// tmCaptures converts TextMate captures to scopes by group number.
+func tmCaptures(captures map[string]tmCapture) map[int]string {
+	scopes := map[int]string{}
+	for key, capture := range captures {
+		if n, err := strconv.Atoi(key); err == nil && capture.Name != "" {
+			scopes[n] = capture.Name
+		}
+	}
+	return scopes
+}
+
+// sublimeSyntax is the YAML form of a Sublime Text grammar.
+type sublimeSyntax struct {
+	Name           string                    `yaml:"name"`
+	Scope          string                    `yaml:"scope"`
+	FileExtensions []string                  `yaml:"file_extensions"`
+	FirstLineMatch string                    `yaml:"first_line_match"`
+	Variables      map[string]string         `yaml:"variables"`
+	Contexts       map[string][]*sublimeRule `yaml:"contexts"`
+}
+
+// sublimeRule is an entry of a Sublime Text context: a match, an include or meta settings of the context.
+type sublimeRule struct {
+	Match                string         `yaml:"match"`
+	Scope                string         `yaml:"scope"`
+	Captures             map[int]string `yaml:"captures"`
+	Push                 sublimeTarget  `yaml:"push"`
+	Set                  sublimeTarget  `yaml:"set"`
+	Pop                  any            `yaml:"pop"` // Either true or the number of contexts
+	Embed                string         `yaml:"embed"`
+	EmbedScope           string         `yaml:"embed_scope"`
+	Escape               string         `yaml:"escape"`
+	EscapeCaptures       map[int]string `yaml:"escape_captures"`
+	Include              string         `yaml:"include"`
+	MetaScope            string         `yaml:"meta_scope"`
+	MetaContentScope     string         `yaml:"meta_content_scope"`
+	MetaIncludePrototype *bool          `yaml:"meta_include_prototype"`
+}
+
+// sublimeTarget is the value of push and set: a context name, a list of names or an anonymous context.
+type sublimeTarget struct {
+	names     []string
+	anonymous []*sublimeRule
+}
+
+// UnmarshalYAML decodes any of the forms of a push or set target.
+func (t *sublimeTarget) UnmarshalYAML(node *yaml.Node) error {
+	switch {
+	case node.Kind == yaml.ScalarNode:
+		t.names = []string{node.Value}
+		return nil
+	case node.Kind == yaml.SequenceNode && len(node.Content) > 0 && node.Content[0].Kind == yaml.MappingNode:
+		return node.Decode(&t.anonymous)
+	default:
+		return node.Decode(&t.names)
+	}
+}
+
+// sublimeVariable matches a reference to a variable in a Sublime Text pattern, e.g. {{identifier}}.
+var sublimeVariable = regexp.MustCompile(`\{\{(\w+)\}\}`)
+
+// sublimeLoader converts a Sublime Text grammar to contexts and rules.
+type sublimeLoader struct {
+	g      *grammar
+	syntax *sublimeSyntax
+	named  map[string]*grammarContext // Named contexts converted so far
+}
+
+// parseSublimeSyntax parses a grammar in the Sublime Text .sublime-syntax format.
+func parseSublimeSyntax(data []byte) (*grammar, error) {
+	// Syntax files start with a %YAML 1.2 directive, which the decoder rejects although it reads the documents fine
+	if bytes.HasPrefix(data, []byte("%YAML")) {
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			data = data[i+1:]
+		}
+	}
+	var syntax sublimeSyntax
+	if err := yaml.Unmarshal(data, &syntax); err != nil {
+		return nil, err
+	}
+	if syntax.Scope == "" {
+		return nil, errors.New("syntax has no scope")
+	}
+	main, ok := syntax.Contexts["main"]
+	if !ok {
+		return nil, errors.New("syntax has no main context")
+	}
+
+	g := newGrammar(syntax.Name, syntax.Scope)
+	ld := &sublimeLoader{g: g, syntax: &syntax, named: map[string]*grammarContext{"main": g.root}}
+	g.fileTypes, g.firstLine = syntax.FileExtensions, ld.expand(syntax.FirstLineMatch)
+	ld.fill(g.root, main, true)
+	for name := range syntax.Contexts {
+		g.repository[name] = ld.context(name)
+	}
+	g.compile()
+	return g, nil
+}
+
+// expand replaces the variable references in a pattern with their values.
+func (ld *sublimeLoader) expand(pattern string) string {
+	for range 10 { // Variables may refer to other variables
+		expanded := sublimeVariable.ReplaceAllStringFunc(pattern, func(ref string) string {
+			if value, ok := ld.syntax.Variables[ref[2:len(ref)-2]]; ok {
+				return value
+			}
+			return ref
+		})
+		if expanded == pattern {
+			break
+		}
+		pattern = expanded
+	}
+	return pattern
+}
+
+// context returns a named context, converting it on first use, or nil if there is none.
+func (ld *sublimeLoader) context(name string) *grammarContext {
+	if c, ok := ld.named[name]; ok {
+		return c
+	}
+	entries, ok := ld.syntax.Contexts[name]
+	if !ok {
+		return nil
+	}
+	c := ld.g.newContext()
+	ld.named[name] = c // Before converting, as the context may refer to itself
+	ld.fill(c, entries, name != "prototype")
+	return c
+}
+
+// fill converts the entries of a context. The prototype context is included first
+// unless prototype is false or the context opts out.
+func (ld *sublimeLoader) fill(c *grammarContext, entries []*sublimeRule, prototype bool) {
+	for _, e := range entries {
+		if e.MetaIncludePrototype != nil && !*e.MetaIncludePrototype {
+			prototype = false
+		}
+	}
+	if prototype {
+		if p := ld.context("prototype"); p != nil {
+			c.rules = append(c.rules, &grammarRule{include: p})
+		}
+	}
+
+	for _, e := range entries {
+		switch {
+		case e.Include != "":
+			if ref, ok := strings.CutPrefix(e.Include, "scope:"); ok {
+				scope, name, _ := strings.Cut(ref, "#")
+				c.rules = append(c.rules, &grammarRule{includeScope: scope, includeName: name})
+			} else if included := ld.context(e.Include); included != nil {
+				c.rules = append(c.rules, &grammarRule{include: included})
+			}
+		case e.Match != "":
+			c.rules = append(c.rules, ld.rule(e))
+		default:
+			if e.MetaScope != "" {
+				c.metaScope = e.MetaScope
+			}
+			if e.MetaContentScope != "" {
+				c.contentScope = e.MetaContentScope
+			}
+		}
+	}
+}
+
+// rule converts a match entry.
+func (ld *sublimeLoader) rule(e *sublimeRule) *grammarRule {
+	r := &grammarRule{source: ld.expand(e.Match), scope: e.Scope, captures: e.Captures}
+	switch pop := e.Pop.(type) {
+	case bool:
+		if pop {
+			r.pop = 1
+		}
+	case int:
+		r.pop = pop
+	}
+	switch {
+	case e.Embed != "":
+		// The embedded syntax runs until the escape pattern matches
+		c := ld.g.newContext()
+		c.metaScope = e.EmbedScope
+		c.end = &grammarRule{source: ld.expand(e.Escape), captures: e.EscapeCaptures}
+		if scope, ok := strings.CutPrefix(e.Embed, "scope:"); ok {
+			c.rules = []*grammarRule{{includeScope: scope}}
+		} else if embedded := ld.context(e.Embed); embedded != nil {
+			c.rules = []*grammarRule{{include: embedded}}
+		}
+		r.push = []*grammarContext{c}
+	case e.Set.names != nil || e.Set.anonymous != nil:
+		r.pop = 1
+		r.push = ld.targets(e.Set)
+	default:
+		r.push = ld.targets(e.Push)
+	}
+	return r
+}
+
+// targets returns the contexts of a push or set target.
+func (ld *sublimeLoader) targets(t sublimeTarget) []*grammarContext {
+	var contexts []*grammarContext
+	for _, name := range t.names {
+		if c := ld.context(name); c != nil {
+			contexts = append(contexts, c)
+		}
+	}
+	if t.anonymous != nil {
+		c := ld.g.newContext()
+		ld.fill(c, t.anonymous, true)
+		contexts = append(contexts, c)
+	}
+	return contexts
+}
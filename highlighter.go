@@ -1,44 +1,205 @@
 package main
 
 import (
+	"maps"
+	"sort"
+
 	"github.com/gdamore/tcell/v2"
 )
 
+// LexState is the state of a highlighter's lexer at a line boundary, such as being
+// inside a block comment. Each highlighter defines its own states; zero is the initial state.
+type LexState int
+
+// StyleSpan applies a style to the runes in [Start, End) of a line.
+type StyleSpan struct {
+	Start, End int
+	Style      tcell.Style
+}
+
 // Highlighter defines the interface for syntax highlighters.
 type Highlighter interface {
-	GetHighlightMap(src []rune) map[int]tcell.Style
+	// HighlightLine returns the styled spans of a single line, sorted and non-overlapping.
+	// The state is the lexer state at the start of the line; the returned state is the
+	// lexer state at its end, to be passed to the next line.
+	HighlightLine(src []rune, state LexState) ([]StyleSpan, LexState)
+}
+
+// appendSpan adds a span to a sorted span list, merging it with the previous span
+// when they touch and share the same style.
+func appendSpan(spans []StyleSpan, start, end int, style tcell.Style) []StyleSpan {
+	if start >= end {
+		return spans
+	}
+	if n := len(spans); n > 0 && spans[n-1].End == start && spans[n-1].Style == style {
+		spans[n-1].End = end
+		return spans
+	}
+	return append(spans, StyleSpan{Start: start, End: end, Style: style})
+}
+
+// spanStyle returns the style of rune i according to a sorted span list, or fallback if no span covers it.
+func spanStyle(spans []StyleSpan, i int, fallback tcell.Style) tcell.Style {
+	j := sort.Search(len(spans), func(j int) bool { return spans[j].End > i })
+	if j < len(spans) && spans[j].Start <= i {
+		return spans[j].Style
+	}
+	return fallback
 }
 
-// SyntaxHighlighter manages different highlighters based on file extensions.
+// lineHighlight caches the highlighting of one buffer line.
+type lineHighlight struct {
+	lexed  bool        // True if start and end hold the states from the last lex of the line
+	styled bool        // True if spans holds the styles from the last lex of the line
+	start  LexState    // Lexer state at the start of the line when it was lexed
+	end    LexState    // Lexer state at the end of the line
+	spans  []StyleSpan // Styled spans of the line
+}
+
+// highlighterFactory creates a highlighter that uses the styles of a theme.
+type highlighterFactory func(theme *Theme, styles syntaxStyles) Highlighter
+
+// SyntaxHighlighter manages different highlighters based on the file type of the buffer.
+// It caches the lexer states and styled spans of each line. An edit only invalidates
+// the edited lines; a following line is lexed again only if its start state changed.
 type SyntaxHighlighter struct {
-	factories map[string]func() Highlighter
-	current   Highlighter
+	factories  map[string]highlighterFactory // Highlighter factories by file type
+	extensions map[string]string             // File types by file extension
+	filenames  map[string]string             // File types by exact file name
+	firstLines []firstLineMatch              // File types by first line, from loaded grammars
+	grammars   map[string]*grammar           // Loaded grammars by scope name
+	theme      *Theme                        // Theme the highlighters take their styles from
+	styles     syntaxStyles                  // Palette of the hand-written and grammar highlighters, from theme
+	filetype   string                        // File type of the current highlighter, or "" for none
+	current    Highlighter
+	lines      []lineHighlight // Cache entry per buffer line, for lines lexed so far
+	checked    int             // Lines before this index start in the state the previous line ended in
 }
 
-// NewSyntaxHighlighter initializes a new SyntaxHighlighter with default styles.
-func NewSyntaxHighlighter(baseStyle tcell.Style) *SyntaxHighlighter {
+// NewSyntaxHighlighter initializes a new SyntaxHighlighter with the styles of a theme.
+func NewSyntaxHighlighter(theme *Theme) *SyntaxHighlighter {
 	return &SyntaxHighlighter{
-		factories: map[string]func() Highlighter{
-			".go": func() Highlighter { return NewGoHighlighter(baseStyle) },
+		factories: map[string]highlighterFactory{
+			filetypeGo:         func(theme *Theme, _ syntaxStyles) Highlighter { return NewGoHighlighter(theme) },
+			filetypeGoMod:      func(_ *Theme, styles syntaxStyles) Highlighter { return NewGoModHighlighter(styles) },
+			filetypePython:     func(_ *Theme, styles syntaxStyles) Highlighter { return NewPythonHighlighter(styles) },
+			filetypeJSON:       func(_ *Theme, styles syntaxStyles) Highlighter { return NewJSONHighlighter(styles) },
+			filetypeYAML:       func(_ *Theme, styles syntaxStyles) Highlighter { return NewYAMLHighlighter(styles) },
+			filetypeMarkdown:   func(_ *Theme, styles syntaxStyles) Highlighter { return NewMarkdownHighlighter(styles) },
+			filetypeShell:      func(_ *Theme, styles syntaxStyles) Highlighter { return NewShellHighlighter(styles) },
+			filetypeMake:       func(_ *Theme, styles syntaxStyles) Highlighter { return NewMakefileHighlighter(styles) },
+			filetypeDockerfile: func(_ *Theme, styles syntaxStyles) Highlighter { return NewDockerfileHighlighter(styles) },
 		},
-		current: nil,
+		extensions: maps.Clone(filetypeExtensions),
+		filenames:  maps.Clone(filetypeFilenames),
+		grammars:   map[string]*grammar{},
+		theme:      theme,
+		styles:     newSyntaxStyles(theme),
+		current:    nil,
 	}
 }
 
+// Clone returns a highlighter for another buffer, with the same file types, grammars and theme
+// but no file type set. The file type and grammar tables are shared with sh.
+func (sh *SyntaxHighlighter) Clone() *SyntaxHighlighter {
+	clone := *sh
+	clone.current, clone.filetype = nil, ""
+	clone.Reset()
+	return &clone
+}
+
+// SetTheme switches the highlighters to the styles of another theme.
+// The current highlighter is recreated and the highlight cache discarded.
+func (sh *SyntaxHighlighter) SetTheme(theme *Theme) {
+	sh.theme = theme
+	sh.styles = newSyntaxStyles(theme)
+	if sh.current != nil {
+		sh.SetFiletype(sh.filetype)
+	}
+}
+
+// Detect sets the current highlighter based on the file name and the text of the buffer.
+// See detectFiletype for the sources that are considered.
+func (sh *SyntaxHighlighter) Detect(filename string, text TextBuffer) {
+	sh.SetFiletype(sh.detectFiletype(filename, text))
+}
+
 // SetFileExtension sets the current highlighter based on the file extension.
 func (sh *SyntaxHighlighter) SetFileExtension(extension string) {
-	if factory, ok := sh.factories[extension]; ok {
+	sh.SetFiletype(sh.extensions[extension])
+}
+
+// SetFiletype sets the current highlighter by file type name or alias, e.g. "python" or "bash".
+// Returns: False if there is no highlighter for the name; the highlighter is then cleared.
+func (sh *SyntaxHighlighter) SetFiletype(filetype string) bool {
+	filetype = sh.normalizeFiletype(filetype)
+	if factory, ok := sh.factories[filetype]; ok {
 		// Create a new highlighter using the factory function
-		sh.current = factory()
+		sh.current = factory(sh.theme, sh.styles)
+		sh.filetype = filetype
 	} else {
 		sh.current = nil
+		sh.filetype = ""
 	}
+	sh.Reset()
+	return sh.current != nil
 }
 
-// GetHighlightMap delegates to the current highlighter or returns an empty style map.
-func (sh *SyntaxHighlighter) GetHighlightMap(src []rune) map[int]tcell.Style {
+// Reset discards the whole highlight cache, e.g. when the buffer is replaced.
+func (sh *SyntaxHighlighter) Reset() {
+	sh.lines = nil
+	sh.checked = 0
+}
+
+// Edit updates the cache after lines y to y+removed were replaced by lines y to y+added.
+// Only line y is invalidated; the entries of the lines after it are shifted and kept.
+func (sh *SyntaxHighlighter) Edit(y, removed, added int) {
+	sh.checked = min(sh.checked, y)
+	if y >= len(sh.lines) {
+		return
+	}
+	sh.lines[y] = lineHighlight{}
+	if removed > 0 {
+		sh.lines = append(sh.lines[:y+1], sh.lines[min(y+1+removed, len(sh.lines)):]...)
+	}
+	if added > 0 {
+		sh.lines = append(sh.lines[:y+1], append(make([]lineHighlight, added), sh.lines[y+1:]...)...)
+	}
+}
+
+// update makes sure every line up to y is lexed with the right start state.
+// Lines that were never lexed, were edited, or now start in a different state are lexed again;
+// only line y keeps its styled spans, the others only keep their states.
+func (sh *SyntaxHighlighter) update(text TextBuffer, y int) {
+	for len(sh.lines) <= y {
+		sh.lines = append(sh.lines, lineHighlight{})
+	}
+	for ; sh.checked <= y; sh.checked++ {
+		l := sh.checked
+		start := LexState(0)
+		if l > 0 {
+			start = sh.lines[l-1].end
+		}
+		if entry := &sh.lines[l]; !entry.lexed || entry.start != start {
+			spans, end := sh.current.HighlightLine(text.Line(l), start)
+			*entry = lineHighlight{lexed: true, start: start, end: end}
+			if l == y {
+				entry.spans, entry.styled = spans, true
+			}
+		}
+	}
+}
+
+// GetHighlightSpans returns the styled spans of line y of text, or nil if no highlighter is set.
+func (sh *SyntaxHighlighter) GetHighlightSpans(text TextBuffer, y int) []StyleSpan {
 	if sh.current == nil {
-		return map[int]tcell.Style{} // Return an empty map if no highlighter is set
+		return nil
+	}
+	sh.update(text, y)
+	entry := &sh.lines[y]
+	if !entry.styled {
+		entry.spans, _ = sh.current.HighlightLine(text.Line(y), entry.start)
+		entry.styled = true
 	}
-	return sh.current.GetHighlightMap(src)
+	return entry.spans
 }
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"slices"
+	"strings"
+)
+
+// blockOpeners maps file types to the characters that open a block when they end a line. With
+// smartindent, the line after one is indented one level more than the line it ends.
+var blockOpeners = map[string]string{
+	filetypeGo:     "{([",
+	filetypeGoMod:  "(",
+	filetypePython: ":([{",
+	filetypeJSON:   "{[",
+	filetypeYAML:   ":",
+	filetypeShell:  "{(",
+}
+
+// blockClosers maps file types to the characters that close a block. With smartindent, typing one
+// at the start of a line removes one level of indentation.
+var blockClosers = map[string]string{
+	filetypeGo:     "})]",
+	filetypeGoMod:  ")",
+	filetypePython: ")]}",
+	filetypeJSON:   "}]",
+	filetypeShell:  "})",
+}
+
+// isIndentBlank reports whether r is a space or a tab, the characters indentation is made of.
+func isIndentBlank(r rune) bool {
+	return r == ' ' || r == '\t'
+}
+
+// leadingIndent returns the indentation of a line: the spaces and tabs it starts with.
+func leadingIndent(line []rune) []rune {
+	n := 0
+	for n < len(line) && isIndentBlank(line[n]) {
+		n++
+	}
+	return line[:n]
+}
+
+// indentUnit returns one level of indentation: tabstop spaces with expandtab, a tab without.
+func (e *Editor) indentUnit() []rune {
+	if e.expandTab {
+		return []rune(strings.Repeat(" ", e.spacesPerTab))
+	}
+	return []rune{'\t'}
+}
+
+// dedentLength returns the length of the indentation that removing levels of indentation from
+// the start of a line removes: a tab, or up to tabstop spaces, per level.
+func (e *Editor) dedentLength(line []rune, levels int) int {
+	n := 0
+	for range levels {
+		if n < len(line) && line[n] == '\t' {
+			n++
+			continue
+		}
+		for spaces := 0; spaces < e.spacesPerTab && n < len(line) && line[n] == ' '; spaces++ {
+			n++
+		}
+	}
+	return n
+}
+
+// handleEnter splits the current line at the cursor position.
+// The text after the cursor is moved to a new line. With autoindent, the new line starts with the
+// indentation of the current one instead of the blanks after the cursor, and a line left with only
+// indentation is emptied; with smartindent, it is indented one level more after a block opener, and
+// a block closer right after the cursor moves to a line of its own with the indentation of the
+// current line.
+func (e *Editor) handleEnter() {
+	if e.cursorY >= e.text.LineCount() {
+		return
+	}
+	if !e.autoIndent {
+		e.cursorX, e.cursorY = e.insertText(e.cursorX, e.cursorY, []rune{'\n'})
+		return
+	}
+
+	line := e.text.Line(e.cursorY)
+	start, end := min(e.cursorX, len(line)), min(e.cursorX, len(line))
+	last := start // After the last character before the cursor that is not a blank
+	for last > 0 && isIndentBlank(line[last-1]) {
+		last--
+	}
+	if last == 0 {
+		start = 0
+	}
+	for end < len(line) && isIndentBlank(line[end]) {
+		end++
+	}
+	base := slices.Clone(leadingIndent(line))
+	indent, closer := base, []rune(nil)
+	if e.smartIndent && last > 0 && strings.ContainsRune(blockOpeners[e.highlighter.filetype], line[last-1]) {
+		indent = slices.Concat(base, e.indentUnit())
+		if end < len(line) && strings.ContainsRune(blockClosers[e.highlighter.filetype], line[end]) {
+			closer = slices.Concat([]rune{'\n'}, base)
+		}
+	}
+	text := slices.Concat([]rune{'\n'}, indent, closer)
+
+	y := e.cursorY
+	e.deleteText(start, y, end, y)
+	e.insertText(start, y, text)
+	e.cursorX, e.cursorY = len(indent), y+1
+}
+
+// handleTab inserts a tab at the cursor position, or with expandtab, the spaces up to the next tab stop.
+func (e *Editor) handleTab() {
+	if !e.expandTab {
+		e.handleInsertRune('\t')
+		return
+	}
+	column := e.bufferToVirtualX(e.text.Line(e.cursorY), e.cursorX)
+	spaces := []rune(strings.Repeat(" ", e.spacesPerTab-column%e.spacesPerTab))
+	e.cursorX, e.cursorY = e.insertText(min(e.cursorX, e.text.LineLen(e.cursorY)), e.cursorY, spaces)
+}
+
+// dedentForCloser removes one level of indentation from the current line when a block closer is
+// typed with only indentation before the cursor, as smartindent lines the closer up with its opener.
+// Parameters:
+// - r: The character about to be typed.
+func (e *Editor) dedentForCloser(r rune) {
+	if !e.smartIndent || !strings.ContainsRune(blockClosers[e.highlighter.filetype], r) {
+		return
+	}
+	line := e.text.Line(e.cursorY)
+	x := min(e.cursorX, len(line))
+	if x == 0 || len(leadingIndent(line[:x])) != x {
+		return
+	}
+	if n := e.dedentLength(line, 1); n > 0 {
+		e.deleteText(0, e.cursorY, n, e.cursorY)
+		e.cursorX = x - n
+	}
+}
+
+// indentBackspaceX returns where backspace at the cursor deletes back to when the cursor is in the
+// indentation of a line after spaces: the previous tab stop, so a whole level of indentation made of
+// spaces is removed at once, or the first character that is not a space before it.
+// Returns: The position, or -1 if backspace deletes a single character.
+func (e *Editor) indentBackspaceX() int {
+	line := e.text.Line(e.cursorY)
+	x := min(e.cursorX, len(line))
+	if x == 0 || line[x-1] != ' ' || len(leadingIndent(line[:x])) != x {
+		return -1
+	}
+	column := e.bufferToVirtualX(line, x)
+	stop := (column - 1) / e.spacesPerTab * e.spacesPerTab
+	for x > 0 && line[x-1] == ' ' && column > stop {
+		x--
+		column--
+	}
+	return x
+}
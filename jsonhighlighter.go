@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+var jsonConstants = wordSet("true false null")
+
+// JSONHighlighter implements syntax highlighting for JSON files.
+type JSONHighlighter struct {
+	styles syntaxStyles
+}
+
+// NewJSONHighlighter initializes a new JSONHighlighter with default styles.
+func NewJSONHighlighter(styles syntaxStyles) *JSONHighlighter {
+	return &JSONHighlighter{styles: styles}
+}
+
+// HighlightLine returns the styled spans of a given JSON line.
+// Strings followed by a colon are styled as object keys.
+func (jh *JSONHighlighter) HighlightLine(src []rune, state LexState) ([]StyleSpan, LexState) {
+	l := newLineLexer(src)
+	for !l.eof() {
+		start := l.pos
+		r := l.peek(0)
+		switch {
+		case r == '"':
+			l.pos++
+			l.quoted(`"`, true)
+			end := l.pos
+			l.skipWhile(unicode.IsSpace)
+			style := jh.styles.str
+			if l.peek(0) == ':' {
+				style = jh.styles.key
+			}
+			l.spans = appendSpan(l.spans, start, end, style)
+		case r == '-' || l.number():
+			if r == '-' {
+				l.pos++
+				l.number()
+			}
+			l.emit(start, jh.styles.number)
+		case isIdentRune(r):
+			if jsonConstants[l.word()] {
+				l.emit(start, jh.styles.constant)
+			}
+		case strings.ContainsRune("{}[]:,", r):
+			l.pos++
+			l.emit(start, jh.styles.operator)
+		default:
+			l.pos++
+		}
+	}
+	return l.spans, state
+}
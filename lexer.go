@@ -0,0 +1,161 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// syntaxStyles is the palette shared by the hand-written highlighters.
+type syntaxStyles struct {
+	comment  tcell.Style // Comments
+	keyword  tcell.Style // Language keywords and directives
+	str      tcell.Style // String literals
+	number   tcell.Style // Numeric literals
+	constant tcell.Style // Named constants such as true, false and null
+	variable tcell.Style // Variable references and assignments
+	key      tcell.Style // Mapping keys, targets and other defined names
+	operator tcell.Style // Operators and structural punctuation
+	heading  tcell.Style // Markup headings
+	emphasis tcell.Style // Markup emphasis
+	code     tcell.Style // Inline code and code blocks in markup
+	link     tcell.Style // Links in markup
+}
+
+// newSyntaxStyles takes the shared palette from a theme.
+func newSyntaxStyles(theme *Theme) syntaxStyles {
+	return syntaxStyles{
+		comment:  theme.Style(scopeComment),
+		keyword:  theme.Style(scopeKeyword),
+		str:      theme.Style(scopeString),
+		number:   theme.Style(scopeNumber),
+		constant: theme.Style(scopeConstant),
+		variable: theme.Style(scopeVariable),
+		key:      theme.Style(scopeIdentifier),
+		operator: theme.Style(scopeOperator),
+		heading:  theme.Style(scopeHeading),
+		emphasis: theme.Style(scopeEmphasis),
+		code:     theme.Style(scopeCode),
+		link:     theme.Style(scopeLink),
+	}
+}
+
+// lineLexer walks a single line of source and collects styled spans.
+type lineLexer struct {
+	src   []rune
+	pos   int
+	spans []StyleSpan
+}
+
+// newLineLexer creates a lexer positioned at the start of src.
+func newLineLexer(src []rune) *lineLexer {
+	return &lineLexer{src: src}
+}
+
+// eof reports whether the whole line was consumed.
+func (l *lineLexer) eof() bool {
+	return l.pos >= len(l.src)
+}
+
+// peek returns the rune at offset from the current position, or 0 past the end of the line.
+func (l *lineLexer) peek(offset int) rune {
+	if i := l.pos + offset; i >= 0 && i < len(l.src) {
+		return l.src[i]
+	}
+	return 0
+}
+
+// hasPrefix reports whether the rest of the line starts with s.
+// The runes are compared in place, as it is called for every rune of strings and comments.
+func (l *lineLexer) hasPrefix(s string) bool {
+	i := l.pos
+	for _, r := range s {
+		if i >= len(l.src) || l.src[i] != r {
+			return false
+		}
+		i++
+	}
+	return true
+}
+
+// rest returns the unconsumed part of the line, sharing the line's runes.
+func (l *lineLexer) rest() []rune {
+	return l.src[l.pos:]
+}
+
+// emit styles the runes from start up to the current position.
+func (l *lineLexer) emit(start int, style tcell.Style) {
+	l.spans = appendSpan(l.spans, start, l.pos, style)
+}
+
+// emitRest consumes the rest of the line with a single style.
+func (l *lineLexer) emitRest(style tcell.Style) {
+	start := l.pos
+	l.pos = len(l.src)
+	l.emit(start, style)
+}
+
+// skipWhile consumes runes while f returns true and returns how many were consumed.
+func (l *lineLexer) skipWhile(f func(rune) bool) int {
+	start := l.pos
+	for !l.eof() && f(l.src[l.pos]) {
+		l.pos++
+	}
+	return l.pos - start
+}
+
+// quoted consumes text up to and including the closing delimiter.
+// The opening delimiter must already be consumed.
+// Returns: True if the closing delimiter was found on this line.
+func (l *lineLexer) quoted(closing string, escapes bool) bool {
+	for !l.eof() {
+		if escapes && l.src[l.pos] == '\\' {
+			l.pos += 2
+			continue
+		}
+		if l.hasPrefix(closing) {
+			l.pos += utf8.RuneCountInString(closing)
+			return true
+		}
+		l.pos++
+	}
+	l.pos = len(l.src)
+	return false
+}
+
+// number consumes a numeric literal (decimal, hex, octal, binary or float) if one starts here.
+func (l *lineLexer) number() bool {
+	if !unicode.IsDigit(l.peek(0)) && !(l.peek(0) == '.' && unicode.IsDigit(l.peek(1))) {
+		return false
+	}
+	l.skipWhile(func(r rune) bool {
+		return unicode.IsDigit(r) || unicode.IsLetter(r) || r == '.' || r == '_'
+	})
+	return true
+}
+
+// isIdentRune reports whether r can be part of an identifier.
+func isIdentRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// word consumes an identifier if one starts here and returns it.
+func (l *lineLexer) word() string {
+	if !isIdentRune(l.peek(0)) || unicode.IsDigit(l.peek(0)) {
+		return ""
+	}
+	start := l.pos
+	l.skipWhile(isIdentRune)
+	return string(l.src[start:l.pos])
+}
+
+// wordSet builds a lookup set from space separated words.
+func wordSet(words string) map[string]bool {
+	set := map[string]bool{}
+	for _, w := range strings.Fields(words) {
+		set[w] = true
+	}
+	return set
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"log"
 	"os"
+	"path/filepath"
 
 	"github.com/gdamore/tcell/v2"
 )
@@ -20,21 +21,46 @@ func main() {
 	defer screen.Fini() // Ensure cleanup is deferred
 
 	screen.Clear()
-	// Set default style: white foreground, black background
-	style := tcell.StyleDefault.Foreground(tcell.ColorWhite).Background(tcell.ColorBlack)
+	// Start with the default color scheme; a theme file in the user's theme directory overrides the bundled one
+	theme, themeErr := loadTheme(defaultColorScheme)
+	if themeErr != nil {
+		theme = defaultTheme()
+	}
+
+	editor := NewEditor(screen, theme)
+	if themeErr != nil {
+		editor.showStatus("Error loading theme: " + themeErr.Error())
+	}
 
-	editor := NewEditor(screen, style)
+	// Load user grammars, so their languages are detected for the file loaded below
+	if dir, err := grammarDir(); err == nil {
+		if err := editor.highlighter.LoadGrammars(dir); err != nil {
+			editor.showStatus("Error loading grammars: " + err.Error())
+		}
+	}
+
+	// Apply the user's settings and key mappings before the file is loaded, so its file type options apply
+	if dir, err := configDir(); err == nil {
+		cfg, err := loadConfig(filepath.Join(dir, configFile))
+		if err == nil {
+			err = editor.applyConfig(cfg)
+		}
+		if err != nil {
+			editor.showStatus("Error loading config: " + err.Error())
+		}
+	}
 
-	// If a filename is provided as an argument, load it; otherwise, start with an empty buffer
-	if len(os.Args) > 1 {
-		if err := editor.loadFile(os.Args[1]); err != nil {
+	// Open each file given as an argument in its own buffer, showing the first; otherwise, start with an empty buffer
+	for _, arg := range os.Args[1:] {
+		if err := editor.openFile(arg); err != nil {
 			editor.showStatus("Error loading file: " + err.Error())
 		}
 	}
+	editor.switchBuffer(editor.buffers[0])
 
 	// Main event loop
 	for {
-		ev := editor.screen.PollEvent()
+		ev := editor.pollEvent()
 
 		switch ev := ev.(type) {
 		case *tcell.EventKey:
@@ -1,8 +1,16 @@
 package main
 
 import (
+	"fmt"
+	"go/token"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+	"unicode/utf8"
 
 	"github.com/gdamore/tcell/v2"
 )
@@ -21,15 +29,15 @@ func TestEditorLoadFile(t *testing.T) {
 	screen.Init()
 	defer screen.Fini()
 
-	style := tcell.StyleDefault
-	editor := NewEditor(screen, style)
+	theme := defaultTheme()
+	editor := NewEditor(screen, theme)
 	editor.loadFile(tempFile.Name())
 
-	if len(editor.lines) != 3 {
-		t.Errorf("Expected 3 lines, got %d", len(editor.lines))
+	if editor.text.LineCount() != 3 {
+		t.Errorf("Expected 3 lines, got %d", editor.text.LineCount())
 	}
-	if string(editor.lines[0]) != "Line1" {
-		t.Errorf("Expected 'Line1', got '%s'", string(editor.lines[0]))
+	if string(editor.text.Line(0)) != "Line1" {
+		t.Errorf("Expected 'Line1', got '%s'", string(editor.text.Line(0)))
 	}
 }
 
@@ -44,12 +52,12 @@ func TestEditorSaveFile(t *testing.T) {
 	screen.Init()
 	defer screen.Fini()
 
-	style := tcell.StyleDefault
-	editor := NewEditor(screen, style)
-	editor.lines = [][]rune{
+	theme := defaultTheme()
+	editor := NewEditor(screen, theme)
+	editor.text = NewPieceTableFromLines([][]rune{
 		[]rune("Line1"),
 		[]rune("Line2"),
-	}
+	})
 
 	editor.saveFile(tempFile.Name())
 
@@ -69,8 +77,8 @@ func TestEditorShowStatus(t *testing.T) {
 	screen.Init()
 	defer screen.Fini()
 
-	style := tcell.StyleDefault
-	editor := NewEditor(screen, style)
+	theme := defaultTheme()
+	editor := NewEditor(screen, theme)
 
 	msg := "Test Status"
 	editor.showStatus(msg)
@@ -83,8 +91,8 @@ func TestEditorAdjustOffsets(t *testing.T) {
 	screen.Init()
 	defer screen.Fini()
 
-	style := tcell.StyleDefault
-	editor := NewEditor(screen, style)
+	theme := defaultTheme()
+	editor := NewEditor(screen, theme)
 
 	editor.cursorX = 100
 	editor.cursorY = 50
@@ -96,18 +104,18 @@ func TestEditorAdjustOffsets(t *testing.T) {
 }
 
 func TestSyntaxHighlighterSetFileExtension(t *testing.T) {
-	style := tcell.StyleDefault
-	highlighter := NewSyntaxHighlighter(style)
+	theme := defaultTheme()
+	highlighter := NewSyntaxHighlighter(theme)
 
 	highlighter.SetFileExtension(".go")
-	if _, ok := highlighter.factories[".go"]; !ok {
+	if _, ok := highlighter.current.(*GoHighlighter); !ok {
 		t.Errorf("Expected .go highlighter to be set")
 	}
 }
 
 func TestSyntaxHighlighterUnsupportedExtension(t *testing.T) {
-	style := tcell.StyleDefault
-	highlighter := NewSyntaxHighlighter(style)
+	theme := defaultTheme()
+	highlighter := NewSyntaxHighlighter(theme)
 
 	highlighter.SetFileExtension(".unsupported")
 	if highlighter.current != nil {
@@ -115,25 +123,2078 @@ func TestSyntaxHighlighterUnsupportedExtension(t *testing.T) {
 	}
 }
 
-func TestGoHighlighterGetHighlightMap(t *testing.T) {
-	style := tcell.StyleDefault
-	goHighlighter := NewGoHighlighter(style)
+func TestGoHighlighterHighlightLine(t *testing.T) {
+	theme := defaultTheme()
+	goHighlighter := NewGoHighlighter(theme)
 
-	src := "package main"
-	highlightMap := goHighlighter.GetHighlightMap(src)
-	if len(highlightMap) == 0 {
+	src := []rune("package main")
+	spans, _ := goHighlighter.HighlightLine(src, goStateCode)
+	if len(spans) == 0 {
 		t.Errorf("Expected highlight map to have entries")
 	}
 }
 
 func TestGoHighlighterComplexSyntax(t *testing.T) {
-	style := tcell.StyleDefault
-	goHighlighter := NewGoHighlighter(style)
+	theme := defaultTheme()
+	goHighlighter := NewGoHighlighter(theme)
 
-	src := "func main() { var x = 42 }"
-	highlightMap := goHighlighter.GetHighlightMap(src)
+	src := []rune("func main() { var x = 42 }")
+	spans, _ := goHighlighter.HighlightLine(src, goStateCode)
 
-	if len(highlightMap) == 0 {
+	if len(spans) == 0 {
 		t.Errorf("Expected highlight map to have entries for complex syntax")
 	}
 }
+
+func TestEditorUndoRedoTyping(t *testing.T) {
+	screen := tcell.NewSimulationScreen("UTF-8")
+	screen.Init()
+	defer screen.Fini()
+
+	theme := defaultTheme()
+	editor := NewEditor(screen, theme)
+
+	for _, r := range "hello" {
+		editor.handleInsertRune(r)
+	}
+	editor.handleEnter()
+	for _, r := range "world" {
+		editor.handleInsertRune(r)
+	}
+
+	// Consecutive typing is undone as a single step
+	editor.undo()
+	if editor.text.LineCount() != 1 || string(editor.text.Line(0)) != "" {
+		t.Errorf("Expected empty buffer after undo, got %q", string(editor.text.Slice(0, editor.text.Len())))
+	}
+	if editor.cursorX != 0 || editor.cursorY != 0 {
+		t.Errorf("Expected cursor at 0,0 after undo, got %d,%d", editor.cursorX, editor.cursorY)
+	}
+
+	editor.redo()
+	if editor.text.LineCount() != 2 || string(editor.text.Line(0)) != "hello" || string(editor.text.Line(1)) != "world" {
+		t.Errorf("Expected buffer restored after redo, got %q", string(editor.text.Slice(0, editor.text.Len())))
+	}
+	if editor.cursorX != 5 || editor.cursorY != 1 {
+		t.Errorf("Expected cursor at 5,1 after redo, got %d,%d", editor.cursorX, editor.cursorY)
+	}
+}
+
+func TestEditorUndoSeparateSteps(t *testing.T) {
+	screen := tcell.NewSimulationScreen("UTF-8")
+	screen.Init()
+	defer screen.Fini()
+
+	theme := defaultTheme()
+	editor := NewEditor(screen, theme)
+	editor.text = NewPieceTableFromLines([][]rune{[]rune("abc"), []rune("def")})
+
+	// Join the lines, then move away and delete a character
+	editor.cursorX = 3
+	editor.handleDelete()
+	editor.handleMoveToStart()
+	editor.handleDelete()
+	if string(editor.text.Line(0)) != "bcdef" {
+		t.Fatalf("Expected 'bcdef', got '%s'", string(editor.text.Line(0)))
+	}
+
+	editor.undo()
+	if string(editor.text.Line(0)) != "abcdef" {
+		t.Errorf("Expected 'abcdef' after first undo, got '%s'", string(editor.text.Line(0)))
+	}
+	editor.undo()
+	if editor.text.LineCount() != 2 || string(editor.text.Line(0)) != "abc" || string(editor.text.Line(1)) != "def" {
+		t.Errorf("Expected original lines after second undo, got %q", string(editor.text.Slice(0, editor.text.Len())))
+	}
+	if editor.cursorX != 3 || editor.cursorY != 0 {
+		t.Errorf("Expected cursor at 3,0 after undo, got %d,%d", editor.cursorX, editor.cursorY)
+	}
+}
+
+func TestPieceTableInsertDelete(t *testing.T) {
+	pt := NewPieceTable([]rune("Line1\nLine2\nLine3"))
+
+	pt.Insert(pt.Offset(4, 1), []rune("X\nY"))
+	if pt.LineCount() != 4 {
+		t.Fatalf("Expected 4 lines, got %d", pt.LineCount())
+	}
+	if string(pt.Line(1)) != "LineX" || string(pt.Line(2)) != "Y2" {
+		t.Errorf("Expected 'LineX' and 'Y2', got '%s' and '%s'", string(pt.Line(1)), string(pt.Line(2)))
+	}
+
+	removed := pt.Delete(pt.Offset(2, 0), pt.Offset(1, 2)-pt.Offset(2, 0))
+	if string(removed) != "ne1\nLineX\nY" {
+		t.Errorf("Expected removed text 'ne1\\nLineX\\nY', got %q", string(removed))
+	}
+	if string(pt.Slice(0, pt.Len())) != "Li2\nLine3" {
+		t.Errorf("Expected 'Li2\\nLine3', got %q", string(pt.Slice(0, pt.Len())))
+	}
+	if pt.LineCount() != 2 || pt.LineLen(1) != 5 {
+		t.Errorf("Expected 2 lines with second of length 5, got %d lines", pt.LineCount())
+	}
+}
+
+func TestPieceTableOffsets(t *testing.T) {
+	pt := NewPieceTable([]rune("héllo\nwörld"))
+	pt.Insert(pt.Len(), []rune("!"))
+
+	if x, y := pt.Position(pt.Offset(3, 1)); x != 3 || y != 1 {
+		t.Errorf("Expected position 3,1, got %d,%d", x, y)
+	}
+	if x, y := pt.Position(pt.Len()); x != 6 || y != 1 {
+		t.Errorf("Expected end position 6,1, got %d,%d", x, y)
+	}
+	// 'é' and 'ö' take two bytes each in UTF-8
+	if b := pt.ByteOffset(pt.Offset(2, 1)); b != 10 {
+		t.Errorf("Expected byte offset 10, got %d", b)
+	}
+	if r := pt.RuneOffset(10); r != pt.Offset(2, 1) {
+		t.Errorf("Expected rune offset %d, got %d", pt.Offset(2, 1), r)
+	}
+}
+
+func TestPieceTableManyPieces(t *testing.T) {
+	// Lines of mixed one to four byte runes, much longer than the distance between store marks
+	want := []rune(strings.Repeat("aé€😀 line\n", 100))
+	pt := NewPieceTable(want)
+	for i := range 50 {
+		offset := (i * 37) % len(want)
+		text := []rune("ü\n" + strconv.Itoa(i))
+		pt.Insert(offset, text)
+		want = slices.Insert(want, offset, text...)
+		if i%3 == 0 {
+			deleted := pt.Delete(offset/2, 5)
+			if string(deleted) != string(want[offset/2:offset/2+5]) {
+				t.Fatalf("Edit %d: expected %q deleted, got %q", i, string(want[offset/2:offset/2+5]), string(deleted))
+			}
+			want = slices.Delete(want, offset/2, offset/2+5)
+		}
+	}
+	if got := string(pt.Slice(0, pt.Len())); got != string(want) {
+		t.Fatalf("Expected the edited text, got %q", got)
+	}
+
+	lines := strings.Split(string(want), "\n")
+	if pt.LineCount() != len(lines) {
+		t.Fatalf("Expected %d lines, got %d", len(lines), pt.LineCount())
+	}
+	offset, bytes := 0, 0
+	for y, line := range lines {
+		if got := string(pt.Line(y)); got != line {
+			t.Fatalf("Expected line %d to be %q, got %q", y, line, got)
+		}
+		for x, r := range []rune(line) {
+			if got := pt.Offset(x, y); got != offset {
+				t.Fatalf("Expected offset %d at %d,%d, got %d", offset, x, y, got)
+			}
+			if gx, gy := pt.Position(offset); gx != x || gy != y {
+				t.Fatalf("Expected position %d,%d at offset %d, got %d,%d", x, y, offset, gx, gy)
+			}
+			if got := pt.ByteOffset(offset); got != bytes {
+				t.Fatalf("Expected byte offset %d at offset %d, got %d", bytes, offset, got)
+			}
+			if got := pt.RuneOffset(bytes + utf8.RuneLen(r) - 1); got != offset {
+				t.Fatalf("Expected the last byte of rune %d to map back to it, got %d", offset, got)
+			}
+			offset++
+			bytes += utf8.RuneLen(r)
+		}
+		offset++ // The line break
+		bytes++
+	}
+}
+
+func TestEditorSearchNext(t *testing.T) {
+	screen := tcell.NewSimulationScreen("UTF-8")
+	screen.Init()
+	defer screen.Fini()
+
+	theme := defaultTheme()
+	editor := NewEditor(screen, theme)
+	editor.text = NewPieceTableFromLines([][]rune{
+		[]rune("foo bar"),
+		[]rune("bar foo"),
+		[]rune("baz"),
+	})
+
+	editor.searchPattern = []rune("foo")
+	editor.searchForward = true
+	editor.searchNext(true)
+	if editor.cursorX != 4 || editor.cursorY != 1 {
+		t.Errorf("Expected match at 4,1, got %d,%d", editor.cursorX, editor.cursorY)
+	}
+
+	// Searching again wraps around to the top
+	editor.searchNext(true)
+	if editor.cursorX != 0 || editor.cursorY != 0 {
+		t.Errorf("Expected wrapped match at 0,0, got %d,%d", editor.cursorX, editor.cursorY)
+	}
+	if editor.status != statusSearchHitBottom {
+		t.Errorf("Expected wrap status, got '%s'", editor.status)
+	}
+
+	// N searches backwards, wrapping to the bottom
+	editor.searchNext(false)
+	if editor.cursorX != 4 || editor.cursorY != 1 {
+		t.Errorf("Expected backward match at 4,1, got %d,%d", editor.cursorX, editor.cursorY)
+	}
+
+	editor.searchPattern = []rune("qux")
+	editor.searchNext(true)
+	if editor.status != errorPatternNotFound+": qux" {
+		t.Errorf("Expected not found status, got '%s'", editor.status)
+	}
+}
+
+func TestEditorSearchPrompt(t *testing.T) {
+	screen := tcell.NewSimulationScreen("UTF-8")
+	screen.Init()
+	defer screen.Fini()
+
+	theme := defaultTheme()
+	editor := NewEditor(screen, theme)
+	editor.text = NewPieceTableFromLines([][]rune{
+		[]rune("foo bar"),
+		[]rune("bar foo"),
+		[]rune("foo baz"),
+	})
+	editor.inCommandMode = true
+
+	// Confirming a search stays in command mode, so n moves to the next match instead of typing
+	for _, r := range "foo" {
+		screen.InjectKey(tcell.KeyRune, r, tcell.ModNone)
+	}
+	screen.InjectKey(tcell.KeyEnter, 0, tcell.ModNone)
+	typeNormalKeys(editor, "/")
+	if !editor.inCommandMode || editor.cursorX != 4 || editor.cursorY != 1 {
+		t.Errorf("Expected command mode at 4,1 after the search, got %d,%d (command mode %v)", editor.cursorX, editor.cursorY, editor.inCommandMode)
+	}
+	typeNormalKeys(editor, "n")
+	if !editor.inCommandMode || editor.cursorX != 0 || editor.cursorY != 2 {
+		t.Errorf("Expected command mode at 0,2 after n, got %d,%d (command mode %v)", editor.cursorX, editor.cursorY, editor.inCommandMode)
+	}
+	want := []string{"foo bar", "bar foo", "foo baz"}
+	for i, line := range want {
+		if got := string(editor.text.Line(i)); got != line {
+			t.Errorf("Expected line %d to be unchanged, got '%s'", i, got)
+		}
+	}
+}
+
+func TestEditorSubstituteCommand(t *testing.T) {
+	screen := tcell.NewSimulationScreen("UTF-8")
+	screen.Init()
+	defer screen.Fini()
+
+	theme := defaultTheme()
+	editor := NewEditor(screen, theme)
+	editor.text = NewPieceTableFromLines([][]rune{
+		[]rune("foo = foo(1)"),
+		[]rune("bar = foo(2)"),
+		[]rune("foo = foo(3)"),
+	})
+
+	if err := editor.executeCommand(`:1,2s/foo\((\d)\)/bar(\1)/g`); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if string(editor.text.Line(0)) != "foo = bar(1)" || string(editor.text.Line(1)) != "bar = bar(2)" {
+		t.Errorf("Unexpected result '%s' / '%s'", string(editor.text.Line(0)), string(editor.text.Line(1)))
+	}
+	if string(editor.text.Line(2)) != "foo = foo(3)" {
+		t.Errorf("Expected line 3 to be outside the range, got '%s'", string(editor.text.Line(2)))
+	}
+	if editor.status != "2 substitutions on 2 lines" {
+		t.Errorf("Unexpected status '%s'", editor.status)
+	}
+
+	if err := editor.executeCommand(":%s/foo/[&]/g"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if string(editor.text.Line(2)) != "[foo] = [foo](3)" {
+		t.Errorf("Expected '[foo] = [foo](3)', got '%s'", string(editor.text.Line(2)))
+	}
+
+	// The whole command is undone in one step
+	editor.undo()
+	if string(editor.text.Line(2)) != "foo = foo(3)" || string(editor.text.Line(0)) != "foo = bar(1)" {
+		t.Errorf("Expected :%%s to be undone, got '%s' / '%s'", string(editor.text.Line(0)), string(editor.text.Line(2)))
+	}
+
+	if err := editor.executeCommand(":5,6s/a/b/"); err == nil {
+		t.Errorf("Expected an error for an invalid range")
+	}
+
+	// With confirmation, each accepted replacement is made before asking about the next match
+	screen.InjectKey(tcell.KeyRune, 'y', tcell.ModNone)
+	screen.InjectKey(tcell.KeyRune, 'q', tcell.ModNone)
+	if err := editor.executeCommand(`:3s/foo/a\rb/gc`); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got := screenText(screen, editor.gutterWidth()+1, 3, 10); got != "b = foo(3)" {
+		t.Errorf("Expected the second prompt to show the first replacement, got '%s'", got)
+	}
+	if string(editor.text.Line(2)) != "a" || string(editor.text.Line(3)) != "b = foo(3)" {
+		t.Errorf("Expected one replacement, got '%s' / '%s'", string(editor.text.Line(2)), string(editor.text.Line(3)))
+	}
+}
+
+// screenText returns n runes of the simulation screen from column x of row y.
+func screenText(screen tcell.SimulationScreen, x, y, n int) string {
+	cells, width, _ := screen.GetContents()
+	var text []rune
+	for i := range n {
+		text = append(text, cells[y*width+x+i].Runes...)
+	}
+	return string(text)
+}
+
+// typeNormalKeys feeds runes to the editor as if typed in normal mode.
+func typeNormalKeys(editor *Editor, keys string) {
+	for _, r := range keys {
+		if editor.inCommandMode {
+			editor.handleCommandMode(tcell.NewEventKey(tcell.KeyRune, r, tcell.ModNone))
+		} else {
+			editor.handleInsertMode(tcell.NewEventKey(tcell.KeyRune, r, tcell.ModNone))
+		}
+	}
+}
+
+func TestParseNormalCommand(t *testing.T) {
+	tests := []struct {
+		keys  string
+		cmd   normalCommand
+		state parseState
+	}{
+		{"3dw", normalCommand{count: 3, operator: 'd', motion: "w"}, parseComplete},
+		{"2d3w", normalCommand{count: 6, operator: 'd', motion: "w"}, parseComplete},
+		{"dd", normalCommand{operator: 'd', motion: "d"}, parseComplete},
+		{"gg", normalCommand{motion: "gg"}, parseComplete},
+		{"0", normalCommand{motion: "0"}, parseComplete},
+		{"10j", normalCommand{count: 10, motion: "j"}, parseComplete},
+		{"d", normalCommand{operator: 'd'}, parseIncomplete},
+		{"g", normalCommand{}, parseIncomplete},
+		{"dx", normalCommand{operator: 'd'}, parseInvalid},
+		{`"ayy`, normalCommand{register: 'a', operator: 'y', motion: "y"}, parseComplete},
+		{`2"A3dw`, normalCommand{count: 6, register: 'A', operator: 'd', motion: "w"}, parseComplete},
+		{`"+p`, normalCommand{register: '+', motion: "p"}, parseComplete},
+		{`"`, normalCommand{}, parseIncomplete},
+		{`"%`, normalCommand{}, parseInvalid},
+	}
+	for _, tt := range tests {
+		cmd, state := parseNormalCommand([]rune(tt.keys))
+		if state != tt.state {
+			t.Errorf("%q: expected state %d, got %d", tt.keys, tt.state, state)
+		}
+		if state == parseComplete && cmd != tt.cmd {
+			t.Errorf("%q: expected %+v, got %+v", tt.keys, tt.cmd, cmd)
+		}
+	}
+}
+
+func TestEditorNormalModeOperators(t *testing.T) {
+	screen := tcell.NewSimulationScreen("UTF-8")
+	screen.Init()
+	defer screen.Fini()
+
+	theme := defaultTheme()
+	editor := NewEditor(screen, theme)
+	editor.text = NewPieceTableFromLines([][]rune{
+		[]rune("one two three four"),
+		[]rune("five six"),
+		[]rune("seven"),
+	})
+	editor.inCommandMode = true
+
+	typeNormalKeys(editor, "2dw")
+	if string(editor.text.Line(0)) != "three four" {
+		t.Errorf("Expected 'three four', got '%s'", string(editor.text.Line(0)))
+	}
+
+	typeNormalKeys(editor, "jddp")
+	if string(editor.text.Line(1)) != "seven" || string(editor.text.Line(2)) != "five six" {
+		t.Errorf("Expected lines swapped, got '%s' / '%s'", string(editor.text.Line(1)), string(editor.text.Line(2)))
+	}
+	if editor.cursorY != 2 {
+		t.Errorf("Expected cursor on pasted line 2, got %d", editor.cursorY)
+	}
+
+	typeNormalKeys(editor, "ggcwTHREE")
+	editor.handleInsertMode(tcell.NewEventKey(tcell.KeyEsc, 0, tcell.ModNone))
+	if string(editor.text.Line(0)) != "THREE four" {
+		t.Errorf("Expected 'THREE four', got '%s'", string(editor.text.Line(0)))
+	}
+
+	// '.' repeats the change including the typed text
+	typeNormalKeys(editor, "w.")
+	if string(editor.text.Line(0)) != "THREE THREE" {
+		t.Errorf("Expected 'THREE THREE', got '%s'", string(editor.text.Line(0)))
+	}
+
+	// The repeated change is undone in one step
+	typeNormalKeys(editor, "u")
+	if string(editor.text.Line(0)) != "THREE four" {
+		t.Errorf("Expected 'THREE four' after undo, got '%s'", string(editor.text.Line(0)))
+	}
+
+	typeNormalKeys(editor, "G$x")
+	if string(editor.text.Line(2)) != "five si" {
+		t.Errorf("Expected 'five si', got '%s'", string(editor.text.Line(2)))
+	}
+
+	// "cw" on the last letter of a word changes only that letter
+	editor.text = NewPieceTableFromLines([][]rune{[]rune("foo bar baz")})
+	typeNormalKeys(editor, "gg0llcwX")
+	editor.handleInsertMode(tcell.NewEventKey(tcell.KeyEsc, 0, tcell.ModNone))
+	if string(editor.text.Line(0)) != "foX bar baz" {
+		t.Errorf("Expected 'foX bar baz', got '%s'", string(editor.text.Line(0)))
+	}
+	typeNormalKeys(editor, "0c2wY")
+	editor.handleInsertMode(tcell.NewEventKey(tcell.KeyEsc, 0, tcell.ModNone))
+	if string(editor.text.Line(0)) != "Y baz" {
+		t.Errorf("Expected 'Y baz', got '%s'", string(editor.text.Line(0)))
+	}
+}
+
+func TestEditorModifiedFlag(t *testing.T) {
+	tempFile, err := os.CreateTemp("", "testfile.txt")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	defer os.Remove(tempFile.Name())
+	tempFile.WriteString("Line1\n")
+	tempFile.Close()
+
+	screen := tcell.NewSimulationScreen("UTF-8")
+	screen.Init()
+	defer screen.Fini()
+
+	theme := defaultTheme()
+	editor := NewEditor(screen, theme)
+	editor.loadFile(tempFile.Name())
+	if editor.modified {
+		t.Errorf("Expected buffer to be unmodified after loading")
+	}
+
+	editor.handleInsertRune('x')
+	if !editor.modified {
+		t.Errorf("Expected buffer to be modified after an edit")
+	}
+	if editor.statusLine() != tempFile.Name()+modifiedMarker {
+		t.Errorf("Expected modified marker in status line, got '%s'", editor.statusLine())
+	}
+
+	// Quitting is refused while there are unsaved changes
+	if err := editor.executeCommand(":q"); err == nil || err.Error() != errorNoWrite {
+		t.Errorf("Expected '%s' error, got %v", errorNoWrite, err)
+	}
+
+	// So is reloading the file, unless forced
+	if err := editor.executeCommand(":e"); err == nil || err.Error() != errorNoWrite || string(editor.text.Line(0)) != "xLine1" {
+		t.Errorf("Expected :e to keep the changes with '%s' error, got %v", errorNoWrite, err)
+	}
+	if err := editor.executeCommand(":e!"); err != nil || editor.modified || string(editor.text.Line(0)) != "Line1" {
+		t.Errorf("Expected :e! to reload the file, got '%s' (%v)", string(editor.text.Line(0)), err)
+	}
+	editor.handleInsertRune('x')
+
+	editor.saveFile(tempFile.Name())
+	if editor.modified {
+		t.Errorf("Expected buffer to be unmodified after saving")
+	}
+}
+
+func TestEditorSaveFilePreservesMode(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "script.sh")
+	if err := os.WriteFile(filename, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	screen := tcell.NewSimulationScreen("UTF-8")
+	screen.Init()
+	defer screen.Fini()
+
+	theme := defaultTheme()
+	editor := NewEditor(screen, theme)
+	editor.loadFile(filename)
+	editor.handleMoveToEnd()
+	editor.handleEnter()
+	for _, r := range "echo hi" {
+		editor.handleInsertRune(r)
+	}
+	if err := editor.saveFile(filename); err != nil {
+		t.Fatalf("Failed to save file: %v", err)
+	}
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatalf("Failed to stat file: %v", err)
+	}
+	if info.Mode().Perm() != 0755 {
+		t.Errorf("Expected mode 0755, got %o", info.Mode().Perm())
+	}
+	content, _ := os.ReadFile(filename)
+	if string(content) != "#!/bin/sh\necho hi\n" {
+		t.Errorf("Unexpected file content %q", string(content))
+	}
+
+	// No temporary files are left behind
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("Expected only the saved file in the directory, got %d entries", len(entries))
+	}
+}
+
+func TestEditorRoundTripFileFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"crlf", "Line1\r\nLine2\r\n"},
+		{"no final newline", "Line1\nLine2"},
+		{"bom", "\uFEFFLine1\nLine2\n"},
+		{"mixed endings", "Line1\r\nLine2\n"},
+	}
+
+	screen := tcell.NewSimulationScreen("UTF-8")
+	screen.Init()
+	defer screen.Fini()
+
+	for _, tt := range tests {
+		filename := filepath.Join(t.TempDir(), "file.txt")
+		if err := os.WriteFile(filename, []byte(tt.content), 0644); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+
+		editor := NewEditor(screen, defaultTheme())
+		if err := editor.loadFile(filename); err != nil {
+			t.Fatalf("%s: failed to load file: %v", tt.name, err)
+		}
+		if string(editor.text.Line(0)) != "Line1" && tt.name != "mixed endings" {
+			t.Errorf("%s: expected 'Line1', got %q", tt.name, string(editor.text.Line(0)))
+		}
+		if err := editor.saveFile(filename); err != nil {
+			t.Fatalf("%s: failed to save file: %v", tt.name, err)
+		}
+
+		content, _ := os.ReadFile(filename)
+		if string(content) != tt.content {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.content, string(content))
+		}
+	}
+}
+
+func TestEditorEmptyFileFinalNewline(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "file.txt")
+	if err := os.WriteFile(filename, nil, 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	screen := tcell.NewSimulationScreen("UTF-8")
+	screen.Init()
+	defer screen.Fini()
+
+	// An empty file has no missing final newline, so text typed into it is saved with one
+	editor := NewEditor(screen, defaultTheme())
+	if err := editor.loadFile(filename); err != nil {
+		t.Fatalf("Failed to load file: %v", err)
+	}
+	if strings.Contains(editor.statusLine(), "[noeol]") {
+		t.Errorf("Expected no [noeol] for an empty file, got '%s'", editor.statusLine())
+	}
+	editor.insertText(0, 0, []rune("hello"))
+	if err := editor.saveFile(filename); err != nil {
+		t.Fatalf("Failed to save file: %v", err)
+	}
+	if content, _ := os.ReadFile(filename); string(content) != "hello\n" {
+		t.Errorf("Expected %q, got %q", "hello\n", string(content))
+	}
+}
+
+func TestEditorSetFileFormat(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "file.txt")
+	if err := os.WriteFile(filename, []byte("Line1\r\nLine2\r\n"), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	screen := tcell.NewSimulationScreen("UTF-8")
+	screen.Init()
+	defer screen.Fini()
+
+	editor := NewEditor(screen, defaultTheme())
+	editor.loadFile(filename)
+	if editor.format.fileFormat != fileFormatDos {
+		t.Fatalf("Expected dos file format, got %s", editor.format.fileFormat)
+	}
+
+	if err := editor.executeCommand(":set fileformat=unix"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !editor.modified {
+		t.Errorf("Expected buffer to be modified after changing the file format")
+	}
+	editor.saveFile(filename)
+	content, _ := os.ReadFile(filename)
+	if string(content) != "Line1\nLine2\n" {
+		t.Errorf("Expected unix line endings, got %q", string(content))
+	}
+
+	if err := editor.executeCommand(":set ff=mac"); err == nil {
+		t.Errorf("Expected an error for an unknown file format")
+	}
+}
+
+func TestEditorLoadFileLongLine(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "minified.json")
+	long := strings.Repeat(`{"key":"value"},`, 256*1024) // 4 MiB on a single line
+	if err := os.WriteFile(filename, []byte(long+"\nend\n"), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	screen := tcell.NewSimulationScreen("UTF-8")
+	screen.Init()
+	defer screen.Fini()
+
+	editor := NewEditor(screen, defaultTheme())
+	if err := editor.loadFile(filename); err != nil {
+		t.Fatalf("Failed to load file with a long line: %v", err)
+	}
+	if editor.text.LineCount() != 2 {
+		t.Errorf("Expected 2 lines, got %d", editor.text.LineCount())
+	}
+	if editor.text.LineLen(0) != len(long) {
+		t.Errorf("Expected first line of %d runes, got %d", len(long), editor.text.LineLen(0))
+	}
+	if string(editor.text.Line(1)) != "end" {
+		t.Errorf("Expected 'end', got '%s'", string(editor.text.Line(1)))
+	}
+}
+
+func TestGoHighlighterMultilineState(t *testing.T) {
+	theme := defaultTheme()
+	style := theme.Style(scopeDefault)
+	goHighlighter := NewGoHighlighter(theme)
+	commentStyle := goHighlighter.styles[token.COMMENT]
+	stringStyle := goHighlighter.styles[token.STRING]
+
+	_, state := goHighlighter.HighlightLine([]rune("x := 1 /* start"), goStateCode)
+	if state != goStateBlockComment {
+		t.Fatalf("Expected block comment state, got %d", state)
+	}
+	spans, state := goHighlighter.HighlightLine([]rune("func inside() {"), state)
+	if state != goStateBlockComment || spanStyle(spans, 0, style) != commentStyle {
+		t.Errorf("Expected middle line to be styled as a comment")
+	}
+	spans, state = goHighlighter.HighlightLine([]rune("end */ var y"), state)
+	if state != goStateCode {
+		t.Errorf("Expected code state after the comment ends, got %d", state)
+	}
+	if spanStyle(spans, 4, style) != commentStyle || spanStyle(spans, 7, style) != goHighlighter.keywordStyle {
+		t.Errorf("Expected comment up to '*/' and keyword after it")
+	}
+
+	_, state = goHighlighter.HighlightLine([]rune("s := `raw"), goStateCode)
+	if state != goStateRawString {
+		t.Fatalf("Expected raw string state, got %d", state)
+	}
+	spans, state = goHighlighter.HighlightLine([]rune("done` + x"), state)
+	if state != goStateCode || spanStyle(spans, 0, style) != stringStyle || spanStyle(spans, 5, style) == stringStyle {
+		t.Errorf("Expected raw string to end at the backtick")
+	}
+}
+
+func TestSyntaxHighlighterCache(t *testing.T) {
+	screen := tcell.NewSimulationScreen("UTF-8")
+	screen.Init()
+	defer screen.Fini()
+
+	theme := defaultTheme()
+	style := theme.Style(scopeDefault)
+	editor := NewEditor(screen, theme)
+	editor.highlighter.SetFileExtension(".go")
+	editor.text = NewPieceTableFromLines([][]rune{
+		[]rune("var a = 1"),
+		[]rune("var b = 2"),
+		[]rune("var c = 3"),
+	})
+	keyword := editor.highlighter.current.(*GoHighlighter).keywordStyle
+	comment := editor.highlighter.current.(*GoHighlighter).styles[token.COMMENT]
+
+	if spanStyle(editor.highlighter.GetHighlightSpans(editor.text, 2), 0, style) != keyword {
+		t.Fatalf("Expected 'var' to be styled as a keyword")
+	}
+
+	// Opening a block comment on the first line changes how the following lines are styled
+	editor.insertText(0, 0, []rune("/* "))
+	if spanStyle(editor.highlighter.GetHighlightSpans(editor.text, 2), 0, style) != comment {
+		t.Errorf("Expected line 3 to be inside the block comment after the edit")
+	}
+
+	// Closing it again restores the previous styles; unaffected lines keep their cache entries
+	editor.undo()
+	if spanStyle(editor.highlighter.GetHighlightSpans(editor.text, 2), 0, style) != keyword {
+		t.Errorf("Expected line 3 to be code again after undo")
+	}
+	if editor.highlighter.lines[1].styled {
+		t.Errorf("Expected line 2 to be lexed only for its state, not restyled")
+	}
+}
+
+func TestSyntaxHighlighterDetectFilename(t *testing.T) {
+	highlighter := NewSyntaxHighlighter(defaultTheme())
+
+	tests := map[string]Highlighter{
+		"/src/Makefile":    (*MakefileHighlighter)(nil),
+		"Dockerfile":       (*DockerfileHighlighter)(nil),
+		"go.mod":           (*GoModHighlighter)(nil),
+		"ci/build.yml":     (*YAMLHighlighter)(nil),
+		"README.md":        (*MarkdownHighlighter)(nil),
+		"fixtures/a.json":  (*JSONHighlighter)(nil),
+		"scripts/setup.sh": (*ShellHighlighter)(nil),
+		"tool.py":          (*PythonHighlighter)(nil),
+		"main.go":          (*GoHighlighter)(nil),
+	}
+	for filename, want := range tests {
+		highlighter.Detect(filename, nil)
+		if fmt.Sprintf("%T", highlighter.current) != fmt.Sprintf("%T", want) {
+			t.Errorf("%s: expected %T, got %T", filename, want, highlighter.current)
+		}
+	}
+
+	highlighter.Detect("notes.txt", nil)
+	if highlighter.current != nil {
+		t.Errorf("Expected no highlighter for notes.txt")
+	}
+}
+
+func TestDetectFiletype(t *testing.T) {
+	highlighter := NewSyntaxHighlighter(defaultTheme())
+
+	tests := []struct {
+		filename string
+		lines    []string
+		want     string
+	}{
+		{"deploy", []string{"#!/usr/bin/env bash", "set -e"}, filetypeShell},
+		{"tool", []string{"#!/usr/bin/env -S python3 -u"}, filetypePython},
+		{"build", []string{"#!/usr/bin/make -f"}, filetypeMake},
+		{"config.yaml.tmpl", []string{"name: {{ .Name }}"}, filetypeYAML},
+		{"Makefile.in", []string{"all:"}, filetypeMake},
+		{"script.bak", []string{"# vim: set ft=python:"}, filetypePython},
+		{"notes.txt", []string{"# -*- mode: sh; -*-", "echo"}, filetypeShell},
+		{"main.go", []string{"// vim: ft=markdown"}, filetypeMarkdown},
+		{"data", []string{"", `{"a": 1}`}, filetypeJSON},
+		{"doc", []string{"---", "a: 1"}, filetypeYAML},
+		{"image", []string{"FROM golang:1.23"}, filetypeDockerfile},
+		{"notes", []string{"hello"}, ""},
+	}
+	for _, tt := range tests {
+		lines := make([][]rune, len(tt.lines))
+		for i, line := range tt.lines {
+			lines[i] = []rune(line)
+		}
+		if got := highlighter.detectFiletype(tt.filename, NewPieceTableFromLines(lines)); got != tt.want {
+			t.Errorf("%s: expected file type %q, got %q", tt.filename, tt.want, got)
+		}
+	}
+}
+
+func TestEditorSetFiletype(t *testing.T) {
+	screen := tcell.NewSimulationScreen("UTF-8")
+	screen.Init()
+	defer screen.Fini()
+
+	editor := NewEditor(screen, defaultTheme())
+	if err := editor.executeCommand(":set ft=bash"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, ok := editor.highlighter.current.(*ShellHighlighter); !ok || editor.highlighter.filetype != filetypeShell {
+		t.Errorf("Expected the shell highlighter, got %T", editor.highlighter.current)
+	}
+	if err := editor.executeCommand(":set filetype=cobol"); err == nil {
+		t.Errorf("Expected an error for an unknown file type")
+	}
+	if err := editor.executeCommand(":set ft="); err != nil || editor.highlighter.current != nil {
+		t.Errorf("Expected an empty file type to turn highlighting off")
+	}
+}
+
+func TestHighlightersHighlightLine(t *testing.T) {
+	theme := defaultTheme()
+	style := theme.Style(scopeDefault)
+	styles := newSyntaxStyles(theme)
+
+	tests := []struct {
+		name        string
+		highlighter Highlighter
+		lines       []string
+		line, col   int
+		want        tcell.Style
+	}{
+		{"python keyword", NewPythonHighlighter(styles), []string{"def f(x):"}, 0, 0, styles.keyword},
+		{"python docstring", NewPythonHighlighter(styles), []string{`"""doc`, "still doc", `"""`}, 1, 0, styles.str},
+		{"json key", NewJSONHighlighter(styles), []string{`{"name": "goed"}`}, 0, 1, styles.key},
+		{"json value", NewJSONHighlighter(styles), []string{`{"name": "goed"}`}, 0, 10, styles.str},
+		{"json constant", NewJSONHighlighter(styles), []string{`[true, -1.5]`}, 0, 1, styles.constant},
+		{"yaml key", NewYAMLHighlighter(styles), []string{"jobs:", "  build: ok"}, 1, 2, styles.key},
+		{"yaml number", NewYAMLHighlighter(styles), []string{"retries: 3 # comment"}, 0, 9, styles.number},
+		{"yaml comment", NewYAMLHighlighter(styles), []string{"retries: 3 # comment"}, 0, 11, styles.comment},
+		{"yaml block scalar", NewYAMLHighlighter(styles), []string{"run: |", "  key: not a key"}, 1, 2, styles.str},
+		{"yaml after block scalar", NewYAMLHighlighter(styles), []string{"run: |", "  echo", "next: 1"}, 2, 0, styles.key},
+		{"markdown heading", NewMarkdownHighlighter(styles), []string{"## Usage"}, 0, 3, styles.heading},
+		{"markdown code", NewMarkdownHighlighter(styles), []string{"run `goed` now"}, 0, 5, styles.code},
+		{"markdown fence", NewMarkdownHighlighter(styles), []string{"```go", "# not a heading", "```"}, 1, 0, styles.code},
+		{"markdown link", NewMarkdownHighlighter(styles), []string{"see [docs](http://x)"}, 0, 12, styles.link},
+		{"shell keyword", NewShellHighlighter(styles), []string{"if [ -f x ]; then"}, 0, 13, styles.keyword},
+		{"shell variable", NewShellHighlighter(styles), []string{`echo "$HOME" ${USER}`}, 0, 14, styles.variable},
+		{"shell assignment", NewShellHighlighter(styles), []string{"NAME=goed"}, 0, 0, styles.variable},
+		{"shell string", NewShellHighlighter(styles), []string{`echo "a`, `b"`}, 1, 0, styles.str},
+		{"make target", NewMakefileHighlighter(styles), []string{"build: main.go"}, 0, 0, styles.key},
+		{"make assignment", NewMakefileHighlighter(styles), []string{"GOFLAGS ?= -v"}, 0, 0, styles.variable},
+		{"make directive", NewMakefileHighlighter(styles), []string{"ifeq ($(OS),Linux)"}, 0, 0, styles.keyword},
+		{"make recipe variable", NewMakefileHighlighter(styles), []string{"\t$(GO) build $@"}, 0, 1, styles.variable},
+		{"make recipe shell", NewMakefileHighlighter(styles), []string{"\t@echo \"done\""}, 0, 7, styles.str},
+		{"dockerfile instruction", NewDockerfileHighlighter(styles), []string{"FROM golang:1.23"}, 0, 0, styles.keyword},
+		{"dockerfile continuation", NewDockerfileHighlighter(styles), []string{`RUN go build \`, "  FROM"}, 1, 2, style},
+		{"go.mod directive", NewGoModHighlighter(styles), []string{"require github.com/gdamore/tcell/v2 v2.8.1"}, 0, 0, styles.keyword},
+		{"go.mod version", NewGoModHighlighter(styles), []string{"require github.com/gdamore/tcell/v2 v2.8.1"}, 0, 36, styles.number},
+	}
+	for _, tt := range tests {
+		var spans []StyleSpan
+		state := LexState(0)
+		for _, line := range tt.lines[:tt.line+1] {
+			spans, state = tt.highlighter.HighlightLine([]rune(line), state)
+		}
+		if got := spanStyle(spans, tt.col, style); got != tt.want {
+			t.Errorf("%s: unexpected style at %d of %q", tt.name, tt.col, tt.lines[tt.line])
+		}
+	}
+}
+
+func TestSyntaxHighlighterLoadGrammars(t *testing.T) {
+	dir := t.TempDir()
+	textMate := `{
+		"name": "Toy",
+		"scopeName": "source.toy",
+		"fileTypes": ["toy", "Toyfile"],
+		"patterns": [
+			{"include": "#comments"},
+			{"match": "\\b(let|fn)\\b", "name": "keyword.control.toy"},
+			{"begin": "<<(\\w+)", "end": "^\\1$", "name": "string.unquoted.heredoc.toy"}
+		],
+		"repository": {
+			"comments": {"patterns": [{"begin": "/\\*", "end": "\\*/", "name": "comment.block.toy"}]}
+		}
+	}`
+	sublime := `%YAML 1.2
+---
+name: Ini
+scope: source.ini
+file_extensions: [ini]
+variables:
+  key: '[A-Za-z_]+'
+contexts:
+  main:
+    - match: '^\['
+      push: section
+    - match: '^({{key}})\s*='
+      captures:
+        1: entity.name.key.ini
+  section:
+    - meta_scope: entity.name.section.ini
+    - match: '\]'
+      pop: true
+`
+	if err := os.WriteFile(filepath.Join(dir, "toy"+textMateSuffix), []byte(textMate), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "ini"+sublimeSuffix), []byte(sublime), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "broken"+textMateSuffix), []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	theme := defaultTheme()
+	style := theme.Style(scopeDefault)
+	styles := newSyntaxStyles(theme)
+	highlighter := NewSyntaxHighlighter(theme)
+	if err := highlighter.LoadGrammars(dir); err == nil || !strings.Contains(err.Error(), "broken") || strings.Contains(err.Error(), "ini") {
+		t.Errorf("Expected an error for the broken grammar only, got %v", err)
+	}
+
+	highlighter.Detect("main.toy", nil)
+	toy, ok := highlighter.current.(*GrammarHighlighter)
+	if !ok || highlighter.filetype != "toy" {
+		t.Fatalf("Expected the toy grammar for main.toy, got %T", highlighter.current)
+	}
+	spans, state := toy.HighlightLine([]rune("let x = 1 /* open"), 0)
+	if spanStyle(spans, 0, style) != styles.keyword || spanStyle(spans, 12, style) != styles.comment {
+		t.Errorf("Expected keyword and comment styles on the first line")
+	}
+	spans, state = toy.HighlightLine([]rune("still */ fn"), state)
+	if spanStyle(spans, 0, style) != styles.comment || spanStyle(spans, 9, style) != styles.keyword {
+		t.Errorf("Expected the comment to end on the second line")
+	}
+	_, state = toy.HighlightLine([]rune("x = <<EOT"), state)
+	spans, state = toy.HighlightLine([]rune("let EOT"), state)
+	if spanStyle(spans, 0, style) != styles.str {
+		t.Errorf("Expected heredoc text until the line matching its begin capture")
+	}
+	_, state = toy.HighlightLine([]rune("EOT"), state)
+	if spans, _ := toy.HighlightLine([]rune("let"), state); spanStyle(spans, 0, style) != styles.keyword {
+		t.Errorf("Expected the heredoc to end")
+	}
+
+	highlighter.Detect("Toyfile", nil)
+	if highlighter.filetype != "toy" {
+		t.Errorf("Expected the toy grammar for Toyfile, got %q", highlighter.filetype)
+	}
+
+	highlighter.Detect("config.ini", nil)
+	ini, ok := highlighter.current.(*GrammarHighlighter)
+	if !ok {
+		t.Fatalf("Expected the ini grammar for config.ini, got %T", highlighter.current)
+	}
+	spans, _ = ini.HighlightLine([]rune("[core] name = x"), 0)
+	if spanStyle(spans, 2, style) != styles.heading || spanStyle(spans, 8, style) == styles.heading {
+		t.Errorf("Expected the section to be popped at ']'")
+	}
+	spans, _ = ini.HighlightLine([]rune("name = x"), 0)
+	if spanStyle(spans, 0, style) != styles.key {
+		t.Errorf("Expected the key capture to be styled")
+	}
+}
+
+func TestParseTheme(t *testing.T) {
+	theme, err := parseTheme("test", `
+# A comment
+default  fg=white bg=#000000
+keyword  fg=12 bold
+search   bg=yellow
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fg, bg, attrs := theme.Style(scopeKeyword).Decompose()
+	if fg != tcell.PaletteColor(12) || bg != tcell.NewRGBColor(0, 0, 0) || attrs&tcell.AttrBold == 0 {
+		t.Errorf("Expected keyword to layer over the default style, got %v %v %v", fg, bg, attrs)
+	}
+	if theme.Style(scopeComment) != theme.Style(scopeDefault) {
+		t.Errorf("Expected a scope without a style to use the default style")
+	}
+	fg, bg, _ = theme.Layer(scopeSearch, theme.Style(scopeKeyword)).Decompose()
+	if fg != tcell.PaletteColor(12) || bg != tcell.ColorYellow {
+		t.Errorf("Expected search to keep the foreground it is layered over, got %v %v", fg, bg)
+	}
+
+	for _, text := range []string{"keyword fg=nocolor", "keyword shiny", "keyword fg"} {
+		if _, err := parseTheme("bad", text); err == nil {
+			t.Errorf("Expected an error for %q", text)
+		}
+	}
+}
+
+func TestThemeForColors(t *testing.T) {
+	theme, err := parseTheme("test", "default fg=#ff0000 bg=200\nkeyword fg=blue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if theme.forColors(1<<24) != theme {
+		t.Errorf("Expected truecolor terminals to use the theme as is")
+	}
+
+	fg, bg, _ := theme.forColors(256).Style(scopeDefault).Decompose()
+	if fg.IsRGB() || bg != tcell.PaletteColor(200) {
+		t.Errorf("Expected RGB colors mapped into the palette on 256 colors, got %v %v", fg, bg)
+	}
+	fg, bg, _ = theme.forColors(16).Style(scopeDefault).Decompose()
+	if fg != tcell.ColorRed || bg.IsRGB() || bg-tcell.ColorValid >= 16 {
+		t.Errorf("Expected colors within the first 16 on 16 colors, got %v %v", fg, bg)
+	}
+	if fg, _, _ := theme.forColors(16).Style(scopeKeyword).Decompose(); fg != tcell.ColorBlue {
+		t.Errorf("Expected a basic color to be kept, got %v", fg)
+	}
+}
+
+func TestLoadTheme(t *testing.T) {
+	config := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", config)
+	t.Setenv("HOME", config)
+	dir, err := themeDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "mine"+themeSuffix), []byte("keyword fg=red"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for name := range bundledThemes {
+		if theme, err := loadTheme(name); err != nil || theme.Name() != name {
+			t.Errorf("Expected bundled theme %q to load, got %v", name, err)
+		}
+	}
+	theme, err := loadTheme("mine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fg, _, _ := theme.Style(scopeKeyword).Decompose(); fg != tcell.ColorRed {
+		t.Errorf("Expected the user theme to be loaded, got %v", fg)
+	}
+	if _, err := loadTheme("missing"); err == nil {
+		t.Errorf("Expected an error for a missing theme")
+	}
+}
+
+func TestEditorColorscheme(t *testing.T) {
+	screen := tcell.NewSimulationScreen("UTF-8")
+	screen.Init()
+	defer screen.Fini()
+
+	editor := NewEditor(screen, defaultTheme())
+	editor.highlighter.SetFileExtension(".go")
+	editor.text = NewPieceTableFromLines([][]rune{[]rune("var a = 1")})
+	dark := editor.highlighter.GetHighlightSpans(editor.text, 0)
+
+	if err := editor.executeCommand(":colorscheme light"); err != nil {
+		t.Fatal(err)
+	}
+	if editor.theme.Name() != "light" || editor.style != editor.theme.Style(scopeDefault) {
+		t.Errorf("Expected the light theme to be current, got %q", editor.theme.Name())
+	}
+	light := editor.highlighter.GetHighlightSpans(editor.text, 0)
+	if spanStyle(light, 0, editor.style) == spanStyle(dark, 0, editor.style) {
+		t.Errorf("Expected the highlighter to use the colors of the new theme")
+	}
+	if editor.highlighter.filetype != filetypeGo {
+		t.Errorf("Expected the file type to be kept, got %q", editor.highlighter.filetype)
+	}
+
+	if err := editor.executeCommand(":colo"); err != nil || editor.status != "light" {
+		t.Errorf("Expected :colo to show the theme name, got %q (%v)", editor.status, err)
+	}
+	if err := editor.executeCommand(":colorscheme missing"); err == nil {
+		t.Errorf("Expected an error for an unknown theme")
+	}
+}
+
+func TestEditorSetOptions(t *testing.T) {
+	screen := tcell.NewSimulationScreen("UTF-8")
+	screen.Init()
+	defer screen.Fini()
+
+	editor := NewEditor(screen, defaultTheme())
+	tests := []struct {
+		command string
+		check   func() bool
+	}{
+		{":set nonumber", func() bool { return !editor.showLineNumbers }},
+		{":set nu", func() bool { return editor.showLineNumbers }},
+		{":set number!", func() bool { return !editor.showLineNumbers }},
+		{":set invnu", func() bool { return editor.showLineNumbers }},
+		{":set cursorline=false", func() bool { return !editor.highlightCurrentLine }},
+		{":set ts=8", func() bool { return editor.spacesPerTab == 8 }},
+		{":set tabstop:2 cul", func() bool { return editor.spacesPerTab == 2 && editor.highlightCurrentLine }},
+		{":set ts?", func() bool { return editor.status == "tabstop=2" }},
+		{":set nonu nu?", func() bool { return editor.status == "nonumber" }},
+		{":set ft", func() bool { return editor.status == "filetype=" }},
+	}
+	for _, tt := range tests {
+		if err := editor.executeCommand(tt.command); err != nil || !tt.check() {
+			t.Errorf("%s: unexpected result (%v)", tt.command, err)
+		}
+	}
+
+	for _, command := range []string{":set ts=0", ":set ts=wide", ":set nu=maybe", ":set tabstop!", ":set nofileformat", ":set bogus", ":set nobogus"} {
+		if err := editor.executeCommand(command); err == nil {
+			t.Errorf("%s: expected an error", command)
+		}
+	}
+}
+
+func TestEditorApplyConfig(t *testing.T) {
+	screen := tcell.NewSimulationScreen("UTF-8")
+	screen.Init()
+	defer screen.Fini()
+
+	path := filepath.Join(t.TempDir(), configFile)
+	if err := os.WriteFile(path, []byte(`
+colorscheme = "light"
+
+[options]
+number = false
+tabstop = 4
+
+[filetype.yaml]
+tabstop = 2
+cursorline = false
+
+[keys.normal]
+"<C-s>" = ":w<CR>"
+"H" = "0"
+
+[keys.insert]
+"<F2>" = "<Esc>"
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	editor := NewEditor(screen, defaultTheme())
+	if err := editor.applyConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if editor.theme.Name() != "light" || editor.showLineNumbers || editor.spacesPerTab != 4 {
+		t.Errorf("Expected the config options to be applied")
+	}
+
+	// File type options apply while the file type is set and are undone when it changes
+	if err := editor.executeCommand(":set ft=yaml"); err != nil {
+		t.Fatal(err)
+	}
+	if editor.spacesPerTab != 2 || editor.highlightCurrentLine {
+		t.Errorf("Expected the yaml options, got tabstop=%d", editor.spacesPerTab)
+	}
+	if err := editor.executeCommand(":set ft=go"); err != nil {
+		t.Fatal(err)
+	}
+	if editor.spacesPerTab != 4 || !editor.highlightCurrentLine {
+		t.Errorf("Expected the options to be restored, got tabstop=%d", editor.spacesPerTab)
+	}
+
+	if err := editor.applyConfig(&Config{Options: map[string]any{"bogus": 1}, Keys: map[string]map[string]string{"visual": {}}}); err == nil {
+		t.Errorf("Expected errors for an unknown option and mode")
+	}
+	if err := os.WriteFile(path, []byte("tabstop = 4"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(path); err == nil {
+		t.Errorf("Expected an error for a setting outside [options]")
+	}
+	if cfg, err := loadConfig(filepath.Join(t.TempDir(), configFile)); err != nil || cfg == nil {
+		t.Errorf("Expected an empty configuration without a config file, got %v", err)
+	}
+}
+
+func TestEditorLocalOptions(t *testing.T) {
+	screen := tcell.NewSimulationScreen("UTF-8")
+	screen.Init()
+	defer screen.Fini()
+	screen.SetSize(80, 25)
+
+	dir := t.TempDir()
+	code, notes := filepath.Join(dir, "main.go"), filepath.Join(dir, "notes.yaml")
+	os.WriteFile(code, []byte("package main\n"), 0o644)
+	os.WriteFile(notes, []byte("key: value\n"), 0o644)
+
+	editor := NewEditor(screen, defaultTheme())
+	editor.updateScreenSize()
+	editor.filetypeOptions = map[string]map[string]string{filetypeYAML: {optionTabStop: "2", optionWrap: "true"}}
+	if err := editor.openFile(code); err != nil {
+		t.Fatal(err)
+	}
+	if err := editor.openFile(notes); err != nil {
+		t.Fatal(err)
+	}
+	if editor.spacesPerTab != 2 || !editor.wrapLines {
+		t.Errorf("Expected the yaml options, got tabstop=%d wrap=%v", editor.spacesPerTab, editor.wrapLines)
+	}
+
+	// Options set with :set stay with their buffer and window when switching buffers
+	if err := editor.executeCommand(":set ts=3 nowrap"); err != nil {
+		t.Fatal(err)
+	}
+	if err := editor.executeCommand(":b " + code); err != nil {
+		t.Fatal(err)
+	}
+	if editor.spacesPerTab != defaultSpacesPerTab || editor.wrapLines {
+		t.Errorf("Expected the go buffer to keep its options, got tabstop=%d wrap=%v", editor.spacesPerTab, editor.wrapLines)
+	}
+	if err := editor.executeCommand(":b " + notes); err != nil {
+		t.Fatal(err)
+	}
+	if editor.spacesPerTab != 3 || editor.wrapLines {
+		t.Errorf("Expected the options set with :set kept, got tabstop=%d wrap=%v", editor.spacesPerTab, editor.wrapLines)
+	}
+
+	// Each window has its own wrap option
+	if err := editor.executeCommand(":split"); err != nil {
+		t.Fatal(err)
+	}
+	if err := editor.executeCommand(":set wrap"); err != nil {
+		t.Fatal(err)
+	}
+	if other := editor.windows()[1]; other.wrapLines || !editor.wrapLines {
+		t.Errorf("Expected only the current window to wrap")
+	}
+
+	// Buffers opened afterwards start with the values :set last gave the options
+	if err := editor.executeCommand(":e " + filepath.Join(dir, "todo.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if editor.spacesPerTab != 3 || !editor.wrapLines {
+		t.Errorf("Expected a new buffer with the :set options, got tabstop=%d wrap=%v", editor.spacesPerTab, editor.wrapLines)
+	}
+}
+
+func TestEditorKeyMappings(t *testing.T) {
+	screen := tcell.NewSimulationScreen("UTF-8")
+	screen.Init()
+	defer screen.Fini()
+
+	editor := NewEditor(screen, defaultTheme())
+	err := editor.applyConfig(&Config{Keys: map[string]map[string]string{
+		modeNormal: {"<C-t>": ":set ts=3<CR>", "H": "0", "Q": ""},
+		modeInsert: {"<F2>": "<Esc>x"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	editor.text = NewPieceTableFromLines([][]rune{[]rune("abc")})
+	editor.inCommandMode = true
+	editor.cursorX = 2
+
+	handle := func(ev tcell.Event) {
+		if key, ok := ev.(*tcell.EventKey); ok {
+			if editor.inCommandMode {
+				editor.handleCommandMode(key)
+			} else {
+				editor.handleInsertMode(key)
+			}
+		}
+	}
+
+	screen.InjectKey(tcell.KeyRune, 'H', tcell.ModNone)
+	handle(editor.pollEvent())
+	if editor.cursorX != 0 {
+		t.Errorf("Expected H to move to the start of the line, got %d", editor.cursorX)
+	}
+
+	// The rest of a mapping is read by the command line
+	screen.InjectKey(tcell.KeyCtrlT, 0, tcell.ModCtrl)
+	handle(editor.pollEvent())
+	if editor.spacesPerTab != 3 {
+		t.Errorf("Expected the mapped command to run, got tabstop=%d", editor.spacesPerTab)
+	}
+
+	// Mapped keys are not mapped again: the 'x' deletes instead of being remapped
+	editor.inCommandMode = false
+	screen.InjectKey(tcell.KeyF2, 0, tcell.ModNone)
+	handle(editor.pollEvent())
+	handle(editor.pollEvent())
+	if !editor.inCommandMode || string(editor.text.Line(0)) != "bc" {
+		t.Errorf("Expected <F2> to leave insert mode and delete, got %q", string(editor.text.Line(0)))
+	}
+
+	// A key mapped to nothing is ignored
+	screen.InjectKey(tcell.KeyRune, 'Q', tcell.ModNone)
+	screen.InjectKey(tcell.KeyRune, 'x', tcell.ModNone)
+	if key, ok := editor.pollEvent().(*tcell.EventKey); !ok || key.Rune() != 'x' {
+		t.Errorf("Expected the disabled key to be skipped")
+	}
+
+	if _, err := parseKeys("<C-1>"); err == nil {
+		t.Errorf("Expected an error for an unknown key")
+	}
+	if keys, err := parseKeys("a<lt>b<"); err != nil || len(keys) != 4 || keys[3].Rune() != '<' {
+		t.Errorf("Expected literal '<' to be parsed, got %d keys (%v)", len(keys), err)
+	}
+}
+
+func TestEditorBuffers(t *testing.T) {
+	screen := tcell.NewSimulationScreen("UTF-8")
+	screen.Init()
+	defer screen.Fini()
+
+	dir := t.TempDir()
+	first, second := filepath.Join(dir, "first.go"), filepath.Join(dir, "second.py")
+	os.WriteFile(first, []byte("package main\n\nfunc main() {}\n"), 0o644)
+	os.WriteFile(second, []byte("import os\n"), 0o644)
+
+	editor := NewEditor(screen, defaultTheme())
+	if err := editor.openFile(first); err != nil {
+		t.Fatal(err)
+	}
+	if len(editor.buffers) != 1 {
+		t.Fatalf("Expected the empty buffer to be reused, got %d buffers", len(editor.buffers))
+	}
+	editor.cursorX, editor.cursorY = 5, 2
+	editor.insertText(0, 0, []rune("// "))
+
+	if err := editor.executeCommand(":e " + second); err != nil {
+		t.Fatal(err)
+	}
+	if len(editor.buffers) != 2 || editor.filename != second || editor.highlighter.filetype != filetypePython {
+		t.Fatalf("Expected %s in a second buffer, got %q", second, editor.filename)
+	}
+	if err := editor.executeCommand(":ls"); err != nil || editor.status != fmt.Sprintf(`1  + %q  2 %%  %q`, first, second) {
+		t.Errorf("Unexpected buffer list %q", editor.status)
+	}
+
+	// Switching back restores the cursor, the unsaved edit and the file type
+	if err := editor.executeCommand(":bp"); err != nil {
+		t.Fatal(err)
+	}
+	if editor.filename != first || editor.cursorX != 5 || editor.cursorY != 2 || !editor.modified ||
+		editor.highlighter.filetype != filetypeGo {
+		t.Errorf("Expected the first buffer as it was left, got %q at %d,%d", editor.filename, editor.cursorX, editor.cursorY)
+	}
+	editor.undo()
+	if string(editor.text.Line(0)) != "package main" {
+		t.Errorf("Expected undo to work on the buffer's own history, got %q", string(editor.text.Line(0)))
+	}
+	editor.insertText(0, 0, []rune("// "))
+
+	for _, command := range []string{":bn", ":b second", ":b 2"} {
+		editor.switchBuffer(editor.buffers[0])
+		if err := editor.executeCommand(command); err != nil || editor.filename != second {
+			t.Errorf("%s: expected the second buffer, got %q (%v)", command, editor.filename, err)
+		}
+	}
+	for _, command := range []string{":b 9", ":b nothing", ":b .go .py"} {
+		if err := editor.executeCommand(command); err == nil {
+			t.Errorf("%s: expected an error", command)
+		}
+	}
+
+	// Modified buffers are not closed or quit without !
+	if err := editor.executeCommand(":bd 1"); err == nil {
+		t.Errorf("Expected :bd to refuse closing a modified buffer")
+	}
+	if err := editor.executeQuitCommand(false); err == nil || !strings.Contains(err.Error(), "buffer 1") {
+		t.Errorf("Expected quitting to report the modified buffer, got %v", err)
+	}
+	if err := editor.executeCommand(":bd! 1"); err != nil || len(editor.buffers) != 1 {
+		t.Errorf("Expected :bd! to close the buffer (%v)", err)
+	}
+	if err := editor.executeCommand(":bd"); err != nil || len(editor.buffers) != 1 || editor.filename != "" || editor.id != 3 {
+		t.Errorf("Expected closing the last buffer to leave a new empty buffer, got %q", editor.filename)
+	}
+}
+
+func TestEditorSplitWindows(t *testing.T) {
+	screen := tcell.NewSimulationScreen("UTF-8")
+	screen.Init()
+	defer screen.Fini()
+	screen.SetSize(80, 25)
+
+	dir := t.TempDir()
+	impl, test := filepath.Join(dir, "sum.go"), filepath.Join(dir, "sum_test.go")
+	os.WriteFile(impl, []byte("package sum\n\nfunc Sum() {}\n"), 0o644)
+	os.WriteFile(test, []byte("package sum\n\nfunc TestSum(t *testing.T) {}\n"), 0o644)
+
+	editor := NewEditor(screen, defaultTheme())
+	editor.updateScreenSize()
+	if err := editor.openFile(impl); err != nil {
+		t.Fatal(err)
+	}
+	editor.cursorY = 2
+	editor.inCommandMode = true
+	first := editor.Window
+
+	// :vsplit opens the test on the left, the implementation stays on the right
+	if err := editor.executeCommand(":vsplit " + test); err != nil {
+		t.Fatal(err)
+	}
+	windows := editor.windows()
+	if len(windows) != 2 || windows[0] != editor.Window || windows[1] != first || editor.filename != test {
+		t.Fatalf("Expected the test in a new window on the left")
+	}
+	if left := windows[0]; left.left != 0 || left.width+1+first.width != 80 || first.left != left.width+1 || left.height != 24 {
+		t.Errorf("Unexpected layout: left %+v, right %+v", left.viewport, first.viewport)
+	}
+	if first.cursorY != 2 || first.Buffer.filename != impl {
+		t.Errorf("Expected the first window to keep its buffer and cursor")
+	}
+
+	// Windows showing the same buffer have their own cursors
+	if err := editor.executeCommand(":split"); err != nil {
+		t.Fatal(err)
+	}
+	top := editor.Window
+	editor.cursorY = 2
+	editor.handleCommandMode(tcell.NewEventKey(tcell.KeyCtrlW, 0, tcell.ModCtrl))
+	editor.handleCommandMode(tcell.NewEventKey(tcell.KeyRune, 'j', tcell.ModNone))
+	if editor.Window == top || editor.Buffer != top.Buffer || editor.cursorY != 0 || top.top != 0 || editor.top != top.height {
+		t.Errorf("Expected Ctrl-W j to move to the window below, at line %d", editor.cursorY)
+	}
+	editor.handleCommandMode(tcell.NewEventKey(tcell.KeyCtrlW, 0, tcell.ModCtrl))
+	editor.handleCommandMode(tcell.NewEventKey(tcell.KeyRune, 'l', tcell.ModNone))
+	if editor.Window != first {
+		t.Errorf("Expected Ctrl-W l to move to the window on the right")
+	}
+
+	// Edits above another window's cursor keep it on the same line
+	editor.switchWindow(top)
+	editor.insertText(0, 0, []rune("// Package sum\n"))
+	if below := editor.windows()[1]; below.cursorY != 1 {
+		t.Errorf("Expected the other window's cursor to follow the edit, got %d", below.cursorY)
+	}
+
+	// Edits on the line of another window's cursor keep it on the same character, within the line
+	below := editor.windows()[1]
+	below.cursorX = 10
+	editor.deleteText(0, 1, 8, 1)
+	if below.cursorX != 2 || below.cursorY != 1 {
+		t.Errorf("Expected the other window's cursor to follow the edit on its line, got (%d, %d)", below.cursorX, below.cursorY)
+	}
+	editor.deleteText(0, 1, 3, 1)
+	if below.cursorX != 0 || below.cursorY != 1 {
+		t.Errorf("Expected the other window's cursor clamped to its line, got (%d, %d)", below.cursorX, below.cursorY)
+	}
+
+	// Resizing takes rows from the window below
+	height := top.height
+	if err := editor.executeCommand(":resize +3"); err != nil || top.height != height+3 {
+		t.Errorf("Expected the window to grow by 3 rows, got %d (%v)", top.height, err)
+	}
+	typeNormalKeys(editor, "2")
+	editor.handleCommandMode(tcell.NewEventKey(tcell.KeyCtrlW, 0, tcell.ModCtrl))
+	editor.handleCommandMode(tcell.NewEventKey(tcell.KeyRune, '-', tcell.ModNone))
+	if top.height != height+1 {
+		t.Errorf("Expected 2 Ctrl-W - to shrink the window by 2 rows, got %d", top.height)
+	}
+	if err := editor.executeCommand(":vertical resize 30"); err != nil || top.width != 30 || first.width != 49 {
+		t.Errorf("Expected the left column to be 30 wide, got %d and %d (%v)", top.width, first.width, err)
+	}
+
+	// The status line of each window shows its file
+	editor.draw()
+	if got := screenText(screen, 0, top.height-1, top.width); got != test[:top.width] {
+		t.Errorf("Expected the window status line to show %q, got %q", test, got)
+	}
+	if got := screenText(screen, top.width, 0, 1); got != string(windowSeparator) {
+		t.Errorf("Expected a separator between the columns, got %q", got)
+	}
+
+	// A buffer shortened in another window while hidden is shown with the cursor on its text
+	long := filepath.Join(dir, "long.txt")
+	os.WriteFile(long, []byte(strings.Repeat("line\n", 50)), 0o644)
+	if err := editor.executeCommand(":e " + long); err != nil {
+		t.Fatal(err)
+	}
+	editor.cursorY, editor.offsetY = 40, 17
+	if err := editor.executeCommand(":e " + impl); err != nil {
+		t.Fatal(err)
+	}
+	other := editor.windows()[1]
+	editor.switchWindow(other)
+	if err := editor.executeCommand(":e " + long); err != nil {
+		t.Fatal(err)
+	}
+	typeNormalKeys(editor, "ggdG")
+	editor.switchWindow(top)
+	if err := editor.executeCommand(":e " + long); err != nil {
+		t.Fatal(err)
+	}
+	if editor.cursorX != 0 || editor.cursorY != 0 || editor.offsetY != 0 {
+		t.Errorf("Expected the cursor and scroll position clamped to the buffer, got (%d, %d) scrolled to %d", editor.cursorX, editor.cursorY, editor.offsetY)
+	}
+
+	// :q closes windows until the last one
+	if err := editor.executeCommand(":q"); err != nil || len(editor.windows()) != 2 {
+		t.Fatalf("Expected :q to close the window (%v)", err)
+	}
+	if err := editor.executeCommand(":only"); err != nil || len(editor.windows()) != 1 || editor.height != 25 || editor.width != 80 {
+		t.Errorf("Expected :only to leave one full screen window")
+	}
+	if err := editor.executeCommand(":close"); err == nil {
+		t.Errorf("Expected an error closing the last window")
+	}
+}
+
+func TestEditorVisualMode(t *testing.T) {
+	screen := tcell.NewSimulationScreen("UTF-8")
+	screen.Init()
+	defer screen.Fini()
+
+	editor := NewEditor(screen, defaultTheme())
+	editor.text = NewPieceTableFromLines([][]rune{
+		[]rune("one two three"),
+		[]rune("four five"),
+		[]rune("six"),
+	})
+	editor.inCommandMode = true
+	lines := func() string {
+		var text []string
+		for y := range editor.text.LineCount() {
+			text = append(text, string(editor.text.Line(y)))
+		}
+		return strings.Join(text, "|")
+	}
+
+	// Character-wise selections include the character under the cursor
+	typeNormalKeys(editor, "wvey")
+	if string(editor.registers['"'].text) != "two" || editor.visual != visualNone {
+		t.Errorf("Expected 'two' yanked and visual mode left, got '%s'", string(editor.registers['"'].text))
+	}
+	typeNormalKeys(editor, "vjd")
+	if got := lines(); got != "one five|six" {
+		t.Errorf("Expected a selection across lines deleted, got '%s'", got)
+	}
+	typeNormalKeys(editor, "u")
+
+	// The selection is drawn with the visual style
+	screen.SetSize(40, 10)
+	editor.updateScreenSize()
+	typeNormalKeys(editor, "ggvl")
+	editor.draw()
+	cells, _, _ := screen.GetContents()
+	_, visual, _ := editor.theme.Style(scopeVisual).Decompose()
+	selected := func(x int) bool {
+		_, bg, _ := cells[editor.gutterWidth()+1+x].Style.Decompose()
+		return bg == visual
+	}
+	if !selected(0) || !selected(1) || selected(2) {
+		t.Errorf("Expected the first two characters drawn selected")
+	}
+	editor.handleCommandMode(tcell.NewEventKey(tcell.KeyEsc, 0, tcell.ModNone))
+
+	// Line-wise selections, indentation and case
+	typeNormalKeys(editor, "Vj2>")
+	if got := lines(); got != "\t\tone two three|\t\tfour five|six" {
+		t.Errorf("Expected two lines indented twice, got '%q'", got)
+	}
+	typeNormalKeys(editor, "Vj<VjU")
+	if got := lines(); got != "\tONE TWO THREE|\tFOUR FIVE|six" {
+		t.Errorf("Expected lines dedented and uppercased, got '%q'", got)
+	}
+	typeNormalKeys(editor, "Vj<Vj~")
+	if got := lines(); got != "one two three|four five|six" {
+		t.Errorf("Expected case switched back, got '%q'", got)
+	}
+
+	// Block selections, and the text typed after c repeated on every line
+	editor.handleCommandMode(tcell.NewEventKey(tcell.KeyCtrlV, 0, tcell.ModCtrl))
+	typeNormalKeys(editor, "jjlc")
+	if got := lines(); got != "e two three|ur five|x" || string(editor.registers['"'].text) != "on\nfo\nsi" {
+		t.Errorf("Expected a block deleted, got '%s', register '%q'", got, string(editor.registers['"'].text))
+	}
+	typeNormalKeys(editor, "##")
+	editor.handleInsertMode(tcell.NewEventKey(tcell.KeyEsc, 0, tcell.ModNone))
+	if got := lines(); got != "##e two three|##ur five|##x" {
+		t.Errorf("Expected the insert repeated on the block, got '%s'", got)
+	}
+	typeNormalKeys(editor, "u")
+	if got := lines(); got != "one two three|four five|six" {
+		t.Errorf("Expected the block change undone in one step, got '%s'", got)
+	}
+
+	// A yanked block is pasted as a block
+	typeNormalKeys(editor, "gg")
+	editor.handleCommandMode(tcell.NewEventKey(tcell.KeyCtrlV, 0, tcell.ModCtrl))
+	typeNormalKeys(editor, "jlyP")
+	if got := lines(); got != "onone two three|fofour five|six" {
+		t.Errorf("Expected the block pasted before the cursor, got '%s'", got)
+	}
+	typeNormalKeys(editor, "u")
+
+	// The last selection is the '<,'> range, which the selected lines can be filtered through
+	typeNormalKeys(editor, "Vj")
+	editor.handleCommandMode(tcell.NewEventKey(tcell.KeyEsc, 0, tcell.ModNone))
+	if err := editor.executeCommand(":'<,'>!sort"); err != nil {
+		t.Fatal(err)
+	}
+	if got := lines(); got != "four five|one two three|six" {
+		t.Errorf("Expected the selected lines sorted, got '%s'", got)
+	}
+	if err := editor.executeCommand(":'<,'>s/o/0/g"); err != nil {
+		t.Fatal(err)
+	}
+	if got := lines(); got != "f0ur five|0ne tw0 three|six" {
+		t.Errorf("Expected :s to apply to the selected lines, got '%s'", got)
+	}
+
+	// Blocks span display columns, so a tab counts for the columns it takes on the screen
+	editor.text = NewPieceTableFromLines([][]rune{
+		[]rune("\tx = 1"),
+		[]rune("abcdefgh"),
+	})
+	editor.cursorX, editor.cursorY = 1, 0
+	editor.handleCommandMode(tcell.NewEventKey(tcell.KeyCtrlV, 0, tcell.ModCtrl))
+	editor.cursorX, editor.cursorY = 4, 1
+	typeNormalKeys(editor, "d")
+	if got := lines(); got != "\t = 1|abcdfgh" || string(editor.registers['"'].text) != "x\ne" {
+		t.Errorf("Expected the block at column 4 deleted, got '%q', register '%q'", got, string(editor.registers['"'].text))
+	}
+	editor.cursorX, editor.cursorY = 1, 1
+	editor.handleCommandMode(tcell.NewEventKey(tcell.KeyCtrlV, 0, tcell.ModCtrl))
+	typeNormalKeys(editor, "kI")
+	typeNormalKeys(editor, "#")
+	editor.handleInsertMode(tcell.NewEventKey(tcell.KeyEsc, 0, tcell.ModNone))
+	if got := lines(); got != "#\t = 1|#abcdfgh" {
+		t.Errorf("Expected the insert before the block over the tab, got '%q'", got)
+	}
+}
+
+func TestEditorRegisters(t *testing.T) {
+	// Use only OSC 52 for the clipboard, whatever tools are installed
+	t.Setenv("DISPLAY", "")
+	t.Setenv("WAYLAND_DISPLAY", "")
+
+	screen := tcell.NewSimulationScreen("UTF-8")
+	screen.Init()
+	defer screen.Fini()
+
+	editor := NewEditor(screen, defaultTheme())
+	editor.text = NewPieceTableFromLines([][]rune{
+		[]rune("one two"),
+		[]rune("three"),
+	})
+	editor.inCommandMode = true
+	lines := func() string {
+		var text []string
+		for y := range editor.text.LineCount() {
+			text = append(text, string(editor.text.Line(y)))
+		}
+		return strings.Join(text, "|")
+	}
+
+	// Named registers keep their text while others are yanked and deleted
+	typeNormalKeys(editor, `"ayw"Byyjyykx`)
+	if got := string(editor.registers['a'].text); got != "one " {
+		t.Errorf("Expected 'one ' in register a, got %q", got)
+	}
+	if reg := editor.registers['b']; string(reg.text) != "one two\n" || !reg.linewise {
+		t.Errorf("Expected the line in register b, got %q", string(reg.text))
+	}
+	if got := string(editor.registers['0'].text); got != "three\n" {
+		t.Errorf("Expected the last yank in register 0, got %q", got)
+	}
+	if got := string(editor.registers['"'].text); got != "o" {
+		t.Errorf("Expected the deletion in the unnamed register, got %q", got)
+	}
+
+	// Appending a line to a character-wise register makes it line-wise
+	typeNormalKeys(editor, `"Ayy`)
+	if reg := editor.registers['a']; string(reg.text) != "one \nne two\n" || !reg.linewise {
+		t.Errorf("Expected the line appended to register a, got %q", string(reg.text))
+	}
+
+	// Pasting respects line-wise and character-wise text
+	typeNormalKeys(editor, `"ap"0P`)
+	if got := lines(); got != "ne two|three|one |ne two|three" {
+		t.Errorf("Expected the registers pasted, got %q", got)
+	}
+
+	// The black hole register keeps the unnamed register
+	typeNormalKeys(editor, `gg"_dd`)
+	if got := string(editor.registers['"'].text); got != "one \nne two\n" {
+		t.Errorf("Expected the unnamed register kept, got %q", got)
+	}
+
+	// The clipboard register is copied to the terminal with OSC 52
+	typeNormalKeys(editor, `v"+y`)
+	if got := string(screen.GetClipboardData()); got != "t" {
+		t.Errorf("Expected the selection copied to the clipboard, got %q", got)
+	}
+	typeNormalKeys(editor, `"*P`)
+	if got := lines(); got != "tthree|one |ne two|three" {
+		t.Errorf("Expected the clipboard pasted, got %q", got)
+	}
+	if err := editor.executeCommand(":reg a+"); err != nil {
+		t.Fatal(err)
+	}
+	if editor.status != `"a one ^Jne two^J  "+ t` {
+		t.Errorf("Unexpected :registers output: %q", editor.status)
+	}
+}
+
+func TestEditorMultipleCursors(t *testing.T) {
+	screen := tcell.NewSimulationScreen("UTF-8")
+	screen.Init()
+	defer screen.Fini()
+	screen.SetSize(40, 10)
+
+	editor := NewEditor(screen, defaultTheme())
+	editor.updateScreenSize()
+	editor.text = NewPieceTableFromLines([][]rune{
+		[]rune("foo bar foo"),
+		[]rune("baz foo"),
+		[]rune("qux"),
+	})
+	editor.inCommandMode = true
+	lines := func() string {
+		var text []string
+		for y := range editor.text.LineCount() {
+			text = append(text, string(editor.text.Line(y)))
+		}
+		return strings.Join(text, "|")
+	}
+	ctrlN := tcell.NewEventKey(tcell.KeyCtrlN, 0, tcell.ModCtrl)
+	esc := tcell.NewEventKey(tcell.KeyEsc, 0, tcell.ModNone)
+
+	// Ctrl-N adds cursors at the next occurrences of the word, until every one has a cursor
+	typeNormalKeys(editor, "l")
+	for range 3 {
+		editor.handleCommandMode(ctrlN)
+	}
+	if !slices.Equal(editor.cursors, []cursor{{x: 9, y: 0}, {x: 5, y: 1}}) || editor.status != statusNoMoreMatches {
+		t.Fatalf("Expected cursors in the other occurrences of foo, got %v", editor.cursors)
+	}
+
+	// Additional cursors are drawn with the cursor style
+	editor.draw()
+	cells, _, _ := screen.GetContents()
+	if _, _, attrs := cells[1*40+editor.gutterWidth()+1+5].Style.Decompose(); attrs&tcell.AttrReverse == 0 {
+		t.Errorf("Expected the cursor on the second line drawn reversed")
+	}
+
+	// Insert mode edits apply at every cursor, and are undone together
+	typeNormalKeys(editor, "ixy")
+	editor.handleInsertMode(tcell.NewEventKey(tcell.KeyBackspace2, 0, tcell.ModNone))
+	editor.handleInsertMode(esc)
+	if got := lines(); got != "fxoo bar fxoo|baz fxoo|qux" {
+		t.Errorf("Expected the text typed at every cursor, got %q", got)
+	}
+	typeNormalKeys(editor, "u")
+	if got := lines(); got != "foo bar foo|baz foo|qux" {
+		t.Errorf("Expected the edits undone in one step, got %q", got)
+	}
+
+	// Normal mode commands apply at every cursor too; Esc goes back to one cursor
+	typeNormalKeys(editor, "x")
+	if got := lines(); got != "fo bar fo|baz fo|qux" {
+		t.Errorf("Expected x at every cursor, got %q", got)
+	}
+	editor.handleCommandMode(esc)
+	if len(editor.cursors) != 0 || !editor.inCommandMode {
+		t.Errorf("Expected Esc to remove the additional cursors")
+	}
+
+	// Cursors added below insert a column
+	typeNormalKeys(editor, "gg")
+	for range 2 {
+		editor.handleCommandMode(tcell.NewEventKey(tcell.KeyDown, 0, tcell.ModCtrl))
+	}
+	typeNormalKeys(editor, "I- ")
+	editor.handleInsertMode(tcell.NewEventKey(tcell.KeyEnter, 0, tcell.ModNone))
+	if got := lines(); got != "- |fo bar fo|- |baz fo|- |qux" {
+		t.Errorf("Expected a line break at every cursor, got %q", got)
+	}
+	if !slices.Equal(editor.cursors, []cursor{{x: 0, y: 3}, {x: 0, y: 5}}) {
+		t.Errorf("Expected the cursors moved down with their lines, got %v", editor.cursors)
+	}
+}
+
+func TestEditorUnicodeWidth(t *testing.T) {
+	screen := tcell.NewSimulationScreen("UTF-8")
+	screen.Init()
+	defer screen.Fini()
+	screen.SetSize(20, 10)
+
+	editor := NewEditor(screen, defaultTheme())
+	editor.updateScreenSize()
+	editor.text = NewPieceTableFromLines([][]rune{
+		[]rune("a世界b"),
+		[]rune("éx"),
+		[]rune(strings.Repeat("世", 30)),
+	})
+	editor.inCommandMode = true
+	left := editor.gutterWidth() + 1
+
+	// Wide characters take two columns
+	editor.draw()
+	if screenText(screen, left+1, 0, 1) != "世" || screenText(screen, left+3, 0, 1) != "界" || screenText(screen, left+5, 0, 1) != "b" {
+		t.Errorf("Expected wide characters drawn in two columns, got %q", screenText(screen, left, 0, 6))
+	}
+
+	// The cursor moves one character per keypress and is placed on its first column
+	typeNormalKeys(editor, "ll")
+	editor.draw()
+	if x, _, _ := screen.GetCursor(); editor.cursorX != 2 || x != left+3 {
+		t.Errorf("Expected the cursor on 界 at column %d, got position %d at column %d", left+3, editor.cursorX, x)
+	}
+
+	// A letter with a combining mark is a single character
+	typeNormalKeys(editor, "j0l")
+	if editor.cursorX != 2 {
+		t.Errorf("Expected l to move over the combining mark, got position %d", editor.cursorX)
+	}
+	typeNormalKeys(editor, "i")
+	editor.handleInsertMode(tcell.NewEventKey(tcell.KeyBackspace2, 0, tcell.ModNone))
+	editor.handleInsertMode(tcell.NewEventKey(tcell.KeyEsc, 0, tcell.ModNone))
+	if got := string(editor.text.Line(1)); got != "x" {
+		t.Errorf("Expected backspace to delete the letter with its mark, got %q", got)
+	}
+
+	// Horizontal scrolling keeps the whole character under the cursor visible
+	typeNormalKeys(editor, "j$")
+	editor.adjustOffsets()
+	editor.draw()
+	x, _, _ := screen.GetCursor()
+	if x != 18 || screenText(screen, x, 2, 1) != "世" {
+		t.Errorf("Expected the last character at the right edge, got the cursor at column %d", x)
+	}
+}
+
+func TestEditorTabStops(t *testing.T) {
+	screen := tcell.NewSimulationScreen("UTF-8")
+	screen.Init()
+	defer screen.Fini()
+	screen.SetSize(40, 10)
+
+	editor := NewEditor(screen, defaultTheme())
+	editor.updateScreenSize()
+	editor.text = NewPieceTableFromLines([][]rune{
+		[]rune("a\tb"),
+		[]rune("abc\td"),
+		[]rune("\t\tx"),
+	})
+	editor.inCommandMode = true
+	left := editor.gutterWidth() + 1
+
+	// Tabs advance to the next multiple of the tab width
+	for y, x := range []int{4, 4, 8} {
+		if got := editor.bufferToVirtualX(editor.text.Line(y), editor.text.LineLen(y)-1); got != x {
+			t.Errorf("Expected the last character of line %d at column %d, got %d", y, x, got)
+		}
+	}
+	editor.draw()
+	if screenText(screen, left, 0, 5) != "a   b" || screenText(screen, left, 1, 5) != "abc d" {
+		t.Errorf("Expected tabs drawn up to the tab stop, got %q and %q", screenText(screen, left, 0, 5), screenText(screen, left, 1, 5))
+	}
+
+	// Moving up and down keeps the screen column
+	typeNormalKeys(editor, "j$k")
+	if editor.cursorX != 2 {
+		t.Errorf("Expected the cursor on b after moving up, got position %d", editor.cursorX)
+	}
+	typeNormalKeys(editor, "jh")
+	editor.draw()
+	if x, _, _ := screen.GetCursor(); x != left+3 {
+		t.Errorf("Expected the cursor on the tab at column %d, got %d", left+3, x)
+	}
+
+	// The tab width follows the tabstop option
+	editor.spacesPerTab = 8
+	if got := editor.bufferToVirtualX(editor.text.Line(1), 4); got != 8 {
+		t.Errorf("Expected d at column 8, got %d", got)
+	}
+}
+
+func TestEditorWrapLines(t *testing.T) {
+	screen := tcell.NewSimulationScreen("UTF-8")
+	screen.Init()
+	defer screen.Fini()
+	screen.SetSize(20, 10)
+
+	editor := NewEditor(screen, defaultTheme())
+	editor.updateScreenSize()
+	editor.text = NewPieceTableFromLines([][]rune{
+		[]rune("aaaa bbbb cccc ddddddd"),
+		[]rune("x"),
+	})
+	editor.inCommandMode = true
+	editor.showLineNumbers = false
+	if err := editor.executeSetCommand([]string{"wrap"}); err != nil || !editor.wrapLines {
+		t.Fatalf("Expected :set wrap to enable wrapping, got %v", err)
+	}
+
+	// Long lines continue on the next screen rows
+	editor.draw()
+	if screenText(screen, 0, 1, 3) != "dd " || screenText(screen, 0, 2, 1) != "x" {
+		t.Errorf("Expected the line wrapped at the window width, got %q and %q", screenText(screen, 0, 1, 3), screenText(screen, 0, 2, 1))
+	}
+	typeNormalKeys(editor, "$")
+	editor.adjustOffsets()
+	editor.draw()
+	if x, y, _ := screen.GetCursor(); x != 1 || y != 1 {
+		t.Errorf("Expected the cursor on the second row at (1, 1), got (%d, %d)", x, y)
+	}
+
+	// Up and down move by screen row
+	typeNormalKeys(editor, "k")
+	if editor.cursorX != 1 || editor.cursorY != 0 {
+		t.Errorf("Expected k to move to the first row of the line, got (%d, %d)", editor.cursorX, editor.cursorY)
+	}
+	typeNormalKeys(editor, "jj")
+	if editor.cursorX != 0 || editor.cursorY != 1 {
+		t.Errorf("Expected jj to move to the next line, got (%d, %d)", editor.cursorX, editor.cursorY)
+	}
+
+	// With linebreak, rows end after a blank; the wrap indicator starts the rows a line continues on
+	if err := editor.executeSetCommand([]string{"lbr", "sbr=>"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	editor.draw()
+	if got := screenText(screen, 0, 1, 9); got != ">ddddddd " {
+		t.Errorf("Expected the line wrapped before the last word, got %q", got)
+	}
+
+	// Scrolling and paging count the rows of wrapped lines
+	editor.executeSetCommand([]string{"nolbr", "sbr="})
+	lines := make([][]rune, 6)
+	for y := range lines {
+		lines[y] = []rune(strings.Repeat("a", 50)) // Three rows each
+	}
+	editor.text = NewPieceTableFromLines(lines)
+	typeNormalKeys(editor, "G")
+	editor.adjustOffsets()
+	editor.draw()
+	if _, y, _ := screen.GetCursor(); editor.offsetY != 3 || y != 6 {
+		t.Errorf("Expected the window scrolled to line 3 and the cursor on row 6, got line %d and row %d", editor.offsetY, y)
+	}
+	editor.handleCommandMode(tcell.NewEventKey(tcell.KeyPgUp, 0, tcell.ModNone))
+	if editor.offsetY != 0 || editor.cursorY != 0 {
+		t.Errorf("Expected PageUp to scroll up three lines, got line %d", editor.offsetY)
+	}
+	editor.handleCommandMode(tcell.NewEventKey(tcell.KeyPgDn, 0, tcell.ModNone))
+	if editor.offsetY != 3 || editor.cursorY != 5 {
+		t.Errorf("Expected PageDown to scroll down three lines, got line %d and the cursor on line %d", editor.offsetY, editor.cursorY)
+	}
+}
+
+func TestEditorIndent(t *testing.T) {
+	screen := tcell.NewSimulationScreen("UTF-8")
+	screen.Init()
+	defer screen.Fini()
+
+	editor := NewEditor(screen, defaultTheme())
+	editor.highlighter.SetFiletype(filetypeGo)
+	editor.text = NewPieceTableFromLines([][]rune{[]rune("func f() {")})
+	editor.inCommandMode = true
+	lines := func() string {
+		var text []string
+		for y := range editor.text.LineCount() {
+			text = append(text, string(editor.text.Line(y)))
+		}
+		return strings.Join(text, "|")
+	}
+	enter := tcell.NewEventKey(tcell.KeyEnter, 0, tcell.ModNone)
+	tab := tcell.NewEventKey(tcell.KeyTab, 0, tcell.ModNone)
+	backspace := tcell.NewEventKey(tcell.KeyBackspace2, 0, tcell.ModNone)
+	esc := tcell.NewEventKey(tcell.KeyEsc, 0, tcell.ModNone)
+
+	// New lines keep the indentation, one level more after a block opener; a closer dedents
+	typeNormalKeys(editor, "A")
+	editor.handleInsertMode(enter)
+	typeNormalKeys(editor, "x")
+	editor.handleInsertMode(enter)
+	typeNormalKeys(editor, "}")
+	editor.handleInsertMode(esc)
+	if got := lines(); got != "func f() {|\tx|}" {
+		t.Errorf("Expected the block indented, got %q", got)
+	}
+
+	// Enter between a block opener and its closer puts the closer on a line of its own
+	editor.text = NewPieceTableFromLines([][]rune{[]rune("\tif {}")})
+	typeNormalKeys(editor, "$i")
+	editor.handleInsertMode(enter)
+	if got := lines(); got != "\tif {|\t\t|\t}" || editor.cursorX != 2 || editor.cursorY != 1 {
+		t.Errorf("Expected the closer on its own line, got %q with the cursor at (%d, %d)", got, editor.cursorX, editor.cursorY)
+	}
+	editor.handleInsertMode(esc)
+
+	// o indents the new line like Enter at the end of the line
+	typeNormalKeys(editor, "ggoy")
+	editor.handleInsertMode(esc)
+	if got := string(editor.text.Line(1)); got != "\t\ty" {
+		t.Errorf("Expected o to indent the new line, got %q", got)
+	}
+
+	// With expandtab, Tab inserts spaces up to the next tab stop and backspace removes them together
+	if err := editor.executeSetCommand([]string{"et", "ts=4"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	editor.text = NewPieceTableFromLines([][]rune{[]rune("ab")})
+	typeNormalKeys(editor, "0i")
+	editor.handleInsertMode(tab)
+	editor.handleInsertMode(tab)
+	if got := lines(); got != "        ab" {
+		t.Errorf("Expected Tab to insert spaces, got %q", got)
+	}
+	editor.handleInsertMode(backspace)
+	if got := lines(); got != "    ab" || editor.cursorX != 4 {
+		t.Errorf("Expected backspace to remove a level of indentation, got %q", got)
+	}
+	editor.handleInsertMode(esc)
+	typeNormalKeys(editor, "V>")
+	if got := lines(); got != "        ab" {
+		t.Errorf("Expected > to indent with spaces, got %q", got)
+	}
+
+	// Without autoindent, new lines start at column 0
+	editor.executeSetCommand([]string{"noai"})
+	typeNormalKeys(editor, "A")
+	editor.handleInsertMode(enter)
+	if got := lines(); got != "        ab|" {
+		t.Errorf("Expected no indentation without autoindent, got %q", got)
+	}
+}
+
+func TestHighlightersLongLine(t *testing.T) {
+	theme := defaultTheme()
+	styles := newSyntaxStyles(theme)
+	highlighters := []Highlighter{
+		NewGoHighlighter(theme), NewPythonHighlighter(styles), NewJSONHighlighter(styles), NewYAMLHighlighter(styles),
+		NewMarkdownHighlighter(styles), NewShellHighlighter(styles), NewMakefileHighlighter(styles),
+		NewDockerfileHighlighter(styles), NewGoModHighlighter(styles),
+	}
+	// A long string and a long run of words, as in minified files; lexing must take linear time
+	n := 1 << 18
+	lines := [][]rune{
+		[]rune(`x = "` + strings.Repeat("a", n) + `"`),
+		[]rune(strings.Repeat("a b ", n/4)),
+		[]rune("# " + strings.Repeat("c", n)),
+	}
+	start := time.Now()
+	for _, h := range highlighters {
+		for _, line := range lines {
+			h.HighlightLine(line, 0)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected long lines to be highlighted quickly, took %v", elapsed)
+	}
+}
+
+func TestGrammarHighlighterLimits(t *testing.T) {
+	g, err := parseTextMateGrammar([]byte(`{
+		"scopeName": "source.toy",
+		"patterns": [
+			{"begin": "\\(", "end": "\\)", "name": "meta.group.toy", "patterns": [{"include": "$self"}]},
+			{"begin": "<<(\\w+)", "end": "^\\1$", "name": "string.unquoted.heredoc.toy"},
+			{"match": "\\b(let|fn)\\b", "name": "keyword.control.toy"},
+			{"match": "\"[^\"]*\"", "name": "string.quoted.double.toy"}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	theme := defaultTheme()
+	style := theme.Style(scopeDefault)
+	styles := newSyntaxStyles(theme)
+	gh := NewGrammarHighlighter(g, styles)
+
+	// Unbalanced nesting stops growing the stack at its limit
+	_, state := gh.HighlightLine([]rune(strings.Repeat("(", 10*grammarMaxStackDepth)), 0)
+	if depth := len(gh.stacks[state]); depth != grammarMaxStackDepth {
+		t.Errorf("Expected the stack capped at %d contexts, got %d", grammarMaxStackDepth, depth)
+	}
+
+	// Lines opening heredocs with distinct delimiters stop adding states at the limit
+	for i := range 2 * grammarMaxStates {
+		gh.HighlightLine([]rune("<<EOT"+strconv.Itoa(i)), 0)
+	}
+	if len(gh.stacks) > grammarMaxStates {
+		t.Errorf("Expected at most %d lexer states, got %d", grammarMaxStates, len(gh.stacks))
+	}
+
+	// Patterns are not searched again from every position of a long line
+	line := []rune(strings.Repeat("let x ", 1<<15) + `"` + strings.Repeat("y", 1<<15))
+	start := time.Now()
+	spans, _ := gh.HighlightLine(line, 0)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected a long line to be highlighted quickly, took %v", elapsed)
+	}
+	if spanStyle(spans, 0, style) != styles.keyword || spanStyle(spans, 6*(1<<15-1), style) != styles.keyword {
+		t.Errorf("Expected every keyword of the long line highlighted")
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+var makeDirectives = wordSet(`include -include sinclude ifeq ifneq ifdef ifndef else endif define endef
+	export unexport override private undefine vpath`)
+
+// MakefileHighlighter implements syntax highlighting for Makefiles.
+// Recipe lines, which start with a tab, are styled as shell commands.
+type MakefileHighlighter struct {
+	styles syntaxStyles
+	shell  *ShellHighlighter
+}
+
+// NewMakefileHighlighter initializes a new MakefileHighlighter with default styles.
+func NewMakefileHighlighter(styles syntaxStyles) *MakefileHighlighter {
+	return &MakefileHighlighter{styles: styles, shell: NewShellHighlighter(styles)}
+}
+
+// HighlightLine returns the styled spans of a given Makefile line.
+func (mh *MakefileHighlighter) HighlightLine(src []rune, state LexState) ([]StyleSpan, LexState) {
+	l := newLineLexer(src)
+	if l.peek(0) == '\t' {
+		mh.recipe(l)
+		return l.spans, state
+	}
+
+	l.skipWhile(unicode.IsSpace)
+	if l.peek(0) == '#' {
+		l.emitRest(mh.styles.comment)
+		return l.spans, state
+	}
+
+	// A directive, a variable assignment or a rule
+	start := l.pos
+	word := string(l.src[start : start+l.skipWhile(func(r rune) bool { return !unicode.IsSpace(r) && r != ':' && r != '=' })])
+	definition := true // Whether the line may define a variable or a rule
+	if makeDirectives[word] {
+		definition = word == "export" || word == "override" || word == "private"
+		l.emit(start, mh.styles.keyword)
+		l.skipWhile(unicode.IsSpace)
+		start = l.pos
+	} else {
+		l.pos = start
+	}
+	rest := string(l.rest())
+	if i := strings.IndexAny(rest, ":=#"); i >= 0 && definition {
+		head := []rune(rest[:i])
+		if op := rest[i:]; strings.HasPrefix(op, "=") || strings.HasPrefix(op, ":=") || strings.HasPrefix(op, "::=") ||
+			(len(head) > 0 && strings.ContainsRune("?+!", head[len(head)-1]) && op[0] == '=') {
+			// Variable assignment: NAME = value, NAME := value, NAME ?= value, ...
+			name := strings.TrimRight(string(head), "?+! \t")
+			l.pos += len([]rune(name))
+			l.emit(start, mh.styles.variable)
+		} else if op[0] == ':' {
+			// Rule: the targets are styled up to the colon
+			l.pos += len(head)
+			l.emit(start, mh.styles.key)
+		}
+	}
+	mh.expansions(l, false)
+	return l.spans, state
+}
+
+// recipe styles a recipe line: make's own variable references and the shell command around them.
+func (mh *MakefileHighlighter) recipe(l *lineLexer) {
+	l.skipWhile(unicode.IsSpace)
+	start := l.pos
+	if l.skipWhile(func(r rune) bool { return strings.ContainsRune("@-+", r) }) > 0 {
+		l.emit(start, mh.styles.operator) // Echo and error suppression prefixes
+	}
+	mh.expansions(l, true)
+}
+
+// expansions styles the rest of the line, highlighting variable references such as $(CC), ${FLAGS} and $@.
+// The text between references is styled as shell code if shell is true, or for comments and operators otherwise.
+func (mh *MakefileHighlighter) expansions(l *lineLexer, shell bool) {
+	state := shStateCode
+	for !l.eof() {
+		// Style the text up to the next reference
+		if shell {
+			end := l.pos
+			for end < len(l.src) && l.src[end] != '$' {
+				end++
+			}
+			text := newLineLexer(l.src[:end])
+			text.pos = l.pos
+			state = mh.shell.lex(text, state)
+			for _, span := range text.spans {
+				l.spans = appendSpan(l.spans, span.Start, span.End, span.Style)
+			}
+			l.pos = end
+		} else {
+			for !l.eof() && l.peek(0) != '$' {
+				start := l.pos
+				switch r := l.peek(0); {
+				case r == '#':
+					l.emitRest(mh.styles.comment)
+				case strings.ContainsRune(":=|;", r):
+					l.pos++
+					l.emit(start, mh.styles.operator)
+				default:
+					l.pos++
+				}
+			}
+		}
+		if l.eof() {
+			return
+		}
+
+		// Style the reference itself
+		start := l.pos
+		l.pos++
+		switch r := l.peek(0); {
+		case r == '(' || r == '{':
+			closing := ')'
+			if r == '{' {
+				closing = '}'
+			}
+			for depth := 0; !l.eof(); {
+				c := l.peek(0)
+				l.pos++
+				if c == r {
+					depth++
+				} else if c == closing {
+					if depth--; depth == 0 {
+						break
+					}
+				}
+			}
+		case r == '$':
+			// An escaped dollar passes a variable reference on to the shell
+			l.pos++
+			l.skipWhile(isIdentRune)
+		default:
+			l.pos++
+		}
+		l.emit(start, mh.styles.variable)
+	}
+}
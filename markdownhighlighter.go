@@ -0,0 +1,132 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Lexer states carried between lines of Markdown documents
+const (
+	mdStateText          LexState = iota // Plain text
+	mdStateFenceBacktick                 // Inside a ``` fenced code block
+	mdStateFenceTilde                    // Inside a ~~~ fenced code block
+)
+
+// MarkdownHighlighter implements syntax highlighting for Markdown files.
+type MarkdownHighlighter struct {
+	styles syntaxStyles
+}
+
+// NewMarkdownHighlighter initializes a new MarkdownHighlighter with default styles.
+func NewMarkdownHighlighter(styles syntaxStyles) *MarkdownHighlighter {
+	return &MarkdownHighlighter{styles: styles}
+}
+
+// HighlightLine returns the styled spans of a given Markdown line.
+// Fenced code blocks may span lines.
+func (mh *MarkdownHighlighter) HighlightLine(src []rune, state LexState) ([]StyleSpan, LexState) {
+	l := newLineLexer(src)
+	trimmed := strings.TrimLeftFunc(string(src), unicode.IsSpace)
+
+	// Fenced code blocks
+	if state != mdStateText {
+		fence := "```"
+		if state == mdStateFenceTilde {
+			fence = "~~~"
+		}
+		l.emitRest(mh.styles.code)
+		if strings.HasPrefix(trimmed, fence) {
+			return l.spans, mdStateText
+		}
+		return l.spans, state
+	}
+	if strings.HasPrefix(trimmed, "```") {
+		l.emitRest(mh.styles.code)
+		return l.spans, mdStateFenceBacktick
+	}
+	if strings.HasPrefix(trimmed, "~~~") {
+		l.emitRest(mh.styles.code)
+		return l.spans, mdStateFenceTilde
+	}
+
+	// Headings and horizontal rules take the whole line
+	if level := len(trimmed) - len(strings.TrimLeft(trimmed, "#")); level > 0 && level <= 6 &&
+		(len(trimmed) == level || trimmed[level] == ' ') {
+		l.emitRest(mh.styles.heading)
+		return l.spans, state
+	}
+	if rule := strings.ReplaceAll(trimmed, " ", ""); len(rule) >= 3 &&
+		(strings.Trim(rule, "-") == "" || strings.Trim(rule, "*") == "" || strings.Trim(rule, "_") == "") {
+		l.emitRest(mh.styles.operator)
+		return l.spans, state
+	}
+
+	// Block quotes and list markers
+	l.skipWhile(unicode.IsSpace)
+	for start := l.pos; l.peek(0) == '>'; start = l.pos {
+		l.pos++
+		l.emit(start, mh.styles.operator)
+		l.skipWhile(unicode.IsSpace)
+	}
+	start := l.pos
+	if strings.ContainsRune("-*+", l.peek(0)) && l.peek(1) == ' ' {
+		l.pos++
+		l.emit(start, mh.styles.operator)
+	} else if n := l.skipWhile(unicode.IsDigit); n > 0 && (l.peek(0) == '.' || l.peek(0) == ')') && l.peek(1) == ' ' {
+		l.pos++
+		l.emit(start, mh.styles.operator)
+	} else {
+		l.pos = start
+	}
+
+	mh.inline(l)
+	return l.spans, state
+}
+
+// inline styles the inline markup in the rest of the line: code spans, emphasis and links.
+func (mh *MarkdownHighlighter) inline(l *lineLexer) {
+	for !l.eof() {
+		start := l.pos
+		switch r := l.peek(0); {
+		case r == '\\':
+			l.pos += 2 // Escaped character
+		case r == '`':
+			ticks := strings.Repeat("`", l.skipWhile(func(r rune) bool { return r == '`' }))
+			if !l.quoted(ticks, false) {
+				l.pos = start + len(ticks) // Unmatched backticks are literal
+				continue
+			}
+			l.emit(start, mh.styles.code)
+		case r == '*' || r == '_':
+			delim := strings.Repeat(string(r), min(l.skipWhile(func(c rune) bool { return c == r }), 3))
+			l.pos = start + len(delim)
+			if unicode.IsSpace(l.peek(0)) || l.eof() || (r == '_' && start > 0 && isIdentRune(l.src[start-1])) || !l.quoted(delim, true) {
+				l.pos = start + len(delim) // Not followed by text, inside a word or never closed
+				continue
+			}
+			l.emit(start, mh.styles.emphasis)
+		case r == '[' || (r == '!' && l.peek(1) == '['):
+			// Links and images: [text](url) or [text][ref]
+			if r == '!' {
+				l.pos++
+			}
+			l.pos++
+			if !l.quoted("]", true) || (l.peek(0) != '(' && l.peek(0) != '[') {
+				l.pos = start + 1
+				continue
+			}
+			closing := ")"
+			if l.peek(0) == '[' {
+				closing = "]"
+			}
+			l.pos++
+			l.quoted(closing, true)
+			l.emit(start, mh.styles.link)
+		case r == '<' && (l.hasPrefix("<http://") || l.hasPrefix("<https://")):
+			l.quoted(">", false)
+			l.emit(start, mh.styles.link)
+		default:
+			l.pos++
+		}
+	}
+}
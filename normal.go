@@ -0,0 +1,706 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+const (
+	normalOperators = "dcy"        // Operators that take a motion, e.g. "dw"
+	normalMotions   = "hjklwbe0$G" // Single-key motions; "gg" is parsed separately
+	normalActions   = "xXpPoOiaAIunN.:/?vV"
+	normalPrefixes  = "gZ"         // Keys that only form a command when doubled, e.g. "gg" and "ZZ"
+	normalChanges   = "xXpPoOiaAI" // Actions that modify the buffer and can be repeated with '.'
+)
+
+// parseState reports how far a sequence of pending keys is from a complete command.
+type parseState int
+
+const (
+	parseIncomplete parseState = iota // More keys are needed
+	parseComplete                     // The keys form a complete command
+	parseInvalid                      // The keys can never form a command
+)
+
+// normalCommand is a parsed normal mode command such as "3dw", "gg" or "x".
+type normalCommand struct {
+	count    int    // Repeat count; 0 if none was typed
+	register rune   // Register named with '"', or 0 for the unnamed register
+	operator rune   // Operator (d, c or y), or 0 for a plain motion or action
+	motion   string // Motion or action keys, e.g. "w", "gg", "x"; the operator itself for "dd"
+}
+
+// repeat returns the number of times the command applies, defaulting to one.
+func (c normalCommand) repeat() int {
+	return max(c.count, 1)
+}
+
+// parseCount parses a count at keys[i:]. A count cannot start with '0', which is a motion.
+// Returns: The count, or 0 if there is none, and the index of the key after it.
+func parseCount(keys []rune, i int) (int, int) {
+	n := 0
+	for i < len(keys) && unicode.IsDigit(keys[i]) && (keys[i] != '0' || n > 0) {
+		n = n*10 + int(keys[i]-'0')
+		i++
+	}
+	return n, i
+}
+
+// parseCommandPrefix parses the count and register name that can start a command, e.g. `2"a`.
+// Parameters:
+// - keys: The pending keys, in the order they were typed.
+// Returns: The count, the register name or 0, the index of the key after the prefix, and
+// whether the prefix is complete, waits for a register name, or names an invalid register.
+func parseCommandPrefix(keys []rune) (int, rune, int, parseState) {
+	count, i := parseCount(keys, 0)
+	if i == len(keys) || keys[i] != '"' {
+		return count, 0, i, parseComplete
+	}
+	if i+1 == len(keys) {
+		return count, 0, i, parseIncomplete
+	}
+	name := keys[i+1]
+	if !isRegisterName(name) {
+		return count, 0, i, parseInvalid
+	}
+	n, i := parseCount(keys, i+2)
+	if n > 0 {
+		count = max(count, 1) * n
+	}
+	return count, name, i, parseComplete
+}
+
+// parseNormalCommand parses the keys typed so far in normal mode.
+// The grammar is [count] ["x [count]] [operator [count]] motion, or [count] ["x [count]] action,
+// where x names the register the command yanks to, deletes to or pastes from.
+// Parameters:
+// - keys: The pending keys, in the order they were typed.
+// Returns: The parsed command and whether it is complete, incomplete or invalid.
+func parseNormalCommand(keys []rune) (normalCommand, parseState) {
+	count, name, i, state := parseCommandPrefix(keys)
+	cmd := normalCommand{count: count, register: name}
+	if state != parseComplete {
+		return cmd, state
+	}
+	if i == len(keys) {
+		return cmd, parseIncomplete
+	}
+	if strings.ContainsRune(normalOperators, keys[i]) {
+		cmd.operator = keys[i]
+		var n int
+		if n, i = parseCount(keys, i+1); n > 0 {
+			cmd.count = max(cmd.count, 1) * n
+		}
+		if i == len(keys) {
+			return cmd, parseIncomplete
+		}
+	}
+
+	switch r := keys[i]; {
+	case strings.ContainsRune(normalPrefixes, r):
+		if i+1 == len(keys) {
+			return cmd, parseIncomplete
+		}
+		if keys[i+1] != r || (r == 'Z' && cmd.operator != 0) {
+			return cmd, parseInvalid
+		}
+		cmd.motion = string(keys[i : i+2])
+		i++
+	case cmd.operator != 0 && r == cmd.operator:
+		cmd.motion = string(r) // Doubled operator works on whole lines, e.g. "dd"
+	case strings.ContainsRune(normalMotions, r):
+		cmd.motion = string(r)
+	case cmd.operator == 0 && strings.ContainsRune(normalActions, r):
+		cmd.motion = string(r)
+	default:
+		return cmd, parseInvalid
+	}
+	if i+1 != len(keys) {
+		return cmd, parseInvalid
+	}
+	return cmd, parseComplete
+}
+
+// handleNormalKey adds a key to the pending normal mode keys and executes them once they form a command.
+// Parameters:
+// - r: The rune typed by the user.
+func (e *Editor) handleNormalKey(r rune) {
+	e.pendingKeys = append(e.pendingKeys, r)
+	cmd, state := parseNormalCommand(e.pendingKeys)
+	switch state {
+	case parseIncomplete:
+		return
+	case parseInvalid:
+		e.pendingKeys = nil
+		return
+	}
+	e.pendingKeys = nil
+	e.executeNormalCommand(cmd)
+}
+
+// executeNormalCommand runs a parsed normal mode command.
+// Changes are recorded so '.' can repeat them, including the text typed if the command enters insert mode.
+// Parameters:
+// - cmd: The command to execute.
+func (e *Editor) executeNormalCommand(cmd normalCommand) {
+	isChange := cmd.operator == 'd' || cmd.operator == 'c' ||
+		(cmd.operator == 0 && strings.ContainsRune(normalChanges, rune(cmd.motion[0])))
+
+	if isChange {
+		// Every edit made by the command, and by the insert session it starts, is undone together
+		e.history.beginGroup()
+	}
+	e.registerName = cmd.register
+	defer func() { e.registerName = 0 }()
+
+	// Motions, operators and changes apply at every cursor; other actions only once
+	switch {
+	case cmd.operator != 0:
+		e.forEachCursor(func() { e.applyOperator(cmd) })
+	case cmd.motion == "gg" || strings.Contains(normalMotions, cmd.motion):
+		e.forEachCursor(func() { e.moveByMotion(cmd) })
+	case isChange:
+		e.forEachCursor(func() { e.executeNormalAction(cmd) })
+	default:
+		e.executeNormalAction(cmd)
+	}
+
+	if isChange {
+		if e.inCommandMode {
+			e.history.endGroup()
+		}
+		if !e.repeating {
+			e.lastChange = &cmd
+			e.insertKeys = nil
+			e.recordingInsert = !e.inCommandMode
+		}
+	}
+	if e.inCommandMode {
+		e.forEachCursor(e.clampCursor)
+	}
+	e.dirty = true // Mark as dirty to trigger a redraw
+}
+
+// executeNormalAction runs a normal mode command that is neither a motion nor an operator.
+func (e *Editor) executeNormalAction(cmd normalCommand) {
+	n := cmd.repeat()
+	switch cmd.motion {
+	case "x":
+		// Delete characters under and after the cursor
+		e.applyOperator(normalCommand{count: cmd.count, operator: 'd', motion: "l"})
+	case "X":
+		// Delete characters before the cursor
+		e.applyOperator(normalCommand{count: cmd.count, operator: 'd', motion: "h"})
+	case "p", "P":
+		e.paste(cmd.motion == "P", n)
+	case "o":
+		// Open a new line below the cursor, indented like Enter at the end of the line
+		e.cursorX = e.text.LineLen(e.cursorY)
+		e.handleEnter()
+		e.enterInsertMode()
+	case "O":
+		// Open a new line above the cursor, with its indentation when autoindent is on
+		var indent []rune
+		if e.autoIndent {
+			indent = slices.Clone(leadingIndent(e.text.Line(e.cursorY)))
+		}
+		e.insertText(0, e.cursorY, append(indent, '\n'))
+		e.cursorX = len(indent)
+		e.enterInsertMode()
+	case "i":
+		e.enterInsertMode()
+	case "a":
+		e.cursorX = min(e.cursorX+1, e.text.LineLen(e.cursorY))
+		e.enterInsertMode()
+	case "A":
+		e.cursorX = e.text.LineLen(e.cursorY)
+		e.enterInsertMode()
+	case "I":
+		e.cursorX = e.firstNonBlank(e.cursorY)
+		e.enterInsertMode()
+	case "v":
+		e.enterVisualMode(visualChar)
+	case "V":
+		e.enterVisualMode(visualLine)
+	case "u":
+		for range n {
+			e.undo()
+		}
+	case "n", "N":
+		for range n {
+			e.searchNext(cmd.motion == "n")
+		}
+	case ".":
+		e.repeatLastChange(cmd.count)
+	case ":":
+		e.cmd = []rune{':'}
+		e.dirty = true // Mark as dirty to trigger a redraw
+		e.handleCommandInput()
+	case "/", "?":
+		e.handleSearchInput(cmd.motion == "/")
+	case "ZZ":
+		// Save if modified and quit, like :x
+		if err := e.executeWriteQuitCommand("", true); err != nil {
+			e.showStatus("Error: " + err.Error())
+		}
+	}
+}
+
+// enterInsertMode switches the editor from normal mode to insert mode.
+func (e *Editor) enterInsertMode() {
+	e.inCommandMode = false
+	e.dirty = true // Mark as dirty to trigger a redraw
+}
+
+// repeatLastChange repeats the last change made in normal mode, replaying any text typed after it.
+// Parameters:
+// - count: A new count for the change, or 0 to reuse the original one.
+func (e *Editor) repeatLastChange(count int) {
+	if e.lastChange == nil {
+		return
+	}
+	cmd := *e.lastChange
+	if count > 0 {
+		cmd.count = count
+	}
+
+	e.repeating = true
+	defer func() { e.repeating = false }()
+
+	e.executeNormalCommand(cmd)
+	if !e.inCommandMode {
+		// The change entered insert mode: replay what was typed and leave again
+		for _, ev := range e.insertKeys {
+			e.handleInsertMode(ev)
+		}
+		e.handleExitInsertMode()
+	}
+}
+
+// moveByMotion moves the cursor according to a motion command.
+func (e *Editor) moveByMotion(cmd normalCommand) {
+	switch cmd.motion {
+	case "j":
+		for range cmd.repeat() {
+			e.handleMoveDown()
+		}
+	case "k":
+		for range cmd.repeat() {
+			e.handleMoveUp()
+		}
+	default:
+		e.cursorX, e.cursorY, _, _ = e.motionTarget(cmd)
+	}
+}
+
+// motionTarget computes where a motion moves the cursor.
+// Parameters:
+// - cmd: The command holding the motion and its count.
+// Returns: The target position, whether the motion is line-wise, and whether the target
+// character is included when an operator is applied.
+func (e *Editor) motionTarget(cmd normalCommand) (int, int, bool, bool) {
+	n := cmd.repeat()
+	x, y := e.cursorX, e.cursorY
+	lastLine := e.text.LineCount() - 1
+
+	switch cmd.motion {
+	case "h":
+		for range n {
+			x = prevCharX(e.text.Line(y), x)
+		}
+		return x, y, false, false
+	case "l":
+		for range n {
+			x = nextCharX(e.text.Line(y), x)
+		}
+		return x, y, false, false
+	case "j":
+		return x, min(y+n, lastLine), true, false
+	case "k":
+		return x, max(y-n, 0), true, false
+	case "w":
+		for i := range n {
+			nx, ny := e.nextWordStart(x, y)
+			if cmd.operator != 0 && i == n-1 && ny > y {
+				// An operator never crosses the line break after the last word
+				return e.text.LineLen(y), y, false, false
+			}
+			x, y = nx, ny
+		}
+		return x, y, false, false
+	case "b":
+		for range n {
+			x, y = e.prevWordStart(x, y)
+		}
+		return x, y, false, false
+	case "e":
+		for range n {
+			x, y = e.wordEnd(x, y)
+		}
+		return x, y, false, true
+	case "0":
+		return 0, y, false, false
+	case "$":
+		y = min(y+n-1, lastLine)
+		return max(e.text.LineLen(y)-1, 0), y, false, true
+	case "gg":
+		y = min(max(cmd.count, 1)-1, lastLine)
+		return e.firstNonBlank(y), y, true, false
+	case "G":
+		if cmd.count > 0 {
+			y = min(cmd.count-1, lastLine)
+		} else {
+			y = lastLine
+		}
+		return e.firstNonBlank(y), y, true, false
+	}
+	return x, y, false, false
+}
+
+// applyOperator applies d, c or y to the text covered by a motion.
+func (e *Editor) applyOperator(cmd normalCommand) {
+	var x0, y0, x1, y1 int
+	var linewise bool
+	if cmd.motion == string(cmd.operator) {
+		// Doubled operator: count whole lines starting at the cursor
+		linewise = true
+		y0, y1 = e.cursorY, min(e.cursorY+cmd.repeat()-1, e.text.LineCount()-1)
+	} else if cmd.operator == 'c' && cmd.motion == "w" && !e.isBlankAt(e.cursorX, e.cursorY) {
+		// "cw" on a word changes to the end of the word, like "ce", but the word under the cursor
+		// counts even on its last character
+		x0, y0, x1, y1 = e.cursorX, e.cursorY, e.cursorX, e.cursorY
+		line := e.text.Line(y1)
+		for x1+1 < len(line) && runeClass(line[x1+1]) == runeClass(line[x1]) {
+			x1++
+		}
+		for range cmd.repeat() - 1 {
+			x1, y1 = e.wordEnd(x1, y1)
+		}
+		x1 = min(x1+1, e.text.LineLen(y1))
+	} else {
+		tx, ty, lw, inclusive := e.motionTarget(cmd)
+		x0, y0, x1, y1 = e.cursorX, e.cursorY, tx, ty
+		if y1 < y0 || (y1 == y0 && x1 < x0) {
+			x0, y0, x1, y1 = x1, y1, x0, y0
+		}
+		if inclusive {
+			x1 = min(x1+1, e.text.LineLen(y1))
+		}
+		linewise = lw
+	}
+
+	if linewise {
+		e.applyLinewiseOperator(cmd.operator, y0, y1)
+		return
+	}
+	e.applyCharwiseOperator(cmd.operator, x0, y0, x1, y1)
+}
+
+// applyCharwiseOperator applies d, c or y to the text between two positions.
+// Parameters:
+// - operator: The operator to apply.
+// - x0, y0: The start of the text (inclusive).
+// - x1, y1: The end of the text (exclusive).
+func (e *Editor) applyCharwiseOperator(operator rune, x0, y0, x1, y1 int) {
+	start, end := e.text.Offset(x0, y0), e.text.Offset(x1, y1)
+	e.cursorX, e.cursorY = x0, y0
+	if start == end && operator != 'c' {
+		return // Nothing to operate on, e.g. "x" on an empty line
+	}
+	e.storeRegister(register{text: e.text.Slice(start, end)}, operator == 'y')
+	switch operator {
+	case 'd':
+		e.deleteText(x0, y0, x1, y1)
+	case 'c':
+		e.deleteText(x0, y0, x1, y1)
+		e.enterInsertMode()
+	}
+}
+
+// applyLinewiseOperator applies d, c or y to whole lines.
+// Parameters:
+// - operator: The operator to apply.
+// - y0, y1: The first and last line (inclusive).
+func (e *Editor) applyLinewiseOperator(operator rune, y0, y1 int) {
+	lastLine := e.text.LineCount() - 1
+	endOffset := e.text.Offset(e.text.LineLen(y1), y1)
+	text := append(e.text.Slice(e.text.Offset(0, y0), endOffset), '\n')
+	e.storeRegister(register{text: text, linewise: true}, operator == 'y')
+
+	switch operator {
+	case 'y':
+		e.cursorY = y0
+	case 'd':
+		switch {
+		case y1 < lastLine:
+			e.deleteText(0, y0, 0, y1+1)
+		case y0 > 0:
+			// Deleting the last lines removes the line break before them
+			e.deleteText(e.text.LineLen(y0-1), y0-1, e.text.LineLen(y1), y1)
+			y0--
+		default:
+			e.deleteText(0, 0, e.text.LineLen(y1), y1)
+		}
+		e.cursorX, e.cursorY = e.firstNonBlank(y0), y0
+	case 'c':
+		// Keep one empty line to type the replacement on
+		e.cursorX, e.cursorY = 0, y0
+		e.deleteText(0, y0, e.text.LineLen(y1), y1)
+		e.enterInsertMode()
+	}
+}
+
+// paste inserts the contents of the register named for the command after or before the cursor.
+// Line-wise text is pasted on new lines below or above the cursor line.
+// Parameters:
+// - before: True to paste before the cursor (P), false to paste after it (p).
+// - count: Number of copies to paste.
+func (e *Editor) paste(before bool, count int) {
+	reg, err := e.readRegister(e.registerName)
+	if err != nil {
+		e.showStatus("Error: " + err.Error())
+	}
+	if len(reg.text) == 0 {
+		return
+	}
+	var text []rune
+	for range count {
+		text = append(text, reg.text...)
+	}
+
+	y := e.cursorY
+	if reg.block {
+		x := e.cursorX
+		if !before && e.text.LineLen(y) > 0 {
+			x++
+		}
+		e.pasteBlock(reg, x, y, count)
+		return
+	}
+	if reg.linewise {
+		switch {
+		case before:
+			e.insertText(0, y, text)
+		case y+1 < e.text.LineCount():
+			y++
+			e.insertText(0, y, text)
+		default:
+			// Below the last line: move the trailing line break to the front
+			e.insertText(e.text.LineLen(y), y, append([]rune{'\n'}, text[:len(text)-1]...))
+			y++
+		}
+		e.cursorX, e.cursorY = e.firstNonBlank(y), y
+		return
+	}
+
+	x := e.cursorX
+	if !before && e.text.LineLen(y) > 0 {
+		x++
+	}
+	endX, endY := e.insertText(x, y, text)
+	if endY == y {
+		e.cursorX, e.cursorY = max(endX-1, 0), y
+	} else {
+		e.cursorX, e.cursorY = x, y
+	}
+}
+
+// pasteBlock inserts the block in a register at a column of successive lines, starting at line y.
+// Lines are added at the end of the buffer, and short lines padded with spaces, to fit the block.
+// Parameters:
+// - reg: The register holding the block.
+// - x, y: The position of the top left corner of the block.
+// - count: Number of copies to paste side by side.
+func (e *Editor) pasteBlock(reg register, x, y, count int) {
+	rows := strings.Split(string(reg.text), "\n")
+	width := 0
+	for _, row := range rows {
+		width = max(width, len([]rune(row)))
+	}
+	for i, row := range rows {
+		ly := y + i
+		if ly == e.text.LineCount() {
+			e.insertText(e.text.LineLen(ly-1), ly-1, []rune{'\n'})
+		}
+		n := e.text.LineLen(ly)
+		if n < x {
+			e.insertText(n, ly, []rune(strings.Repeat(" ", x-n)))
+		}
+		if x < n || count > 1 {
+			// Keep the copies and the text after the block aligned
+			row += strings.Repeat(" ", width-len([]rune(row)))
+		}
+		e.insertText(x, ly, []rune(strings.Repeat(row, count)))
+	}
+	e.cursorX, e.cursorY = x, y
+}
+
+// clampCursor keeps the cursor on the start of an existing character, as normal mode has no position
+// past the end of a line.
+func (e *Editor) clampCursor() {
+	e.cursorY = min(max(e.cursorY, 0), e.text.LineCount()-1)
+	line := e.text.Line(e.cursorY)
+	e.cursorX = charStartX(line, min(max(e.cursorX, 0), lastCharX(line)))
+}
+
+// firstNonBlank returns the column of the first non-whitespace character of line y.
+func (e *Editor) firstNonBlank(y int) int {
+	line := e.text.Line(y)
+	for x, r := range line {
+		if !unicode.IsSpace(r) {
+			return x
+		}
+	}
+	return lastCharX(line)
+}
+
+// isBlankAt reports whether the character at a position is whitespace or past the end of the line.
+func (e *Editor) isBlankAt(x, y int) bool {
+	line := e.text.Line(y)
+	return x >= len(line) || unicode.IsSpace(line[x])
+}
+
+// Character classes used by word motions
+const (
+	classBlank = iota // Whitespace and line breaks
+	classPunct        // Punctuation and other symbols
+	classWord         // Letters, digits and underscores
+)
+
+// runeClass returns the word motion class of a rune.
+func runeClass(r rune) int {
+	switch {
+	case r == '\n' || unicode.IsSpace(r):
+		return classBlank
+	case r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r):
+		return classWord
+	}
+	return classPunct
+}
+
+// textIter walks the buffer one character at a time, treating line ends as '\n'.
+type textIter struct {
+	text TextBuffer
+	x, y int
+	line []rune
+}
+
+// newTextIter creates an iterator positioned at (x, y).
+func newTextIter(text TextBuffer, x, y int) *textIter {
+	return &textIter{text: text, x: x, y: y, line: text.Line(y)}
+}
+
+// char returns the character at the iterator position, or '\n' at the end of a line.
+func (it *textIter) char() rune {
+	if it.x < len(it.line) {
+		return it.line[it.x]
+	}
+	return '\n'
+}
+
+// emptyLine reports whether the iterator is on an empty line, which word motions treat as a word.
+func (it *textIter) emptyLine() bool {
+	return len(it.line) == 0
+}
+
+// next advances one character, returning false at the end of the buffer.
+func (it *textIter) next() bool {
+	if it.x < len(it.line) {
+		it.x++
+		return true
+	}
+	if it.y+1 >= it.text.LineCount() {
+		return false
+	}
+	it.y++
+	it.x = 0
+	it.line = it.text.Line(it.y)
+	return true
+}
+
+// prev moves back one character, returning false at the start of the buffer.
+func (it *textIter) prev() bool {
+	if it.x > 0 {
+		it.x--
+		return true
+	}
+	if it.y == 0 {
+		return false
+	}
+	it.y--
+	it.line = it.text.Line(it.y)
+	it.x = len(it.line)
+	return true
+}
+
+// nextWordStart returns the start of the word after (x, y), as the 'w' motion.
+func (e *Editor) nextWordStart(x, y int) (int, int) {
+	it := newTextIter(e.text, x, y)
+	class := runeClass(it.char())
+	// Skip the rest of the current word
+	for class != classBlank && runeClass(it.char()) == class {
+		if !it.next() {
+			return it.x, it.y
+		}
+	}
+	// Skip whitespace and line breaks, stopping on empty lines
+	for runeClass(it.char()) == classBlank {
+		if !it.next() {
+			return it.x, it.y
+		}
+		if it.emptyLine() {
+			break
+		}
+	}
+	return it.x, it.y
+}
+
+// prevWordStart returns the start of the word before (x, y), as the 'b' motion.
+func (e *Editor) prevWordStart(x, y int) (int, int) {
+	it := newTextIter(e.text, x, y)
+	if !it.prev() {
+		return it.x, it.y
+	}
+	// Skip whitespace and line breaks, stopping on empty lines
+	for runeClass(it.char()) == classBlank && !it.emptyLine() {
+		if !it.prev() {
+			return it.x, it.y
+		}
+	}
+	// Move to the first character of the word
+	class := runeClass(it.char())
+	for class != classBlank && it.x > 0 && runeClass(it.line[it.x-1]) == class {
+		it.x--
+	}
+	return it.x, it.y
+}
+
+// wordEnd returns the end of the word at or after (x, y), as the 'e' motion.
+func (e *Editor) wordEnd(x, y int) (int, int) {
+	it := newTextIter(e.text, x, y)
+	if !it.next() {
+		return x, y
+	}
+	// Skip whitespace and line breaks
+	for runeClass(it.char()) == classBlank {
+		if !it.next() {
+			return x, y
+		}
+	}
+	// Move to the last character of the word
+	class := runeClass(it.char())
+	for it.x+1 < len(it.line) && runeClass(it.line[it.x+1]) == class {
+		it.x++
+	}
+	return it.x, it.y
+}
+
+// recordInsertKey remembers a key typed in insert mode after a repeatable change.
+func (e *Editor) recordInsertKey(ev *tcell.EventKey) {
+	if e.recordingInsert && !e.repeating && ev.Key() != tcell.KeyEsc {
+		e.insertKeys = append(e.insertKeys, ev)
+	}
+}
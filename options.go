@@ -0,0 +1,317 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Names of the options that can be changed with :set and in the config file
+const (
+	optionNumber      = "number"      // Show line numbers
+	optionCursorLine  = "cursorline"  // Highlight the line with the cursor
+	optionTabStop     = "tabstop"     // Number of columns between tab stops
+	optionAutoIndent  = "autoindent"  // Start new lines with the indentation of the previous one
+	optionSmartIndent = "smartindent" // Indent after block openers and dedent block closers
+	optionExpandTab   = "expandtab"   // Insert spaces instead of tabs
+	optionWrap        = "wrap"        // Wrap long lines across screen rows
+	optionLineBreak   = "linebreak"   // Wrap long lines after blanks rather than within words
+	optionShowBreak   = "showbreak"   // Indicator shown at the start of the rows a wrapped line continues on
+	optionFileFormat  = "fileformat"  // Line endings to write on save
+	optionFileType    = "filetype"    // Language of the buffer, selecting its highlighter
+)
+
+// bufferOptions are the options each buffer has its own values of. A buffer starts with the values
+// :set last gave them, which its file type can override.
+type bufferOptions struct {
+	spacesPerTab int  // Number of columns between tab stops, which a tab character advances to
+	autoIndent   bool // True if new lines should start with the indentation of the line they follow
+	smartIndent  bool // True if indentation should follow the blocks of the file type's language
+	expandTab    bool // True if Tab and indentation should insert spaces instead of tabs
+}
+
+// defaultBufferOptions are the values buffers start with when neither the config file nor :set changed them.
+var defaultBufferOptions = bufferOptions{
+	spacesPerTab: defaultSpacesPerTab,
+	autoIndent:   defaultAutoIndent,
+	smartIndent:  defaultSmartIndent,
+}
+
+// boolOption returns the setting behind a boolean buffer option, or nil if the option is not one.
+func (o *bufferOptions) boolOption(name string) *bool {
+	switch name {
+	case optionAutoIndent:
+		return &o.autoIndent
+	case optionSmartIndent:
+		return &o.smartIndent
+	case optionExpandTab:
+		return &o.expandTab
+	}
+	return nil
+}
+
+// windowOptions are the options each window has its own values of, which change how it shows its
+// buffer. A new window starts with the values of the window it was split from. A buffer is shown
+// with the values it was last shown with, or at first with the values :set last gave them, which
+// its file type can override.
+type windowOptions struct {
+	showLineNumbers      bool   // True if line numbers should be displayed
+	highlightCurrentLine bool   // True if the current line should be highlighted
+	wrapLines            bool   // True if long lines should wrap across screen rows instead of scrolling
+	lineBreak            bool   // True if wrapped lines should break after blanks rather than within words
+	showBreak            string // Wrap indicator shown at the start of the rows a wrapped line continues on
+}
+
+// defaultWindowOptions are the values windows start with when neither the config file nor :set changed them.
+var defaultWindowOptions = windowOptions{
+	showLineNumbers:      defaultShowLineNumbers,
+	highlightCurrentLine: defaultHighlightCurrentLine,
+}
+
+// boolOption returns the setting behind a boolean window option, or nil if the option is not one.
+func (o *windowOptions) boolOption(name string) *bool {
+	switch name {
+	case optionNumber:
+		return &o.showLineNumbers
+	case optionCursorLine:
+		return &o.highlightCurrentLine
+	case optionWrap:
+		return &o.wrapLines
+	case optionLineBreak:
+		return &o.lineBreak
+	}
+	return nil
+}
+
+// optionAbbreviations maps the short names of options to their full names.
+var optionAbbreviations = map[string]string{
+	"nu":  optionNumber,
+	"cul": optionCursorLine,
+	"ts":  optionTabStop,
+	"ai":  optionAutoIndent,
+	"si":  optionSmartIndent,
+	"et":  optionExpandTab,
+	"lbr": optionLineBreak,
+	"sbr": optionShowBreak,
+	"ff":  optionFileFormat,
+	"ft":  optionFileType,
+}
+
+// optionName returns the full name of an option from its name or abbreviation,
+// or "" if there is no such option.
+func optionName(name string) string {
+	if full, ok := optionAbbreviations[name]; ok {
+		return full
+	}
+	switch name {
+	case optionNumber, optionCursorLine, optionTabStop, optionAutoIndent, optionSmartIndent, optionExpandTab,
+		optionWrap, optionLineBreak, optionShowBreak, optionFileFormat, optionFileType:
+		return name
+	}
+	return ""
+}
+
+// boolOption returns the setting behind a boolean option for the current buffer or window,
+// or nil if the option is not boolean.
+func (e *Editor) boolOption(name string) *bool {
+	if b := e.bufferOptions.boolOption(name); b != nil {
+		return b
+	}
+	return e.windowOptions.boolOption(name)
+}
+
+// optionValue returns the value of an option for the current buffer or window as text, as shown by :set name?.
+// Parameters:
+// - name: The full name of the option.
+func (e *Editor) optionValue(name string) string {
+	if b := e.boolOption(name); b != nil {
+		return strconv.FormatBool(*b)
+	}
+	switch name {
+	case optionTabStop:
+		return strconv.Itoa(e.spacesPerTab)
+	case optionShowBreak:
+		return e.showBreak
+	case optionFileFormat:
+		return e.format.fileFormat
+	case optionFileType:
+		return e.highlighter.filetype
+	}
+	return ""
+}
+
+// setOption sets an option from its value as text, like :set: for the current buffer or window, and
+// for the buffers opened after it. The value stays when the file type changes.
+// Parameters:
+// - name: The full name of the option.
+// - value: The new value.
+// Returns:
+// - error: An error if the value is not valid for the option.
+func (e *Editor) setOption(name, value string) error {
+	if err := e.setLocalOption(name, value); err != nil {
+		return err
+	}
+	delete(e.overriddenOptions, name)
+
+	// Buffers opened from now on start with the new value
+	if b := e.bufferDefaults.boolOption(name); b != nil {
+		*b = *e.boolOption(name)
+	}
+	if b := e.windowDefaults.boolOption(name); b != nil {
+		*b = *e.boolOption(name)
+	}
+	switch name {
+	case optionTabStop:
+		e.bufferDefaults.spacesPerTab = e.spacesPerTab
+	case optionShowBreak:
+		e.windowDefaults.showBreak = e.showBreak
+	}
+	return nil
+}
+
+// setLocalOption sets an option from its value as text for the current buffer or window only.
+// Boolean options take anything strconv.ParseBool accepts.
+// Parameters:
+// - name: The full name of the option.
+// - value: The new value.
+// Returns:
+// - error: An error if the value is not valid for the option.
+func (e *Editor) setLocalOption(name, value string) error {
+	invalid := errors.New(errorInvalidArgument + ": " + name + "=" + value)
+	if b := e.boolOption(name); b != nil {
+		v, err := strconv.ParseBool(value)
+		if err != nil {
+			return invalid
+		}
+		*b = v
+		e.dirty = true // Mark as dirty to trigger a redraw
+		return nil
+	}
+	switch name {
+	case optionTabStop:
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return invalid
+		}
+		e.spacesPerTab = n
+	case optionShowBreak:
+		e.showBreak = value
+	case optionFileFormat:
+		if value != fileFormatUnix && value != fileFormatDos {
+			return invalid
+		}
+		if value != e.format.fileFormat {
+			// Converting changes every line ending on the next save
+			e.format.fileFormat = value
+			e.modified = true
+		}
+	case optionFileType:
+		if !e.highlighter.SetFiletype(value) && value != "" {
+			return invalid
+		}
+		e.applyFiletypeOptions()
+	default:
+		return errors.New(errorUnknownOption + ": " + name)
+	}
+	e.dirty = true // Mark as dirty to trigger a redraw
+	return nil
+}
+
+// applyFiletypeOptions applies the options the config file sets for the file type of the current
+// buffer, to it and to the current window, when the file type is set. Options set for the previous
+// file type get back the values they had before, except those changed with :set since.
+func (e *Editor) applyFiletypeOptions() {
+	for name, value := range e.overriddenOptions {
+		e.setLocalOption(name, value) // The values were valid when they were replaced
+	}
+	clear(e.overriddenOptions)
+
+	overrides := e.filetypeOptions[e.highlighter.filetype]
+	for _, name := range slices.Sorted(maps.Keys(overrides)) {
+		previous := e.optionValue(name)
+		if err := e.setLocalOption(name, overrides[name]); err != nil {
+			e.showStatus("Error: " + err.Error())
+			continue
+		}
+		e.overriddenOptions[name] = previous
+	}
+}
+
+// executeSetCommand processes the :set command to show and change options, like vim's :set.
+// Each argument is one of:
+//   - name=value or name:value: sets the option
+//   - name?: shows the value of the option
+//   - name: sets a boolean option, or shows the value of any other option
+//   - noname, name! and invname: clear and toggle a boolean option
+//
+// Parameters:
+// - args: The arguments, e.g. "fileformat=dos", "nonumber" or "ts?".
+// Returns:
+// - error: An error if an option or value is unknown.
+func (e *Editor) executeSetCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New(errorUnknownOption + ": (none)")
+	}
+	for _, arg := range args {
+		name, value, assign := strings.Cut(arg, "=")
+		if !assign {
+			name, value, assign = strings.Cut(arg, ":")
+		}
+		if assign {
+			full := optionName(name)
+			if full == "" {
+				return errors.New(errorUnknownOption + ": " + name)
+			}
+			if err := e.setOption(full, value); err != nil {
+				return err
+			}
+			continue
+		}
+
+		query := strings.HasSuffix(name, "?")
+		toggle := strings.HasSuffix(name, "!")
+		name = strings.TrimRight(name, "?!")
+		full := optionName(name)
+		state := true
+		if full == "" {
+			switch {
+			case strings.HasPrefix(name, "no"):
+				full, state = optionName(name[2:]), false
+			case strings.HasPrefix(name, "inv"):
+				full, toggle = optionName(name[3:]), true
+			}
+			if full == "" || e.boolOption(full) == nil {
+				return errors.New(errorUnknownOption + ": " + name)
+			}
+		}
+
+		b := e.boolOption(full)
+		switch {
+		case query || (b == nil && !toggle):
+			e.showStatus(e.formatOption(full))
+		case b == nil:
+			return errors.New(errorInvalidArgument + ": " + arg)
+		default:
+			if toggle {
+				state = !*b
+			}
+			e.setOption(full, strconv.FormatBool(state))
+		}
+	}
+	return nil
+}
+
+// formatOption returns an option and its value as shown by :set name?: "name" or "noname"
+// for boolean options and "name=value" for the others.
+func (e *Editor) formatOption(name string) string {
+	if b := e.boolOption(name); b != nil {
+		if *b {
+			return name
+		}
+		return "no" + name
+	}
+	return fmt.Sprintf("%s=%s", name, e.optionValue(name))
+}
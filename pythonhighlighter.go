@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Lexer states carried between lines of Python source
+const (
+	pyStateCode         LexState = iota // Plain code
+	pyStateTripleDouble                 // Inside a """ string
+	pyStateTripleSingle                 // Inside a ''' string
+)
+
+var pythonKeywords = wordSet(`and as assert async await break class continue def del elif else except
+	finally for from global if import in is lambda nonlocal not or pass raise return try while with yield
+	match case type`)
+
+var pythonConstants = wordSet("True False None self cls")
+
+// PythonHighlighter implements syntax highlighting for Python files.
+type PythonHighlighter struct {
+	styles syntaxStyles
+}
+
+// NewPythonHighlighter initializes a new PythonHighlighter with default styles.
+func NewPythonHighlighter(styles syntaxStyles) *PythonHighlighter {
+	return &PythonHighlighter{styles: styles}
+}
+
+// HighlightLine returns the styled spans of a given Python source line.
+// Triple-quoted strings may span lines.
+func (ph *PythonHighlighter) HighlightLine(src []rune, state LexState) ([]StyleSpan, LexState) {
+	l := newLineLexer(src)
+
+	if state != pyStateCode {
+		closing := `"""`
+		if state == pyStateTripleSingle {
+			closing = `'''`
+		}
+		if !l.quoted(closing, true) {
+			l.emit(0, ph.styles.str)
+			return l.spans, state
+		}
+		l.emit(0, ph.styles.str)
+	}
+
+	for !l.eof() {
+		start := l.pos
+		r := l.peek(0)
+		switch {
+		case r == '#':
+			l.emitRest(ph.styles.comment)
+		case r == '"' || r == '\'' || (strings.ContainsRune("rbfuRBFU", r) && (l.peek(1) == '"' || l.peek(1) == '\'')):
+			if r != '"' && r != '\'' {
+				l.pos++ // String prefix such as r"..." or f'...'
+			}
+			quote := string(l.peek(0))
+			if triple := strings.Repeat(quote, 3); l.hasPrefix(triple) {
+				l.pos += 3
+				if !l.quoted(triple, true) {
+					l.emit(start, ph.styles.str)
+					if quote == `"` {
+						return l.spans, pyStateTripleDouble
+					}
+					return l.spans, pyStateTripleSingle
+				}
+			} else {
+				l.pos++
+				l.quoted(quote, true)
+			}
+			l.emit(start, ph.styles.str)
+		case r == '@' && strings.TrimSpace(string(src[:l.pos])) == "":
+			// Decorator
+			l.pos++
+			l.skipWhile(func(r rune) bool { return isIdentRune(r) || r == '.' })
+			l.emit(start, ph.styles.key)
+		case l.number():
+			l.emit(start, ph.styles.number)
+		case isIdentRune(r):
+			word := l.word()
+			switch {
+			case pythonKeywords[word]:
+				l.emit(start, ph.styles.keyword)
+			case pythonConstants[word]:
+				l.emit(start, ph.styles.constant)
+			}
+		case strings.ContainsRune("+-*/%=<>!&|^~:", r):
+			l.pos++
+			l.emit(start, ph.styles.operator)
+		case unicode.IsSpace(r):
+			l.skipWhile(unicode.IsSpace)
+		default:
+			l.pos++
+		}
+	}
+	return l.spans, pyStateCode
+}
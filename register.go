@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// Register names with a special meaning
+const (
+	registerUnnamed   = '"' // The text most recently yanked or deleted
+	registerYank      = '0' // The text most recently yanked without naming a register
+	registerClipboard = '+' // The system clipboard; '*' is the same register
+	registerBlackHole = '_' // Discards what is written to it
+)
+
+// register holds yanked or deleted text.
+type register struct {
+	text     []rune // Register contents; line-wise text ends with '\n'
+	linewise bool   // True if the text is a sequence of whole lines
+	block    bool   // True if the text is a block, one line of text per row separated by '\n'
+}
+
+// registerOf returns a register holding text from outside the editor, such as the clipboard.
+// Text ending with a line break is line-wise.
+func registerOf(text string) register {
+	return register{text: []rune(text), linewise: strings.HasSuffix(text, "\n")}
+}
+
+// appended returns the register with the text of another appended, as when yanking to an uppercase
+// register name. If either is line-wise, so is the result, with each text on lines of its own.
+func (r register) appended(other register) register {
+	switch {
+	case len(r.text) == 0:
+		return other
+	case r.linewise && !other.linewise:
+		return register{text: slices.Concat(r.text, other.text, []rune{'\n'}), linewise: true}
+	case !r.linewise && other.linewise:
+		return register{text: slices.Concat(r.text, []rune{'\n'}, other.text), linewise: true}
+	}
+	return register{text: slices.Concat(r.text, other.text), linewise: r.linewise, block: r.block && other.block}
+}
+
+// isRegisterName reports whether r names a register: '"', '0', a letter, '+', '*' or '_'.
+func isRegisterName(r rune) bool {
+	return r == registerUnnamed || r == registerYank || r == registerClipboard || r == '*' ||
+		r == registerBlackHole || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+}
+
+// storeRegister puts yanked or deleted text into the register named for the command. The unnamed
+// register always holds the last text stored, and "0 the last text yanked without a register name.
+// An uppercase name appends to the register of the lowercase letter; the clipboard register also
+// copies the text to the system clipboard.
+// Parameters:
+// - reg: The yanked or deleted text.
+// - yank: True if the text was yanked, false if it was deleted.
+func (e *Editor) storeRegister(reg register, yank bool) {
+	name := e.registerName
+	switch {
+	case name == registerBlackHole:
+		return
+	case name == 0 || name == registerUnnamed:
+		if yank {
+			e.registers[registerYank] = reg
+		}
+	case name >= 'A' && name <= 'Z':
+		name = unicode.ToLower(name)
+		reg = e.registers[name].appended(reg)
+		e.registers[name] = reg
+	case name == registerClipboard || name == '*':
+		e.registers[registerClipboard] = reg
+		if err := e.copyToClipboard(reg.text); err != nil {
+			e.showStatus("Error: " + err.Error())
+		}
+	default:
+		e.registers[name] = reg
+	}
+	e.registers[registerUnnamed] = reg
+}
+
+// readRegister returns the contents of a register. The clipboard register holds what the
+// system clipboard tool pastes, or without one, the text the editor last copied to the clipboard.
+// Parameters:
+// - name: The register name, or 0 for the unnamed register.
+// Returns: The register, and an error if the clipboard tool failed.
+func (e *Editor) readRegister(name rune) (register, error) {
+	switch name {
+	case 0:
+		name = registerUnnamed
+	case registerClipboard, '*':
+		text, ok, err := pasteFromClipboard()
+		if ok && err == nil {
+			return registerOf(text), nil
+		}
+		return e.registers[registerClipboard], err
+	}
+	return e.registers[unicode.ToLower(name)], nil
+}
+
+// listRegisters returns the registers shown by :registers, e.g. `"" one  "a two^J`,
+// with line breaks shown as ^J. Empty registers are not listed.
+// Parameters:
+// - names: The registers to list, or "" for all of them.
+func (e *Editor) listRegisters(names string) string {
+	var entries []string
+	for _, name := range `"0abcdefghijklmnopqrstuvwxyz+` {
+		reg := e.registers[name]
+		if len(reg.text) == 0 || (names != "" && !strings.ContainsRune(names, name)) {
+			continue
+		}
+		entries = append(entries, fmt.Sprintf("\"%c %s", name, strings.ReplaceAll(string(reg.text), "\n", "^J")))
+	}
+	return strings.Join(entries, "  ")
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"slices"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+const (
+	// Search status messages
+	errorPatternNotFound  = "Pattern not found"
+	errorNoPreviousRegex  = "No previous search pattern"
+	statusSearchHitBottom = "Search hit BOTTOM, continuing at TOP"
+	statusSearchHitTop    = "Search hit TOP, continuing at BOTTOM"
+)
+
+// handleSearchInput handles the '/' and '?' search prompt at the bottom.
+// The cursor jumps to the first match while the pattern is typed; Esc restores the original position.
+// Parameters:
+// - forward: True to search towards the end of the buffer, false to search backwards.
+func (e *Editor) handleSearchInput(forward bool) {
+	prompt := '/'
+	if !forward {
+		prompt = '?'
+	}
+	e.cmd = []rune{prompt}
+	startX, startY, startOffsetX, startOffsetY := e.cursorX, e.cursorY, e.offsetX, e.offsetY
+	lastPattern := e.searchPattern
+	e.dirty = true // Mark as dirty to trigger a redraw
+
+	// preview moves the cursor to the first match of the pattern typed so far
+	preview := func() {
+		e.cursorX, e.cursorY, e.offsetX, e.offsetY = startX, startY, startOffsetX, startOffsetY
+		e.searchPattern = slices.Clone(e.cmd[1:])
+		e.hideSearchMatches = false
+		if len(e.searchPattern) == 0 {
+			e.searchPattern = lastPattern
+		} else if x, y, _, ok := e.findMatch(e.searchPattern, startX, startY, forward); ok {
+			e.cursorX, e.cursorY = x, y
+		}
+		e.dirty = true // Mark as dirty to trigger a redraw
+	}
+
+	for inSearch := true; inSearch; {
+		e.adjustOffsets()
+		e.draw()
+		ev := e.pollEvent()
+		switch ev := ev.(type) {
+		case *tcell.EventKey:
+			switch ev.Key() {
+			case tcell.KeyEsc:
+				// Abandon the search and restore the original view
+				e.cursorX, e.cursorY, e.offsetX, e.offsetY = startX, startY, startOffsetX, startOffsetY
+				e.searchPattern = lastPattern
+				inSearch = false
+			case tcell.KeyEnter:
+				// Confirm the search, reusing the last pattern if none was typed
+				e.cursorX, e.cursorY, e.offsetX, e.offsetY = startX, startY, startOffsetX, startOffsetY
+				pattern := slices.Clone(e.cmd[1:])
+				if len(pattern) == 0 {
+					pattern = lastPattern
+				}
+				e.searchPattern = pattern
+				e.searchForward = forward
+				e.searchNext(true)
+				inSearch = false
+			case tcell.KeyBackspace, tcell.KeyBackspace2:
+				// Remove last character from the pattern
+				if len(e.cmd) > 1 {
+					e.cmd = e.cmd[:len(e.cmd)-1]
+					preview()
+				}
+			case tcell.KeyRune:
+				// Add character to the pattern
+				e.cmd = append(e.cmd, ev.Rune())
+				preview()
+			}
+		case *tcell.EventResize:
+			e.updateScreenSize()
+		}
+	}
+
+	e.cmd = []rune{}
+	e.dirty = true // Mark as dirty to trigger a redraw
+}
+
+// searchNext moves the cursor to the next match of the last search pattern.
+// Parameters:
+// - sameDirection: True to search in the direction of the last search (n), false for the opposite (N).
+func (e *Editor) searchNext(sameDirection bool) {
+	if len(e.searchPattern) == 0 {
+		e.showStatus(errorNoPreviousRegex)
+		return
+	}
+	e.hideSearchMatches = false
+	forward := e.searchForward == sameDirection
+	x, y, wrapped, ok := e.findMatch(e.searchPattern, e.cursorX, e.cursorY, forward)
+	if !ok {
+		e.showStatus(errorPatternNotFound + ": " + string(e.searchPattern))
+		return
+	}
+	e.cursorX, e.cursorY = x, y
+	if wrapped && forward {
+		e.showStatus(statusSearchHitBottom)
+	} else if wrapped {
+		e.showStatus(statusSearchHitTop)
+	}
+	e.dirty = true // Mark as dirty to trigger a redraw
+}
+
+// findMatch finds the nearest occurrence of pattern after (or before) a buffer position.
+// The search wraps around the end (or start) of the buffer.
+// Parameters:
+// - pattern: The literal text to search for.
+// - fromX, fromY: The position to search from; a match at this exact position is skipped.
+// - forward: True to search towards the end of the buffer, false to search backwards.
+// Returns: The position of the match, whether the search wrapped, and whether a match was found.
+func (e *Editor) findMatch(pattern []rune, fromX, fromY int, forward bool) (int, int, bool, bool) {
+	lineCount := e.text.LineCount()
+	for i := 0; i <= lineCount; i++ {
+		var y int
+		if forward {
+			y = (fromY + i) % lineCount
+		} else {
+			y = (fromY - i + lineCount) % lineCount
+		}
+		matches := findAll(e.text.Line(y), pattern)
+		if !forward {
+			slices.Reverse(matches)
+		}
+		for _, x := range matches {
+			switch {
+			case i == 0 && forward && x <= fromX:
+				continue // Match is at or before the starting point
+			case i == 0 && !forward && x >= fromX:
+				continue // Match is at or after the starting point
+			case i == lineCount && forward && x > fromX:
+				continue // Wrapped past the starting point
+			case i == lineCount && !forward && x < fromX:
+				continue // Wrapped past the starting point
+			}
+			wrapped := (forward && y < fromY) || (!forward && y > fromY) || i == lineCount
+			return x, y, wrapped, true
+		}
+	}
+	return 0, 0, false, false
+}
+
+// indexRunes returns the index of the first occurrence of pattern in line, or -1 if there is none.
+func indexRunes(line, pattern []rune) int {
+	for i := 0; i+len(pattern) <= len(line); i++ {
+		if slices.Equal(line[i:i+len(pattern)], pattern) {
+			return i
+		}
+	}
+	return -1
+}
+
+// findAll returns the start index of every non-overlapping occurrence of pattern in line.
+func findAll(line, pattern []rune) []int {
+	var matches []int
+	if len(pattern) == 0 {
+		return matches
+	}
+	for i := 0; i+len(pattern) <= len(line); i++ {
+		if slices.Equal(line[i:i+len(pattern)], pattern) {
+			matches = append(matches, i)
+			i += len(pattern) - 1
+		}
+	}
+	return matches
+}
+
+// searchMatches marks the runes of line that belong to a match of the current search pattern.
+// Returns: A slice with one entry per rune, or nil if there is nothing to highlight.
+func (e *Editor) searchMatches(line []rune) []bool {
+	matches := findAll(line, e.searchPattern)
+	if len(matches) == 0 {
+		return nil
+	}
+	matched := make([]bool, len(line))
+	for _, x := range matches {
+		for i := x; i < x+len(e.searchPattern); i++ {
+			matched[i] = true
+		}
+	}
+	return matched
+}
+
+// clearSearchHighlight stops highlighting matches of the last search pattern.
+// The pattern is kept so n and N still work.
+func (e *Editor) clearSearchHighlight() {
+	e.hideSearchMatches = true
+	e.dirty = true // Mark as dirty to trigger a redraw
+}
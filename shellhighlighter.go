@@ -0,0 +1,144 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Lexer states carried between lines of shell scripts
+const (
+	shStateCode   LexState = iota // Plain code
+	shStateDouble                 // Inside a "..." string
+	shStateSingle                 // Inside a '...' string
+)
+
+var shellKeywords = wordSet(`if then else elif fi for while until do done case esac in function select time
+	return exit local export readonly declare typeset unset break continue shift source alias eval exec trap set`)
+
+// isShellWordRune reports whether r can be part of an unquoted shell word.
+func isShellWordRune(r rune) bool {
+	return !unicode.IsSpace(r) && !strings.ContainsRune("|&;<>()$`\"'", r)
+}
+
+// ShellHighlighter implements syntax highlighting for shell scripts.
+type ShellHighlighter struct {
+	styles syntaxStyles
+}
+
+// NewShellHighlighter initializes a new ShellHighlighter with default styles.
+func NewShellHighlighter(styles syntaxStyles) *ShellHighlighter {
+	return &ShellHighlighter{styles: styles}
+}
+
+// HighlightLine returns the styled spans of a given shell script line.
+// Quoted strings may span lines.
+func (sh *ShellHighlighter) HighlightLine(src []rune, state LexState) ([]StyleSpan, LexState) {
+	l := newLineLexer(src)
+	state = sh.lex(l, state)
+	return l.spans, state
+}
+
+// lex styles the rest of the line as shell code, starting in the given state,
+// and returns the state at the end of the line.
+func (sh *ShellHighlighter) lex(l *lineLexer, state LexState) LexState {
+	switch start := l.pos; state {
+	case shStateDouble:
+		closed := l.quoted(`"`, true)
+		l.emit(start, sh.styles.str)
+		if !closed {
+			return state
+		}
+	case shStateSingle:
+		closed := l.quoted(`'`, false)
+		l.emit(start, sh.styles.str)
+		if !closed {
+			return state
+		}
+	}
+
+	for !l.eof() {
+		start := l.pos
+		r := l.peek(0)
+		switch {
+		case r == '#' && (start == 0 || unicode.IsSpace(l.src[start-1])):
+			l.emitRest(sh.styles.comment)
+		case r == '"':
+			l.pos++
+			closed := l.quoted(`"`, true)
+			l.emit(start, sh.styles.str)
+			if !closed {
+				return shStateDouble
+			}
+		case r == '\'':
+			l.pos++
+			closed := l.quoted(`'`, false)
+			l.emit(start, sh.styles.str)
+			if !closed {
+				return shStateSingle
+			}
+		case r == '$':
+			sh.variable(l)
+		case strings.ContainsRune("|&;<>()`!", r):
+			l.skipWhile(func(r rune) bool { return strings.ContainsRune("|&;<>()`!", r) })
+			l.emit(start, sh.styles.operator)
+		case unicode.IsSpace(r):
+			l.skipWhile(unicode.IsSpace)
+		default:
+			word := string(l.src[start : start+l.skipWhile(isShellWordRune)])
+			if name, _, ok := strings.Cut(word, "="); ok && name != "" && atCommandStart(l.src, start) {
+				l.pos = start + len([]rune(name))
+				l.emit(start, sh.styles.variable)
+				l.pos++
+				l.emit(l.pos-1, sh.styles.operator)
+				continue
+			}
+			switch {
+			case shellKeywords[word] && atCommandStart(l.src, start):
+				l.emit(start, sh.styles.keyword)
+			case strings.Trim(word, "0123456789") == "":
+				l.emit(start, sh.styles.number)
+			}
+		}
+	}
+	return shStateCode
+}
+
+// variable styles a parameter expansion such as $HOME, ${name:-x} or $1; the '$' must be at the current position.
+// Command and arithmetic substitutions are styled as operators.
+func (sh *ShellHighlighter) variable(l *lineLexer) {
+	start := l.pos
+	l.pos++
+	switch r := l.peek(0); {
+	case r == '{':
+		l.quoted("}", false)
+	case r == '(':
+		l.skipWhile(func(r rune) bool { return r == '(' })
+		l.emit(start, sh.styles.operator)
+		return
+	case isIdentRune(r):
+		l.skipWhile(isIdentRune)
+	case strings.ContainsRune("@*#?$!-", r):
+		l.pos++
+	}
+	l.emit(start, sh.styles.variable)
+}
+
+// atCommandStart reports whether the word at start of src begins a command, i.e. it is only
+// preceded by whitespace, a keyword or an assignment since the start of the line or the last separator.
+func atCommandStart(src []rune, start int) bool {
+	for i := start - 1; i >= 0; i-- {
+		switch r := src[i]; {
+		case strings.ContainsRune("|&;(!`", r):
+			return true
+		case !unicode.IsSpace(r):
+			// The previous word may itself be a keyword such as 'then' or 'do'
+			end := i + 1
+			for i >= 0 && isShellWordRune(src[i]) {
+				i--
+			}
+			prev := string(src[i+1 : end])
+			return shellKeywords[prev] && prev != "in" || strings.Contains(prev, "=")
+		}
+	}
+	return true
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+const (
+	// Substitute error messages
+	errorInvalidRange      = "Invalid range"
+	errorInvalidPattern    = "Invalid pattern"
+	errorTrailingCharacter = "Trailing characters"
+)
+
+// rangeCharacters are the characters an ex line range is made of.
+const rangeCharacters = "0123456789.,$%'<>"
+
+// matchRange is a run of runes on a single line, such as a match awaiting confirmation.
+type matchRange struct {
+	y          int // Line index of the match
+	start, end int // Rune range of the match within the line
+}
+
+// substitution describes a parsed :s command.
+type substitution struct {
+	startY, endY int            // Line range the command applies to (inclusive)
+	pattern      *regexp.Regexp // Pattern to search for on each line
+	template     string         // Replacement in regexp.Expand syntax
+	global       bool           // True to replace every match on a line, not just the first
+	confirm      bool           // True to ask before each replacement
+}
+
+// parseLineAddress parses a single ex line address: a number, '.', '$', or '< and '> for the
+// first and last line of the last visual selection.
+// Returns: The zero-based line index, the remaining text, and whether an address was found.
+func (e *Editor) parseLineAddress(cmd string) (int, string, bool) {
+	if strings.HasPrefix(cmd, "'<") || strings.HasPrefix(cmd, "'>") {
+		if e.lastSelection == nil {
+			return -1, cmd[2:], true // No selection was made: the range is invalid
+		}
+		_, y0, _, y1 := e.lastSelection.bounds()
+		if cmd[1] == '<' {
+			return y0, cmd[2:], true
+		}
+		return y1, cmd[2:], true
+	}
+	switch {
+	case strings.HasPrefix(cmd, "."):
+		return e.cursorY, cmd[1:], true
+	case strings.HasPrefix(cmd, "$"):
+		return e.text.LineCount() - 1, cmd[1:], true
+	}
+	digits := 0
+	for digits < len(cmd) && cmd[digits] >= '0' && cmd[digits] <= '9' {
+		digits++
+	}
+	if digits == 0 {
+		return 0, cmd, false
+	}
+	n, _ := strconv.Atoi(cmd[:digits])
+	return n - 1, cmd[digits:], true
+}
+
+// parseRange parses an optional ex line range ('%', 'N', 'N,M', '.', '$', "'<,'>") at the start of a command.
+// Without a range, the command applies to the cursor line.
+// Returns: The first and last line indices (inclusive) and the rest of the command.
+func (e *Editor) parseRange(cmd string) (int, int, string, error) {
+	if strings.HasPrefix(cmd, "%") {
+		return 0, e.text.LineCount() - 1, cmd[1:], nil
+	}
+	start, rest, ok := e.parseLineAddress(cmd)
+	if !ok {
+		return e.cursorY, e.cursorY, cmd, nil
+	}
+	end := start
+	if strings.HasPrefix(rest, ",") {
+		if end, rest, ok = e.parseLineAddress(rest[1:]); !ok {
+			return 0, 0, cmd, errors.New(errorInvalidRange)
+		}
+	}
+	if start > end {
+		start, end = end, start
+	}
+	if start < 0 || end >= e.text.LineCount() {
+		return 0, 0, cmd, errors.New(errorInvalidRange)
+	}
+	return start, end, rest, nil
+}
+
+// isSubstituteCommand reports whether an ex command (without the ':') is a :s command.
+// The range itself is validated later by parseRange so errors can be reported.
+func isSubstituteCommand(cmd string) bool {
+	rest := strings.TrimLeft(cmd, rangeCharacters)
+	if !strings.HasPrefix(rest, "s") || len(rest) < 2 {
+		return false
+	}
+	delim, _ := utf8.DecodeRuneInString(rest[1:])
+	return delim != ' ' && delim != '\\' && delim != '"' && !isWordRune(delim)
+}
+
+// isWordRune reports whether r can be part of a command name or identifier.
+func isWordRune(r rune) bool {
+	return r == '_' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z'
+}
+
+// splitDelimited splits s on unescaped occurrences of delim.
+// A backslash before delim is removed; other escapes are kept for the regexp and template parsers.
+func splitDelimited(s string, delim rune) []string {
+	var parts []string
+	var current strings.Builder
+	escaped := false
+	for _, r := range s {
+		switch {
+		case escaped:
+			if r != delim {
+				current.WriteRune('\\')
+			}
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == delim:
+			parts = append(parts, current.String())
+			current.Reset()
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if escaped {
+		current.WriteRune('\\')
+	}
+	return append(parts, current.String())
+}
+
+// expandTemplate converts a vim-style replacement into regexp.Expand syntax.
+// It supports '&' and '\0' for the whole match, '\1'-'\9' for capture groups,
+// '\r' for a line break, '\t' for a tab, and '\&' or '\\' for literal characters.
+func expandTemplate(replacement string) string {
+	var template strings.Builder
+	escaped := false
+	for _, r := range replacement {
+		switch {
+		case escaped && r >= '0' && r <= '9':
+			template.WriteString("${" + string(r) + "}")
+		case escaped && r == 'r':
+			template.WriteRune('\n')
+		case escaped && r == 't':
+			template.WriteRune('\t')
+		case escaped && r == '$':
+			template.WriteString("$$")
+		case escaped:
+			template.WriteRune(r)
+		case r == '\\':
+			escaped = true
+			continue
+		case r == '&':
+			template.WriteString("${0}")
+		case r == '$':
+			template.WriteString("$$")
+		default:
+			template.WriteRune(r)
+		}
+		escaped = false
+	}
+	return template.String()
+}
+
+// parseSubstitute parses a :s command (without the ':') such as "%s/old/new/gc".
+// An empty pattern reuses the last search pattern.
+func (e *Editor) parseSubstitute(cmd string) (*substitution, error) {
+	startY, endY, rest, err := e.parseRange(cmd)
+	if err != nil {
+		return nil, err
+	}
+	delim, size := utf8.DecodeRuneInString(rest[1:])
+	parts := splitDelimited(rest[1+size:], delim)
+	if len(parts) > 3 {
+		return nil, errors.New(errorTrailingCharacter + ": " + parts[3])
+	}
+	for len(parts) < 3 {
+		parts = append(parts, "")
+	}
+
+	sub := &substitution{startY: startY, endY: endY, template: expandTemplate(parts[1])}
+	for _, flag := range parts[2] {
+		switch flag {
+		case 'g':
+			sub.global = true
+		case 'c':
+			sub.confirm = true
+		default:
+			return nil, errors.New(errorTrailingCharacter + ": " + parts[2])
+		}
+	}
+
+	pattern := parts[0]
+	if pattern == "" {
+		if len(e.searchPattern) == 0 {
+			return nil, errors.New(errorNoPreviousRegex)
+		}
+		pattern = regexp.QuoteMeta(string(e.searchPattern))
+	}
+	if sub.pattern, err = regexp.Compile(pattern); err != nil {
+		return nil, fmt.Errorf("%s: %w", errorInvalidPattern, err)
+	}
+	return sub, nil
+}
+
+// executeSubstituteCommand processes the :s command to replace regexp matches in a range of lines.
+// Parameters:
+// - cmd: The command string after the ':', including the optional range.
+// Returns:
+// - error: An error if the command cannot be parsed.
+func (e *Editor) executeSubstituteCommand(cmd string) error {
+	sub, err := e.parseSubstitute(cmd)
+	if err != nil {
+		return err
+	}
+
+	// All replacements made by one command are undone together
+	e.history.beginGroup()
+	defer e.history.endGroup()
+
+	limit := 1
+	if sub.global {
+		limit = -1
+	}
+	replacements, lines, lastY := 0, 0, 0
+	confirm, stop := sub.confirm, false
+	for y, endY := sub.startY, sub.endY; y <= endY && !stop; y++ {
+		line := string(e.text.Line(y))
+
+		// Matches are found in the line as it was, and each accepted replacement is applied right
+		// away, so the next prompt shows the line with it. Text after the last replacement made,
+		// from column prevEnd of the original line, now starts at (baseX, baseY).
+		edits, prevEnd, baseX, baseY := 0, 0, 0, y
+		for _, loc := range sub.pattern.FindAllStringSubmatchIndex(line, limit) {
+			start := utf8.RuneCountInString(line[:loc[0]])
+			end := start + utf8.RuneCountInString(line[loc[0]:loc[1]])
+			replacement := []rune(string(sub.pattern.ExpandString(nil, sub.template, line, loc)))
+			match := matchRange{y: baseY, start: baseX + start - prevEnd, end: baseX + end - prevEnd}
+			if confirm {
+				accept, all, quit := e.confirmSubstitution(match, replacement)
+				confirm, stop = !all, quit
+				if !accept {
+					if stop {
+						break
+					}
+					continue
+				}
+			}
+			e.deleteText(match.start, match.y, match.end, match.y)
+			baseX, baseY = e.insertText(match.start, match.y, replacement)
+			prevEnd = end
+			edits++
+			if stop {
+				break
+			}
+		}
+
+		if edits > 0 {
+			replacements += edits
+			lines++
+			// Replacements containing line breaks push the remaining lines down
+			endY += baseY - y
+			y = baseY
+			lastY = y
+		}
+	}
+
+	if replacements == 0 {
+		if !sub.confirm {
+			e.showStatus(errorPatternNotFound + ": " + sub.pattern.String())
+		}
+		return nil
+	}
+	e.cursorX, e.cursorY = 0, lastY
+	e.showStatus(fmt.Sprintf("%d substitution%s on %d line%s", replacements, plural(replacements), lines, plural(lines)))
+	return nil
+}
+
+// confirmSubstitution highlights a match and asks in the status bar whether to replace it.
+// Returns: Whether to replace the match, whether to replace all remaining matches without asking,
+// and whether to stop after this match.
+func (e *Editor) confirmSubstitution(match matchRange, replacement []rune) (bool, bool, bool) {
+	e.confirmMatch = &match
+	e.cursorX, e.cursorY = match.start, match.y
+	prompt := e.cmd
+	defer func() {
+		e.confirmMatch = nil
+		e.cmd = prompt
+		e.dirty = true // Mark as dirty to trigger a redraw
+	}()
+	e.cmd = []rune(fmt.Sprintf("replace with %s (y/n/a/q/l)?", string(replacement)))
+	e.dirty = true // Mark as dirty to trigger a redraw
+
+	for {
+		e.adjustOffsets()
+		e.draw()
+		switch ev := e.pollEvent().(type) {
+		case *tcell.EventKey:
+			if ev.Key() == tcell.KeyEsc {
+				return false, false, true
+			}
+			switch ev.Rune() {
+			case 'y':
+				return true, false, false
+			case 'n':
+				return false, false, false
+			case 'a':
+				return true, true, false
+			case 'q':
+				return false, false, true
+			case 'l':
+				return true, false, true
+			}
+		case *tcell.EventResize:
+			e.updateScreenSize()
+		}
+	}
+}
+
+// plural returns the "s" suffix for counts other than one.
+func plural(n int) string {
+	if n == 1 {
+		return ""
+	}
+	return "s"
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"slices"
+	"sort"
+	"unicode/utf8"
+)
+
+// TextBuffer defines the storage used for the text being edited.
+// Positions are addressed either as (x, y) rune columns and line indices, or as
+// rune offsets from the start of the buffer. Lines are separated by '\n' runes.
+type TextBuffer interface {
+	// Len returns the number of runes in the buffer.
+	Len() int
+	// LineCount returns the number of lines in the buffer (at least one).
+	LineCount() int
+	// Line returns a copy of the runes of line y, without the line break.
+	Line(y int) []rune
+	// LineLen returns the number of runes in line y, without the line break.
+	LineLen(y int) int
+	// Slice returns a copy of the runes between two offsets.
+	Slice(start, end int) []rune
+	// Insert inserts text at the given rune offset.
+	Insert(offset int, text []rune)
+	// Delete removes length runes starting at offset and returns them.
+	Delete(offset, length int) []rune
+	// Offset converts a (x, y) position to a rune offset.
+	Offset(x, y int) int
+	// Position converts a rune offset to a (x, y) position.
+	Position(offset int) (int, int)
+	// ByteOffset converts a rune offset to the byte offset in the UTF-8 encoded text.
+	ByteOffset(offset int) int
+	// RuneOffset converts a byte offset in the UTF-8 encoded text to a rune offset.
+	RuneOffset(byteOffset int) int
+}
+
+// storeMarkInterval is the number of runes between the byte offsets a textStore keeps.
+const storeMarkInterval = 64
+
+// textStore is an append-only buffer of UTF-8 text that pieces reference by rune offsets. It keeps the
+// byte offset of every storeMarkInterval-th rune, so that rune offsets convert to byte offsets, and
+// back, in time that does not depend on the size of the text.
+type textStore struct {
+	text   []byte // The text, encoded in UTF-8
+	runes  int    // Number of runes in text
+	marks  []int  // Byte offset of every storeMarkInterval-th rune
+	breaks []int  // Rune offsets of the '\n' runes
+}
+
+// append adds runes to the end of the store.
+func (s *textStore) append(text []rune) {
+	for _, r := range text {
+		if s.runes%storeMarkInterval == 0 {
+			s.marks = append(s.marks, len(s.text))
+		}
+		if r == '\n' {
+			s.breaks = append(s.breaks, s.runes)
+		}
+		s.text = utf8.AppendRune(s.text, r)
+		s.runes++
+	}
+}
+
+// byteOffset converts a rune offset in the store to a byte offset.
+func (s *textStore) byteOffset(offset int) int {
+	if offset >= s.runes {
+		return len(s.text)
+	}
+	b := s.marks[offset/storeMarkInterval]
+	for range offset % storeMarkInterval {
+		_, size := utf8.DecodeRune(s.text[b:])
+		b += size
+	}
+	return b
+}
+
+// runeOffset converts a byte offset in the store to the offset of the rune the byte belongs to.
+func (s *textStore) runeOffset(byteOffset int) int {
+	if byteOffset >= len(s.text) {
+		return s.runes
+	}
+	i := sort.SearchInts(s.marks, byteOffset+1) - 1 // The last mark at or before the byte
+	offset, b := i*storeMarkInterval, s.marks[i]
+	for {
+		_, size := utf8.DecodeRune(s.text[b:])
+		if b+size > byteOffset {
+			return offset
+		}
+		b += size
+		offset++
+	}
+}
+
+// appendRunes appends the runes between two rune offsets of the store to text.
+func (s *textStore) appendRunes(text []rune, start, end int) []rune {
+	for b, stop := s.byteOffset(start), s.byteOffset(end); b < stop; {
+		r, size := utf8.DecodeRune(s.text[b:])
+		text = append(text, r)
+		b += size
+	}
+	return text
+}
+
+// piece references a run of text in one of the piece table's backing stores.
+type piece struct {
+	added  bool // True if the run lives in the add store, false for the original text
+	start  int  // Rune offset of the run in its backing store
+	length int  // Number of runes in the run
+	bytes  int  // Number of bytes of the run in UTF-8
+	breaks int  // Number of '\n' runes in the run
+}
+
+// pieceEnd is where a piece ends in the text: the runes, bytes and line breaks up to its end.
+type pieceEnd struct {
+	runes, bytes, breaks int
+}
+
+// PieceTable is a TextBuffer that never moves the original text.
+// Edits only append to an add store and split the list of pieces, so inserting or
+// deleting costs time proportional to the number of pieces instead of the file size.
+// The ends of the pieces are kept as running totals, so finding the piece holding an offset
+// or a line takes time logarithmic in the number of pieces.
+type PieceTable struct {
+	original textStore  // Text the buffer was created with; never modified
+	added    textStore  // Append-only store holding every inserted run
+	pieces   []piece    // Pieces that make up the current text, in order
+	ends     []pieceEnd // Where each piece ends in the text
+}
+
+// NewPieceTable creates a piece table holding the given text.
+func NewPieceTable(text []rune) *PieceTable {
+	pt := &PieceTable{}
+	pt.original.append(text)
+	if len(text) > 0 {
+		pt.pieces = []piece{pt.newPiece(false, 0, len(text))}
+	}
+	pt.index()
+	return pt
+}
+
+// NewPieceTableFromLines creates a piece table holding the given lines joined by '\n'.
+func NewPieceTableFromLines(lines [][]rune) *PieceTable {
+	var text []rune
+	for i, line := range lines {
+		if i > 0 {
+			text = append(text, '\n')
+		}
+		text = append(text, line...)
+	}
+	return NewPieceTable(text)
+}
+
+// store returns the backing store of a piece.
+func (pt *PieceTable) store(p piece) *textStore {
+	if p.added {
+		return &pt.added
+	}
+	return &pt.original
+}
+
+// newPiece creates a piece for a run of a backing store, counting its bytes and line breaks.
+func (pt *PieceTable) newPiece(added bool, start, length int) piece {
+	p := piece{added: added, start: start, length: length}
+	s := pt.store(p)
+	p.bytes = s.byteOffset(start+length) - s.byteOffset(start)
+	p.breaks = pt.breaksBefore(p, length)
+	return p
+}
+
+// breaksBefore counts the '\n' runes in the first n runes of a piece.
+func (pt *PieceTable) breaksBefore(p piece, n int) int {
+	breaks := pt.store(p).breaks
+	return sort.SearchInts(breaks, p.start+n) - sort.SearchInts(breaks, p.start)
+}
+
+// nthBreak returns the offset inside a piece of its n-th (1-based) '\n' rune.
+func (pt *PieceTable) nthBreak(p piece, n int) int {
+	breaks := pt.store(p).breaks
+	return breaks[sort.SearchInts(breaks, p.start)+n-1] - p.start
+}
+
+// split divides a piece at the given offset inside it.
+func (pt *PieceTable) split(p piece, at int) (piece, piece) {
+	return pt.newPiece(p.added, p.start, at), pt.newPiece(p.added, p.start+at, p.length-at)
+}
+
+// index recomputes where each piece ends after the pieces changed.
+func (pt *PieceTable) index() {
+	pt.ends = pt.ends[:0]
+	var end pieceEnd
+	for _, p := range pt.pieces {
+		end.runes += p.length
+		end.bytes += p.bytes
+		end.breaks += p.breaks
+		pt.ends = append(pt.ends, end)
+	}
+}
+
+// total returns the runes, bytes and line breaks of the whole text.
+func (pt *PieceTable) total() pieceEnd {
+	if len(pt.ends) == 0 {
+		return pieceEnd{}
+	}
+	return pt.ends[len(pt.ends)-1]
+}
+
+// startOf returns where piece i starts in the text.
+func (pt *PieceTable) startOf(i int) pieceEnd {
+	if i == 0 {
+		return pieceEnd{}
+	}
+	return pt.ends[i-1]
+}
+
+// pieceAt returns the index of the piece holding the rune at offset, or len(pt.pieces) past the end of the text.
+func (pt *PieceTable) pieceAt(offset int) int {
+	return sort.Search(len(pt.ends), func(i int) bool { return pt.ends[i].runes > offset })
+}
+
+// Len returns the number of runes in the buffer.
+func (pt *PieceTable) Len() int {
+	return pt.total().runes
+}
+
+// LineCount returns the number of lines in the buffer.
+func (pt *PieceTable) LineCount() int {
+	return pt.total().breaks + 1
+}
+
+// lineStart returns the rune offset where line y starts.
+func (pt *PieceTable) lineStart(y int) int {
+	if y <= 0 {
+		return 0
+	}
+	i := sort.Search(len(pt.ends), func(i int) bool { return pt.ends[i].breaks >= y })
+	if i == len(pt.ends) {
+		return pt.Len()
+	}
+	start := pt.startOf(i)
+	return start.runes + pt.nthBreak(pt.pieces[i], y-start.breaks) + 1
+}
+
+// lineRange returns the rune offsets where line y starts and ends, excluding the line break.
+func (pt *PieceTable) lineRange(y int) (int, int) {
+	start := pt.lineStart(y)
+	if y+1 >= pt.LineCount() {
+		return start, pt.Len()
+	}
+	return start, pt.lineStart(y+1) - 1
+}
+
+// Line returns a copy of the runes of line y, without the line break.
+func (pt *PieceTable) Line(y int) []rune {
+	start, end := pt.lineRange(y)
+	return pt.Slice(start, end)
+}
+
+// LineLen returns the number of runes in line y, without the line break.
+func (pt *PieceTable) LineLen(y int) int {
+	start, end := pt.lineRange(y)
+	return end - start
+}
+
+// Slice returns a copy of the runes between two offsets.
+func (pt *PieceTable) Slice(start, end int) []rune {
+	text := make([]rune, 0, max(end-start, 0))
+	for i := pt.pieceAt(start); i < len(pt.pieces); i++ {
+		p, offset := pt.pieces[i], pt.startOf(i).runes
+		if offset >= end {
+			break
+		}
+		from := max(start-offset, 0)
+		to := min(end-offset, p.length)
+		text = pt.store(p).appendRunes(text, p.start+from, p.start+to)
+	}
+	return text
+}
+
+// Insert inserts text at the given rune offset.
+func (pt *PieceTable) Insert(offset int, text []rune) {
+	if len(text) == 0 {
+		return
+	}
+	start := pt.added.runes
+	pt.added.append(text)
+	inserted := pt.newPiece(true, start, len(text))
+	defer pt.index()
+
+	// Locate the piece containing the offset
+	i := pt.pieceAt(offset)
+	inner := offset - pt.startOf(i).runes
+
+	// Typing appends to the end of the previous insertion, so grow that piece instead
+	if inner == 0 && i > 0 {
+		if prev := &pt.pieces[i-1]; prev.added && prev.start+prev.length == start {
+			prev.length += inserted.length
+			prev.bytes += inserted.bytes
+			prev.breaks += inserted.breaks
+			return
+		}
+	}
+
+	if inner == 0 || i == len(pt.pieces) {
+		pt.pieces = slices.Insert(pt.pieces, i, inserted)
+		return
+	}
+	left, right := pt.split(pt.pieces[i], inner)
+	pt.pieces = slices.Replace(pt.pieces, i, i+1, left, inserted, right)
+}
+
+// Delete removes length runes starting at offset and returns them.
+func (pt *PieceTable) Delete(offset, length int) []rune {
+	if length <= 0 {
+		return []rune{}
+	}
+	end := offset + length
+	removed := pt.Slice(offset, end)
+
+	// Only the pieces overlapping the deleted range change: keep what they hold outside of it
+	first, last := pt.pieceAt(offset), pt.pieceAt(end-1)
+	var kept []piece
+	if first < len(pt.pieces) {
+		if p, inner := pt.pieces[first], offset-pt.startOf(first).runes; inner > 0 {
+			kept = append(kept, pt.newPiece(p.added, p.start, inner))
+		}
+	}
+	if last < len(pt.pieces) {
+		if p, inner := pt.pieces[last], end-pt.startOf(last).runes; inner < p.length {
+			kept = append(kept, pt.newPiece(p.added, p.start+inner, p.length-inner))
+		}
+	}
+	pt.pieces = slices.Replace(pt.pieces, first, min(last+1, len(pt.pieces)), kept...)
+	pt.index()
+	return removed
+}
+
+// Offset converts a (x, y) position to a rune offset.
+func (pt *PieceTable) Offset(x, y int) int {
+	return pt.lineStart(y) + x
+}
+
+// Position converts a rune offset to a (x, y) position.
+func (pt *PieceTable) Position(offset int) (int, int) {
+	i := pt.pieceAt(offset)
+	if i == len(pt.pieces) {
+		y := pt.LineCount() - 1
+		return offset - pt.lineStart(y), y
+	}
+	start := pt.startOf(i)
+	y := start.breaks + pt.breaksBefore(pt.pieces[i], offset-start.runes)
+	return offset - pt.lineStart(y), y
+}
+
+// ByteOffset converts a rune offset to the byte offset in the UTF-8 encoded text.
+func (pt *PieceTable) ByteOffset(offset int) int {
+	i := pt.pieceAt(offset)
+	if i == len(pt.pieces) {
+		return pt.total().bytes
+	}
+	p, start := pt.pieces[i], pt.startOf(i)
+	s := pt.store(p)
+	return start.bytes + s.byteOffset(p.start+offset-start.runes) - s.byteOffset(p.start)
+}
+
+// RuneOffset converts a byte offset in the UTF-8 encoded text to a rune offset.
+func (pt *PieceTable) RuneOffset(byteOffset int) int {
+	i := sort.Search(len(pt.ends), func(i int) bool { return pt.ends[i].bytes > byteOffset })
+	if i == len(pt.pieces) {
+		return pt.Len()
+	}
+	p, start := pt.pieces[i], pt.startOf(i)
+	s := pt.store(p)
+	return start.runes + s.runeOffset(s.byteOffset(p.start)+byteOffset-start.bytes) - p.start
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// Scopes a theme assigns styles to
+const (
+	scopeDefault    = "default"    // Text without a more specific scope
+	scopeComment    = "comment"    // Comments
+	scopeKeyword    = "keyword"    // Language keywords and directives
+	scopeString     = "string"     // String literals
+	scopeCharacter  = "character"  // Character literals
+	scopeNumber     = "number"     // Numeric literals
+	scopeConstant   = "constant"   // Named constants such as true, false and null
+	scopeVariable   = "variable"   // Variable references and assignments
+	scopeIdentifier = "identifier" // Identifiers, mapping keys, targets and other defined names
+	scopeOperator   = "operator"   // Operators and structural punctuation
+	scopeHeading    = "heading"    // Markup headings
+	scopeEmphasis   = "emphasis"   // Markup emphasis
+	scopeCode       = "code"       // Inline code and code blocks in markup
+	scopeLink       = "link"       // Links in markup
+	scopeGutter     = "gutter"     // Line numbers
+	scopeCursorLine = "cursorline" // The line with the cursor, layered over the text styles
+	scopeStatusBar  = "statusbar"  // Status and command line
+	scopeSearch     = "search"     // Search matches, layered over the text styles
+	scopeVisual     = "visual"     // Text selected in visual mode, layered over the other styles
+	scopeCursor     = "cursor"     // Additional cursors, layered over the other styles
+
+	scopeStatusLine         = "statusline"   // Status line of the current window, with several windows
+	scopeStatusLineInactive = "statuslinenc" // Status lines of the other windows, and window separators
+)
+
+// defaultColorScheme is the bundled theme the editor starts with.
+const defaultColorScheme = "dark"
+
+// themeSuffix is the file name suffix of theme files.
+const themeSuffix = ".theme"
+
+// bundledThemes are the themes built into the editor, in the theme file format.
+var bundledThemes = map[string]string{
+	"dark": `
+default    fg=white bg=black
+comment    fg=gray
+keyword    fg=blue
+string     fg=green
+character  fg=purple
+number     fg=indianred
+constant   fg=purple
+variable   fg=teal
+identifier fg=orange
+operator   fg=blue
+heading    fg=orange bold
+emphasis   italic
+code       fg=green
+link       fg=blue underline
+cursorline bg=18
+search     fg=black bg=yellow
+visual     bg=240
+cursor     reverse
+statusline   fg=black bg=white bold
+statuslinenc fg=black bg=gray
+`,
+	"light": `
+default    fg=black bg=white
+comment    fg=gray italic
+keyword    fg=navy bold
+string     fg=darkgreen
+character  fg=purple
+number     fg=darkred
+constant   fg=purple
+variable   fg=teal
+identifier fg=#af5f00
+operator   fg=navy
+heading    fg=#af5f00 bold
+emphasis   italic
+code       fg=darkgreen
+link       fg=blue underline
+gutter     fg=gray bg=#eeeeee
+cursorline bg=#e4e4e4
+statusbar  fg=white bg=#585858
+search     fg=black bg=yellow
+visual     bg=#bcd4ee
+cursor     reverse
+statusline   fg=white bg=#303030 bold
+statuslinenc fg=#303030 bg=#bcbcbc
+`,
+}
+
+// themeStyle is the style a theme gives a scope. Colors left as tcell.ColorDefault are not set,
+// so the style can be layered over another one.
+type themeStyle struct {
+	fg, bg tcell.Color
+	attrs  tcell.AttrMask
+}
+
+// apply layers the style over base.
+func (ts themeStyle) apply(base tcell.Style) tcell.Style {
+	if ts.fg != tcell.ColorDefault {
+		base = base.Foreground(ts.fg)
+	}
+	if ts.bg != tcell.ColorDefault {
+		base = base.Background(ts.bg)
+	}
+	_, _, attrs := base.Decompose()
+	return base.Attributes(attrs | ts.attrs)
+}
+
+// Theme assigns styles to named scopes such as keyword, comment or statusbar.
+// Scopes the theme does not mention use its default style.
+type Theme struct {
+	name   string
+	styles map[string]themeStyle
+}
+
+// Name returns the name the theme was loaded by.
+func (t *Theme) Name() string {
+	return t.name
+}
+
+// Style returns the style of a scope: the theme's style for it layered over the default style.
+func (t *Theme) Style(scope string) tcell.Style {
+	base := t.styles[scopeDefault].apply(tcell.Style{})
+	if scope == scopeDefault {
+		return base
+	}
+	return t.styles[scope].apply(base)
+}
+
+// Layer returns style with the colors and attributes the theme sets for a scope layered over it,
+// for scopes such as cursorline and search that mark text which already has a style.
+func (t *Theme) Layer(scope string, style tcell.Style) tcell.Style {
+	return t.styles[scope].apply(style)
+}
+
+// parseTheme parses a theme file. Each line assigns a style to a scope, e.g.
+// "keyword fg=#5f87ff bold". Colors are W3C names, #rrggbb values or palette
+// indexes; "default" is the terminal's own color. Attributes are bold, italic,
+// underline, reverse, dim, blink and strikethrough. '#' at the start of a line starts a comment.
+func parseTheme(name, text string) (*Theme, error) {
+	theme := &Theme{name: name, styles: map[string]themeStyle{}}
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		var style themeStyle
+		for _, field := range fields[1:] {
+			key, value, ok := strings.Cut(field, "=")
+			switch {
+			case ok && (key == "fg" || key == "bg"):
+				color, err := parseThemeColor(value)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %w", n, err)
+				}
+				if key == "fg" {
+					style.fg = color
+				} else {
+					style.bg = color
+				}
+			case !ok && themeAttributes[field] != 0:
+				style.attrs |= themeAttributes[field]
+			default:
+				return nil, fmt.Errorf("line %d: invalid style %q", n, field)
+			}
+		}
+		theme.styles[fields[0]] = style
+	}
+	return theme, scanner.Err()
+}
+
+// themeAttributes are the text attributes a theme can set, by name.
+var themeAttributes = map[string]tcell.AttrMask{
+	"bold":          tcell.AttrBold,
+	"italic":        tcell.AttrItalic,
+	"underline":     tcell.AttrUnderline,
+	"reverse":       tcell.AttrReverse,
+	"dim":           tcell.AttrDim,
+	"blink":         tcell.AttrBlink,
+	"strikethrough": tcell.AttrStrikeThrough,
+}
+
+// parseThemeColor parses a color name, a #rrggbb value or a palette index.
+func parseThemeColor(value string) (tcell.Color, error) {
+	if value == "default" {
+		return tcell.ColorReset, nil
+	}
+	if index, err := strconv.Atoi(strings.TrimPrefix(value, "color")); err == nil && index >= 0 && index < 256 {
+		return tcell.PaletteColor(index), nil
+	}
+	if color := tcell.GetColor(strings.ToLower(value)); color != tcell.ColorDefault {
+		return color, nil
+	}
+	return tcell.ColorDefault, fmt.Errorf("invalid color %q", value)
+}
+
+// themeDir returns the directory user themes are loaded from: goed/themes in the user's configuration directory.
+func themeDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "goed", "themes"), nil
+}
+
+// loadTheme loads a theme by name: name.theme from the user's theme directory if it exists,
+// or else the bundled theme of that name.
+func loadTheme(name string) (*Theme, error) {
+	if dir, err := themeDir(); err == nil && name != "" && !strings.ContainsAny(name, `/\`) {
+		data, err := os.ReadFile(filepath.Join(dir, name+themeSuffix))
+		if err == nil {
+			return parseTheme(name, string(data))
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	if text, ok := bundledThemes[name]; ok {
+		return parseTheme(name, text)
+	}
+	return nil, fmt.Errorf("no theme named %q", name)
+}
+
+// defaultTheme returns the bundled default theme.
+func defaultTheme() *Theme {
+	theme, err := parseTheme(defaultColorScheme, bundledThemes[defaultColorScheme])
+	if err != nil {
+		panic(err) // The bundled themes are known to parse
+	}
+	return theme
+}
+
+// forColors returns the theme with every color the terminal cannot show replaced by the closest one it can.
+// Parameters:
+// - colors: The number of colors of the terminal, as returned by tcell.Screen.Colors.
+func (t *Theme) forColors(colors int) *Theme {
+	if colors >= 1<<24 {
+		return t // Truecolor shows every color as is
+	}
+	palette := make([]tcell.Color, min(max(colors, 8), 256))
+	for i := range palette {
+		palette[i] = tcell.PaletteColor(i)
+	}
+	fit := func(c tcell.Color) tcell.Color {
+		if c.IsRGB() || (c.Valid() && int(c-tcell.ColorValid) >= len(palette)) {
+			return tcell.FindColor(c, palette)
+		}
+		return c
+	}
+
+	fitted := &Theme{name: t.name, styles: map[string]themeStyle{}}
+	for scope, style := range t.styles {
+		style.fg, style.bg = fit(style.fg), fit(style.bg)
+		fitted.styles[scope] = style
+	}
+	return fitted
+}
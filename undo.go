@@ -0,0 +1,193 @@
+package main
+
+const (
+	defaultUndoLevels = 1000 // Maximum number of undo steps kept in history
+
+	// Undo status messages
+	statusAlreadyOldest = "Already at oldest change"
+	statusAlreadyNewest = "Already at newest change"
+)
+
+// editOp describes a single reversible change to the text buffer.
+type editOp struct {
+	insert bool   // True if text was inserted, false if it was deleted
+	x, y   int    // Buffer position where the change starts
+	text   []rune // Text inserted or deleted; may contain '\n' line breaks
+}
+
+// end returns the buffer position right after the op's text.
+func (op editOp) end() (int, int) {
+	return textEnd(op.x, op.y, op.text)
+}
+
+// cursorAfter returns where the cursor naturally lands after the op is applied.
+func (op editOp) cursorAfter() (int, int) {
+	if op.insert {
+		return op.end()
+	}
+	return op.x, op.y
+}
+
+// undoStep groups the operations that are undone and redone together.
+type undoStep struct {
+	ops              []editOp
+	cursorX, cursorY int // Cursor position before the step was applied
+}
+
+// History records buffer edits as undo steps and keeps undone steps for redo.
+type History struct {
+	undo      []*undoStep
+	redo      []*undoStep
+	sealed    bool // True if the next edit must start a new undo step
+	grouping  bool // True while every edit is collected into the same undo step
+	maxLevels int  // Maximum number of undo steps to keep
+}
+
+// NewHistory creates an empty edit history.
+func NewHistory() *History {
+	return &History{
+		sealed:    true,
+		maxLevels: defaultUndoLevels,
+	}
+}
+
+// record adds an operation to the history.
+// Consecutive edits are merged into the same undo step as long as the step is not sealed
+// and the cursor has not moved away from where the previous edit left it, or a group is open.
+// Parameters:
+// - op: The operation that was applied to the buffer.
+// - cursorX, cursorY: The cursor position before the operation was applied.
+func (h *History) record(op editOp, cursorX, cursorY int) {
+	h.redo = nil // A new edit invalidates the redo history
+
+	if step := h.last(); step != nil && !h.sealed {
+		prev := &step.ops[len(step.ops)-1]
+		if x, y := prev.cursorAfter(); x == cursorX && y == cursorY {
+			// Extend the previous op when typing or deleting contiguous text
+			if prev.insert && op.insert {
+				if ex, ey := prev.end(); ex == op.x && ey == op.y {
+					prev.text = append(prev.text, op.text...)
+					return
+				}
+			} else if !prev.insert && !op.insert {
+				if op.x == prev.x && op.y == prev.y {
+					// Delete key: the removed text follows the previous deletion
+					prev.text = append(prev.text, op.text...)
+					return
+				}
+				if ex, ey := op.end(); ex == prev.x && ey == prev.y {
+					// Backspace: the removed text precedes the previous deletion
+					prev.text = append(op.text, prev.text...)
+					prev.x, prev.y = op.x, op.y
+					return
+				}
+			}
+			step.ops = append(step.ops, op)
+			return
+		}
+		if h.grouping {
+			step.ops = append(step.ops, op)
+			return
+		}
+	}
+
+	h.undo = append(h.undo, &undoStep{ops: []editOp{op}, cursorX: cursorX, cursorY: cursorY})
+	if len(h.undo) > h.maxLevels {
+		h.undo = h.undo[len(h.undo)-h.maxLevels:]
+	}
+	h.sealed = false
+}
+
+// seal closes the current undo step so the next edit starts a new one.
+func (h *History) seal() {
+	h.sealed = true
+}
+
+// beginGroup starts an undo step that collects every edit until endGroup is called.
+func (h *History) beginGroup() {
+	h.sealed = true
+	h.grouping = true
+}
+
+// endGroup closes the undo step opened by beginGroup.
+func (h *History) endGroup() {
+	h.grouping = false
+	h.sealed = true
+}
+
+// reset discards all undo and redo history.
+func (h *History) reset() {
+	h.undo = nil
+	h.redo = nil
+	h.sealed = true
+}
+
+// last returns the most recent undo step, or nil if there is none.
+func (h *History) last() *undoStep {
+	if len(h.undo) == 0 {
+		return nil
+	}
+	return h.undo[len(h.undo)-1]
+}
+
+// textEnd returns the buffer position right after text inserted at (x, y).
+func textEnd(x, y int, text []rune) (int, int) {
+	for _, r := range text {
+		if r == '\n' {
+			y++
+			x = 0
+		} else {
+			x++
+		}
+	}
+	return x, y
+}
+
+// undo reverts the most recent undo step and restores the cursor position it started from.
+func (e *Editor) undo() {
+	e.history.seal()
+	if len(e.history.undo) == 0 {
+		e.showStatus(statusAlreadyOldest)
+		return
+	}
+	step := e.history.undo[len(e.history.undo)-1]
+	e.history.undo = e.history.undo[:len(e.history.undo)-1]
+
+	for i := len(step.ops) - 1; i >= 0; i-- {
+		op := step.ops[i]
+		if op.insert {
+			endX, endY := op.end()
+			e.applyDelete(op.x, op.y, endX, endY)
+		} else {
+			e.applyInsert(op.x, op.y, op.text)
+		}
+	}
+
+	e.history.redo = append(e.history.redo, step)
+	e.cursorX, e.cursorY = step.cursorX, step.cursorY
+	e.dirty = true // Mark as dirty to trigger a redraw
+}
+
+// redo reapplies the most recently undone step.
+func (e *Editor) redo() {
+	e.history.seal()
+	if len(e.history.redo) == 0 {
+		e.showStatus(statusAlreadyNewest)
+		return
+	}
+	step := e.history.redo[len(e.history.redo)-1]
+	e.history.redo = e.history.redo[:len(e.history.redo)-1]
+
+	for _, op := range step.ops {
+		if op.insert {
+			e.applyInsert(op.x, op.y, op.text)
+		} else {
+			endX, endY := op.end()
+			e.applyDelete(op.x, op.y, endX, endY)
+		}
+	}
+
+	e.history.undo = append(e.history.undo, step)
+	e.cursorX, e.cursorY = step.ops[len(step.ops)-1].cursorAfter()
+	e.dirty = true // Mark as dirty to trigger a redraw
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// visualKeys are the keys that act on the selection in visual mode, rather than move the cursor.
+const visualKeys = "vVoOdxXDyYcsSRCIA<>uU~!:"
+
+// visualMode is the kind of selection made in visual mode.
+type visualMode int
+
+const (
+	visualNone  visualMode = iota // Not in visual mode
+	visualChar                    // Character-wise selection, started with 'v'
+	visualLine                    // Line-wise selection, started with 'V'
+	visualBlock                   // Block (column) selection, started with Ctrl-V
+)
+
+// selection is a region of text selected in visual mode. Positions are rune indexes, but a block
+// selection spans display columns, so it stays aligned on the screen over tabs and wide characters.
+type selection struct {
+	mode           visualMode
+	startX, startY int // Where the selection was started
+	endX, endY     int // The other end of the selection, where the cursor is
+	left, right    int // The first and last display column of a block selection
+}
+
+// bounds returns the first and last line of the selection and its first and last column (inclusive).
+// For character-wise selections, the columns are rune indexes on the first and last line; for block
+// selections, they are the display columns of the block on every line. Line-wise selections cover
+// whole lines whatever the columns.
+func (s selection) bounds() (int, int, int, int) {
+	x0, y0, x1, y1 := s.startX, s.startY, s.endX, s.endY
+	if s.mode == visualBlock {
+		return s.left, min(y0, y1), s.right, max(y0, y1)
+	}
+	if y1 < y0 || (y1 == y0 && x1 < x0) {
+		x0, y0, x1, y1 = x1, y1, x0, y0
+	}
+	return x0, y0, x1, y1
+}
+
+// columns returns the range of columns the selection covers on line y, or an empty range if the
+// line is not selected. The range ends one past the end of the line when the line break is selected.
+// Parameters:
+// - y: The line index.
+// - line: The text of the line.
+// - tabWidth: The number of columns between tab stops.
+// Returns: The first column (inclusive) and the last (exclusive).
+func (s selection) columns(y int, line []rune, tabWidth int) (int, int) {
+	x0, y0, x1, y1 := s.bounds()
+	if y < y0 || y > y1 {
+		return 0, 0
+	}
+	lineLen := len(line)
+	switch s.mode {
+	case visualLine:
+		return 0, lineLen + 1
+	case visualBlock:
+		return blockRange(line, x0, x1, tabWidth)
+	}
+	from, to := 0, lineLen+1
+	if y == y0 {
+		from = x0
+	}
+	if y == y1 {
+		to = min(x1+1, lineLen+1)
+	}
+	return from, to
+}
+
+// blockRange returns the range of characters of a line shown in a block of display columns. Characters
+// partly in the block, such as a tab or a wide character across its edge, are included.
+// Parameters:
+// - line: The text of the line.
+// - left, right: The first and last display column of the block (inclusive).
+// - tabWidth: The number of columns between tab stops.
+// Returns: The first character (inclusive) and the last (exclusive), both the end of the line if
+// the line does not reach the block.
+func blockRange(line []rune, left, right, tabWidth int) (int, int) {
+	from, to, column := len(line), len(line), 0
+	for _, c := range clusters(line, tabWidth) {
+		if column > right {
+			break
+		}
+		if column+c.width > left {
+			from, to = min(from, c.start), c.end
+		}
+		column += c.width
+	}
+	return from, to
+}
+
+// blockInsert is text being typed on the first line of a block selection, which is repeated on
+// the other lines of the block when insert mode is left (I, A and c in block visual mode).
+type blockInsert struct {
+	x, y0, y1   int  // Where the text is typed on the first line, and the lines of the block
+	left, right int  // The first and last display column of the block
+	after       bool // True to insert after the block, padding short lines with spaces; false before it
+}
+
+// selection returns the current visual selection, which ends at the cursor.
+func (e *Editor) selection() selection {
+	sel := selection{mode: e.visual, startX: e.visualX, startY: e.visualY, endX: e.cursorX, endY: e.cursorY}
+	if sel.mode == visualBlock {
+		// The block spans the columns of the characters at both ends, wide ones included
+		columns := func(x, y int) (int, int) {
+			line := e.text.Line(y)
+			start := e.bufferToVirtualX(line, x)
+			return start, start + clusterAt(line, x, e.spacesPerTab).width - 1
+		}
+		left0, right0 := columns(sel.startX, sel.startY)
+		left1, right1 := columns(sel.endX, sel.endY)
+		sel.left, sel.right = min(left0, left1), max(right0, right1)
+	}
+	return sel
+}
+
+// enterVisualMode starts selecting text at the cursor.
+func (e *Editor) enterVisualMode(mode visualMode) {
+	e.collapseCursors() // Selections are made with the main cursor only
+	e.visual = mode
+	e.visualX, e.visualY = e.cursorX, e.cursorY
+	e.pendingKeys = nil
+	e.dirty = true // Mark as dirty to trigger a redraw
+}
+
+// exitVisualMode ends the selection, remembering it for the '< and '> line addresses.
+func (e *Editor) exitVisualMode() {
+	sel := e.selection()
+	e.lastSelection = &sel
+	e.visual = visualNone
+	e.pendingKeys = nil
+	e.dirty = true // Mark as dirty to trigger a redraw
+}
+
+// handleVisualMode processes key events in visual mode.
+// Motions move the cursor, extending the selection; the keys in visualKeys act on it.
+// Parameters:
+// - ev: The key event to process.
+func (e *Editor) handleVisualMode(ev *tcell.EventKey) {
+	switch ev.Key() {
+	case tcell.KeyEsc:
+		if len(e.pendingKeys) > 0 {
+			// Cancel the pending command
+			e.pendingKeys = nil
+			return
+		}
+		e.exitVisualMode()
+	case tcell.KeyCtrlV:
+		if e.visual == visualBlock {
+			e.exitVisualMode()
+		} else {
+			e.visual = visualBlock
+			e.dirty = true // Mark as dirty to trigger a redraw
+		}
+	case tcell.KeyLeft:
+		e.handleVisualKey('h')
+	case tcell.KeyRight:
+		e.handleVisualKey('l')
+	case tcell.KeyUp:
+		e.handleVisualKey('k')
+	case tcell.KeyDown:
+		e.handleVisualKey('j')
+	case tcell.KeyHome:
+		e.handleVisualKey('0')
+	case tcell.KeyEnd:
+		e.handleVisualKey('$')
+	case tcell.KeyPgUp:
+		e.handlePageUp()
+		e.clampCursor()
+	case tcell.KeyPgDn:
+		e.handlePageDown()
+		e.clampCursor()
+	case tcell.KeyRune:
+		e.handleVisualKey(ev.Rune())
+	}
+}
+
+// handleVisualKey adds a key to the pending visual mode keys and executes them once they form a
+// motion, or one of the visualKeys after an optional count and register name, e.g. `"ay`.
+// Parameters:
+// - r: The rune typed by the user.
+func (e *Editor) handleVisualKey(r rune) {
+	e.pendingKeys = append(e.pendingKeys, r)
+	prefix := e.pendingKeys[:len(e.pendingKeys)-1]
+	count, name, i, state := parseCommandPrefix(prefix)
+	if strings.ContainsRune(visualKeys, r) && state == parseComplete && i == len(prefix) {
+		// A visual key, after an optional count and register name
+		e.pendingKeys = nil
+		e.registerName = name
+		defer func() { e.registerName = 0 }()
+		e.executeVisualKey(r, max(count, 1))
+		return
+	}
+
+	cmd, state := parseNormalCommand(e.pendingKeys)
+	if state == parseIncomplete && cmd.operator == 0 {
+		return
+	}
+	e.pendingKeys = nil
+	if state == parseComplete && cmd.operator == 0 && (cmd.motion == "gg" || strings.Contains(normalMotions, cmd.motion)) {
+		e.moveByMotion(cmd)
+		e.clampCursor()
+		e.dirty = true // Mark as dirty to trigger a redraw
+	}
+}
+
+// executeVisualKey runs one of the visualKeys on the selection. Keys other than v, V, o and O
+// end visual mode. Changes made to the selection are undone in one step.
+// Parameters:
+// - r: The key.
+// - count: How many times to shift the lines for '>' and '<'.
+func (e *Editor) executeVisualKey(r rune, count int) {
+	switch r {
+	case 'v', 'V':
+		mode := visualChar
+		if r == 'V' {
+			mode = visualLine
+		}
+		if e.visual == mode {
+			e.exitVisualMode()
+		} else {
+			e.visual = mode
+			e.dirty = true // Mark as dirty to trigger a redraw
+		}
+		return
+	case 'o', 'O':
+		// Move the cursor to the other end of the selection
+		e.visualX, e.cursorX = e.cursorX, e.visualX
+		e.visualY, e.cursorY = e.cursorY, e.visualY
+		e.dirty = true // Mark as dirty to trigger a redraw
+		return
+	case ':', '!':
+		// Enter an ex command on the selected lines; '!' filters them through a shell command
+		e.exitVisualMode()
+		e.cmd = []rune(":'<,'>")
+		if r == '!' {
+			e.cmd = append(e.cmd, '!')
+		}
+		e.handleCommandInput()
+		return
+	}
+
+	sel := e.selection()
+	e.exitVisualMode()
+	switch r {
+	case 'x':
+		r = 'd'
+	case 's':
+		r = 'c'
+	case 'X', 'D':
+		r, sel.mode = 'd', visualLine
+	case 'Y':
+		r, sel.mode = 'y', visualLine
+	case 'S', 'R', 'C':
+		r, sel.mode = 'c', visualLine
+	}
+
+	// Every edit made to the selection, and by the insert session it starts, is undone together
+	if r != 'y' {
+		e.history.beginGroup()
+	}
+	x0, y0, x1, y1 := sel.bounds()
+	switch {
+	case r == '>' || r == '<':
+		e.shiftLines(y0, y1, count, r == '<')
+	case r == 'u' || r == 'U' || r == '~':
+		e.changeCase(sel, r)
+	case r == 'I' || r == 'A':
+		e.insertAtSelection(sel, r == 'A')
+	case sel.mode == visualLine:
+		e.applyLinewiseOperator(r, y0, y1)
+	case sel.mode == visualBlock:
+		e.applyBlockOperator(r, x0, y0, x1, y1)
+	default:
+		// The last selected character is included, and so is the line break if the selection reaches it
+		x1++
+		if x1 > e.text.LineLen(y1) && y1+1 < e.text.LineCount() {
+			x1, y1 = 0, y1+1
+		}
+		e.applyCharwiseOperator(r, x0, y0, min(x1, e.text.LineLen(y1)), y1)
+	}
+	if r != 'y' && e.inCommandMode {
+		e.history.endGroup()
+	}
+	if e.inCommandMode {
+		e.clampCursor()
+	}
+	e.dirty = true // Mark as dirty to trigger a redraw
+}
+
+// applyBlockOperator applies d, c or y to a block of text. The register holds one line of
+// the block per row. After c, the text typed on the first line is repeated on the others.
+// Parameters:
+// - operator: The operator to apply.
+// - left, y0: The first display column and line of the block.
+// - right, y1: The last display column and line of the block (inclusive).
+func (e *Editor) applyBlockOperator(operator rune, left, y0, right, y1 int) {
+	var text []rune
+	for y := y0; y <= y1; y++ {
+		line := e.text.Line(y)
+		if y > y0 {
+			text = append(text, '\n')
+		}
+		from, to := blockRange(line, left, right, e.spacesPerTab)
+		text = append(text, line[from:to]...)
+	}
+	e.cursorX, _ = blockRange(e.text.Line(y0), left, right, e.spacesPerTab)
+	e.cursorY = y0
+	e.storeRegister(register{text: text, block: true}, operator == 'y')
+	if operator == 'y' {
+		return
+	}
+
+	for y := y0; y <= y1; y++ {
+		from, to := blockRange(e.text.Line(y), left, right, e.spacesPerTab)
+		e.deleteText(from, y, to, y)
+	}
+	if operator == 'c' {
+		e.startBlockInsert(blockInsert{y0: y0, y1: y1, left: left, right: right})
+	}
+}
+
+// insertAtSelection enters insert mode before (I) or after (A) the selection. In a block selection,
+// the text typed is inserted on every line of the block; A pads lines that are too short.
+// Parameters:
+// - sel: The selection.
+// - after: True to insert after the selection (A), false to insert before it (I).
+func (e *Editor) insertAtSelection(sel selection, after bool) {
+	x0, y0, x1, y1 := sel.bounds()
+	switch {
+	case sel.mode == visualBlock:
+		e.startBlockInsert(blockInsert{y0: y0, y1: y1, left: x0, right: x1, after: after})
+	case after:
+		e.cursorX, e.cursorY = e.text.LineLen(y1), y1
+		if sel.mode == visualChar {
+			e.cursorX = min(x1+1, e.cursorX)
+		}
+		e.enterInsertMode()
+	default:
+		e.cursorX, e.cursorY = 0, y0
+		if sel.mode == visualChar {
+			e.cursorX = x0
+		}
+		e.enterInsertMode()
+	}
+}
+
+// startBlockInsert enters insert mode on the first line of a block, to repeat what is typed on the others.
+func (e *Editor) startBlockInsert(insert blockInsert) {
+	insert.x, _ = e.blockInsertX(insert, insert.y0)
+	e.cursorX, e.cursorY = insert.x, insert.y0
+	e.blockInsert = &insert
+	e.enterInsertMode()
+}
+
+// blockInsertX returns where the text typed in a block goes on one of its lines: before the block,
+// or after it. Inserting after the block pads a line that ends before the block's last column with
+// spaces up to it.
+// Returns: The position, and false if the line ends before the block, so nothing is inserted before it.
+func (e *Editor) blockInsertX(insert blockInsert, y int) (int, bool) {
+	line := e.text.Line(y)
+	from, to := blockRange(line, insert.left, insert.right, e.spacesPerTab)
+	width := e.bufferToVirtualX(line, len(line))
+	if !insert.after {
+		return from, width >= insert.left
+	}
+	if width <= insert.right {
+		to, _ = e.insertText(len(line), y, []rune(strings.Repeat(" ", insert.right+1-width)))
+	}
+	return to, true
+}
+
+// finishBlockInsert repeats the text typed on the first line of a block on its other lines.
+// Nothing is repeated if the cursor left the first line, e.g. because a line break was typed.
+func (e *Editor) finishBlockInsert() {
+	insert := e.blockInsert
+	if insert == nil {
+		return
+	}
+	e.blockInsert = nil
+	if e.cursorY != insert.y0 || e.cursorX <= insert.x || insert.x > e.text.LineLen(insert.y0) {
+		return
+	}
+	text := slices.Clone(e.text.Line(insert.y0)[insert.x:e.cursorX])
+	for y := insert.y0 + 1; y <= insert.y1; y++ {
+		if x, ok := e.blockInsertX(*insert, y); ok {
+			e.insertText(x, y, text)
+		}
+	}
+}
+
+// shiftLines indents lines by a number of levels of indentation, tabs or with expandtab spaces,
+// or removes as many levels: a tab, or up to tabstop spaces, each. Empty lines are not indented.
+// Parameters:
+// - y0, y1: The first and last line (inclusive).
+// - count: The number of levels to shift by.
+// - dedent: True to remove indentation (<), false to add it (>).
+func (e *Editor) shiftLines(y0, y1, count int, dedent bool) {
+	for y := y0; y <= y1; y++ {
+		line := e.text.Line(y)
+		if !dedent {
+			if len(line) > 0 {
+				e.insertText(0, y, []rune(strings.Repeat(string(e.indentUnit()), count)))
+			}
+			continue
+		}
+		e.deleteText(0, y, e.dedentLength(line, count), y)
+	}
+	e.cursorX, e.cursorY = e.firstNonBlank(y0), y0
+}
+
+// changeCase converts the selected text to lowercase (u), uppercase (U), or switches its case (~).
+func (e *Editor) changeCase(sel selection, op rune) {
+	_, y0, _, y1 := sel.bounds()
+	for y := y0; y <= y1; y++ {
+		line := e.text.Line(y)
+		from, to := sel.columns(y, line, e.spacesPerTab)
+		to = min(to, len(line))
+		changed := slices.Clone(line[from:to])
+		for i, r := range changed {
+			switch {
+			case op == 'u' || (op == '~' && unicode.IsUpper(r)):
+				changed[i] = unicode.ToLower(r)
+			default:
+				changed[i] = unicode.ToUpper(r)
+			}
+		}
+		if !slices.Equal(changed, line[from:to]) {
+			e.deleteText(from, y, to, y)
+			e.insertText(from, y, changed)
+		}
+		if y == y0 {
+			e.cursorX, e.cursorY = from, y
+		}
+	}
+}
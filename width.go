@@ -0,0 +1,82 @@
+package main
+
+import (
+	"unicode/utf8"
+
+	"github.com/rivo/uniseg"
+)
+
+// cluster is a grapheme cluster of a line: a character as the user sees it, which can be made
+// of several runes, such as a letter with combining accents or an emoji sequence.
+type cluster struct {
+	start, end int // Rune range of the cluster in the line
+	width      int // Number of screen columns the cluster takes
+}
+
+// clusters splits a line into grapheme clusters, with their display width: two columns for
+// wide East Asian characters and emoji, one for everything else, and for a tab, the columns up
+// to the next tab stop, as tab stops are every tabWidth columns.
+// Characters without a width of their own, such as a lone zero-width space, take one column
+// so the cursor can be placed on them.
+func clusters(line []rune, tabWidth int) []cluster {
+	var result []cluster
+	rest, state, start, column := string(line), -1, 0, 0
+	for rest != "" {
+		var text string
+		var width int
+		text, rest, width, state = uniseg.FirstGraphemeClusterInString(rest, state)
+		end := start + utf8.RuneCountInString(text)
+		if text == "\t" {
+			width = tabWidth - column%tabWidth
+		}
+		width = max(width, 1)
+		result = append(result, cluster{start: start, end: end, width: width})
+		start, column = end, column+width
+	}
+	return result
+}
+
+// clusterAt returns the cluster of a line containing the rune at x, or an empty one-column
+// cluster at the end of the line for positions past its last character.
+func clusterAt(line []rune, x, tabWidth int) cluster {
+	for _, c := range clusters(line, tabWidth) {
+		if x < c.end {
+			return c
+		}
+	}
+	return cluster{start: len(line), end: len(line), width: 1}
+}
+
+// nextCharX returns the position of the character after the one at x, or the end of the line.
+func nextCharX(line []rune, x int) int {
+	if x >= len(line) {
+		return len(line)
+	}
+	return clusterAt(line, x, 1).end
+}
+
+// prevCharX returns the position of the character before the one at x, or 0.
+func prevCharX(line []rune, x int) int {
+	prev := 0
+	for _, c := range clusters(line, 1) {
+		if c.start >= x {
+			break
+		}
+		prev = c.start
+	}
+	return prev
+}
+
+// charStartX returns the start of the character containing the rune at x, so that the cursor
+// is never placed on a combining mark or in the middle of an emoji sequence.
+func charStartX(line []rune, x int) int {
+	if x >= len(line) {
+		return x
+	}
+	return clusterAt(line, x, 1).start
+}
+
+// lastCharX returns the position of the last character of a line, or 0 for an empty line.
+func lastCharX(line []rune) int {
+	return prevCharX(line, len(line))
+}
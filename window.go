@@ -0,0 +1,489 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+const (
+	// Window error messages
+	errorNotEnoughRoom = "Not enough room"
+	errorLastWindow    = "Cannot close last window"
+
+	// Minimum window sizes; a window's height includes its status line
+	minWindowHeight = 2
+	minWindowWidth  = 1
+
+	windowSeparator = '│' // Drawn between windows side by side
+)
+
+// viewport is a cursor position in a buffer and the scroll position of the view around it.
+type viewport struct {
+	cursorX, cursorY int // Cursor position in the buffer
+	offsetX, offsetY int // Viewport offset for scrolling
+}
+
+// Window shows a buffer on part of the screen, with its own cursor, scroll position and options.
+// Several windows can show the same buffer.
+type Window struct {
+	*Buffer  // Buffer shown in the window
+	viewport // Cursor and scroll position in the buffer
+
+	windowOptions // Values of the window options, such as wrap, for the window
+
+	cursors []cursor // Additional cursors, which edits are repeated at
+
+	left, top     int // Screen position of the top left corner
+	width, height int // Size on the screen; the last row is the window's status line
+}
+
+// show switches the window to another buffer, remembering the position in the buffer it leaves
+// and the options it was shown with.
+func (w *Window) show(b *Buffer) {
+	w.lastViewport, w.lastWindowOptions = w.viewport, w.windowOptions
+	w.Buffer = b
+	w.viewport, w.windowOptions = b.lastViewport, b.lastWindowOptions
+	w.cursors = nil
+
+	// Other windows may have shortened the buffer since the position was saved
+	w.cursorY = min(w.cursorY, w.text.LineCount()-1)
+	w.cursorX = min(w.cursorX, w.text.LineLen(w.cursorY))
+	w.offsetX = min(w.offsetX, w.cursorX)
+	w.offsetY = min(w.offsetY, w.cursorY)
+}
+
+// textHeight returns the number of buffer lines the window shows.
+func (w *Window) textHeight() int {
+	return max(w.height-1, 0)
+}
+
+// scrollToCursor adjusts the scroll position so the cursor is visible.
+// Parameters:
+// - column, width: The screen column of the character under the cursor within its line, and its width.
+// - textWidth: The number of columns the window has for text.
+// Returns: True if the scroll position changed.
+func (w *Window) scrollToCursor(column, width, textWidth int) bool {
+	changed := false
+	// Ensure the whole character under the cursor is visible horizontally
+	if column < w.offsetX {
+		w.offsetX, changed = column, true
+	} else if column+width > w.offsetX+textWidth {
+		w.offsetX, changed = column+width-textWidth, true
+	}
+
+	// Ensure the cursor is visible vertically
+	if w.cursorY < w.offsetY {
+		w.offsetY, changed = w.cursorY, true
+	} else if w.cursorY >= w.offsetY+w.textHeight() {
+		w.offsetY, changed = w.cursorY-w.textHeight()+1, true
+	}
+	return changed
+}
+
+// layoutNode is a node of the window layout: a window, or nodes that split an area
+// side by side or stacked on top of each other.
+type layoutNode struct {
+	window   *Window       // Window of a leaf node, nil for inner nodes
+	vertical bool          // True if the children are side by side (:vsplit), false if stacked (:split)
+	children []*layoutNode // Nodes splitting the area of an inner node
+	parent   *layoutNode
+	size     int // Rows of the node in a stack, or columns side by side; 0 for an equal share
+}
+
+// leaves appends the windows of the node, from top to bottom and left to right.
+func (n *layoutNode) leaves(windows []*Window) []*Window {
+	if n.window != nil {
+		return append(windows, n.window)
+	}
+	for _, child := range n.children {
+		windows = child.leaves(windows)
+	}
+	return windows
+}
+
+// find returns the leaf node of a window, or nil if the window is not in the layout.
+func (n *layoutNode) find(w *Window) *layoutNode {
+	if n.window == w {
+		return n
+	}
+	for _, child := range n.children {
+		if found := child.find(w); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// arrange places the windows of the node in a screen area. Children that do not fit
+// the area exactly are scaled to it, keeping their proportions.
+func (n *layoutNode) arrange(left, top, width, height int) {
+	if n.window != nil {
+		n.window.left, n.window.top, n.window.width, n.window.height = left, top, width, height
+		return
+	}
+	avail := height
+	if n.vertical {
+		avail = width - (len(n.children) - 1) // One column between windows for the separator
+	}
+	total := 0
+	for _, child := range n.children {
+		total += child.size
+	}
+	if total != avail {
+		used := 0
+		for i, child := range n.children {
+			switch {
+			case i == len(n.children)-1:
+				child.size = avail - used
+			case total == 0 || slices.ContainsFunc(n.children, func(c *layoutNode) bool { return c.size == 0 }):
+				child.size = avail / len(n.children)
+			default:
+				child.size = child.size * avail / total
+			}
+			child.size = max(child.size, 1)
+			used += child.size
+		}
+	}
+	for _, child := range n.children {
+		if n.vertical {
+			child.arrange(left, top, child.size, height)
+			left += child.size + 1
+		} else {
+			child.arrange(left, top, width, child.size)
+			top += child.size
+		}
+	}
+}
+
+// equalize makes all the windows in the node share their area equally.
+func (n *layoutNode) equalize() {
+	for _, child := range n.children {
+		child.size = 0
+		child.equalize()
+	}
+}
+
+// windows returns the windows on the screen, from top to bottom and left to right.
+func (e *Editor) windows() []*Window {
+	return e.layout.leaves(nil)
+}
+
+// layoutWindows places the windows on the screen. A single window takes the whole screen
+// and uses the bottom line as its status line; several windows share the lines above it.
+func (e *Editor) layoutWindows() {
+	if e.layout.window != nil {
+		e.layout.arrange(0, 0, e.w, e.h)
+	} else {
+		e.layout.arrange(0, 0, e.w, e.h-1)
+	}
+	e.dirty = true // Mark as dirty to trigger a redraw
+}
+
+// switchWindow makes w the current window.
+func (e *Editor) switchWindow(w *Window) {
+	if w == e.Window {
+		return
+	}
+	e.history.endGroup() // The current undo step belongs to the window being left
+	e.Window = w
+	e.pendingKeys = nil
+	e.dirty = true // Mark as dirty to trigger a redraw
+}
+
+// splitWindow splits the current window in two, showing the same buffer at the same position.
+// Like vim, the new window goes above or to the left and becomes the current window.
+// Parameters:
+// - vertical: True to split side by side (:vsplit), false to stack the windows (:split).
+// Returns:
+// - error: An error if the window is too small to split.
+func (e *Editor) splitWindow(vertical bool) error {
+	size, minSize := e.height, minWindowHeight
+	if vertical {
+		size, minSize = e.width-1, minWindowWidth // One column goes to the separator
+	}
+	if size < 2*minSize {
+		return errors.New(errorNotEnoughRoom)
+	}
+
+	leaf := e.layout.find(e.Window)
+	if leaf.parent == nil || leaf.parent.vertical != vertical {
+		// Turn the leaf into a node of the split direction holding the window
+		inner := &layoutNode{window: e.Window, parent: leaf}
+		leaf.window, leaf.vertical, leaf.children = nil, vertical, []*layoutNode{inner}
+		leaf = inner
+	}
+	parent := leaf.parent
+	w := &Window{Buffer: e.Buffer, viewport: e.viewport, windowOptions: e.windowOptions}
+	node := &layoutNode{window: w, parent: parent, size: size / 2}
+	leaf.size = size - node.size
+	i := slices.Index(parent.children, leaf)
+	parent.children = slices.Insert(parent.children, i, node)
+	e.switchWindow(w)
+	e.layoutWindows()
+	return nil
+}
+
+// firstWindow returns the top left window of the node.
+func (n *layoutNode) firstWindow() *Window {
+	for n.window == nil {
+		n = n.children[0]
+	}
+	return n.window
+}
+
+// closeWindow removes a window from the screen; its space goes to the window before or after it.
+// The buffer stays open.
+// Returns:
+// - error: An error if it is the last window.
+func (e *Editor) closeWindow(w *Window) error {
+	leaf := e.layout.find(w)
+	parent := leaf.parent
+	if parent == nil {
+		return errors.New(errorLastWindow)
+	}
+	i := slices.Index(parent.children, leaf)
+	parent.children = slices.Delete(parent.children, i, i+1)
+	neighbor := parent.children[max(i-1, 0)]
+	neighbor.size += leaf.size
+	if parent.vertical {
+		neighbor.size++ // The separator is not needed any more
+	}
+	if len(parent.children) == 1 {
+		// A node with a single child is replaced by the child
+		child := parent.children[0]
+		parent.window, parent.vertical, parent.children = child.window, child.vertical, child.children
+		for _, grandchild := range parent.children {
+			grandchild.parent = parent
+		}
+		neighbor = parent
+		if grandparent := parent.parent; grandparent != nil && parent.window == nil && grandparent.vertical == parent.vertical {
+			// Windows split in the same direction as the grandparent join its children
+			j := slices.Index(grandparent.children, parent)
+			grandparent.children = slices.Replace(grandparent.children, j, j+1, parent.children...)
+			for _, child := range parent.children {
+				child.parent = grandparent
+			}
+		}
+	}
+	if w == e.Window {
+		w.lastViewport, w.lastWindowOptions = w.viewport, w.windowOptions
+		e.switchWindow(neighbor.firstWindow())
+	}
+	e.layoutWindows()
+	return nil
+}
+
+// onlyWindow closes all the windows but the current one.
+func (e *Editor) onlyWindow() {
+	e.layout = &layoutNode{window: e.Window}
+	e.layoutWindows()
+}
+
+// cycleWindow switches to the window n places after the current one, wrapping around;
+// negative n switches to earlier windows.
+func (e *Editor) cycleWindow(n int) {
+	windows := e.windows()
+	count := len(windows)
+	e.switchWindow(windows[((slices.Index(windows, e.Window)+n)%count+count)%count])
+}
+
+// moveToWindow switches to the window next to the current one in a direction.
+// Parameters:
+// - dx, dy: The direction: -1 or 1 for left or right, or for up or down; the other is 0.
+func (e *Editor) moveToWindow(dx, dy int) {
+	// Look just past the edge of the window, in line with the cursor
+	x, y := e.cursorScreenPosition(e.Window)
+	x = min(max(x, e.left), e.left+e.width-1)
+	y = min(max(y, e.top), e.top+e.textHeight()-1)
+	switch {
+	case dx < 0:
+		x = e.left - 2 // Skip the separator
+	case dx > 0:
+		x = e.left + e.width + 1
+	case dy < 0:
+		y = e.top - 1
+	case dy > 0:
+		y = e.top + e.height
+	}
+	for _, w := range e.windows() {
+		if x >= w.left && x < w.left+w.width && y >= w.top && y < w.top+w.height {
+			e.switchWindow(w)
+			return
+		}
+	}
+}
+
+// resizeWindow changes the height or width of the current window, taking the space from
+// or giving it to the windows after it, or else before it.
+// Parameters:
+// - vertical: True to change the width, false to change the height.
+// - size: The new size, or the change in size if relative.
+// - relative: True if size is a change to the current size.
+func (e *Editor) resizeWindow(vertical bool, size int, relative bool) {
+	node := e.layout.find(e.Window)
+	for node.parent != nil && node.parent.vertical != vertical {
+		node = node.parent
+	}
+	if node.parent == nil {
+		return // No window next to it in that direction
+	}
+	parent := node.parent
+	if relative {
+		size += node.size
+	}
+	minSize := minWindowHeight
+	if vertical {
+		minSize = minWindowWidth
+	}
+
+	delta := max(size, minSize) - node.size
+	i := slices.Index(parent.children, node)
+	siblings := slices.Clone(parent.children[i+1:])
+	for j := i - 1; j >= 0; j-- {
+		siblings = append(siblings, parent.children[j])
+	}
+	for _, sibling := range siblings {
+		if delta > 0 {
+			take := min(delta, sibling.size-minSize)
+			if take > 0 {
+				sibling.size -= take
+				node.size += take
+				delta -= take
+			}
+		} else if delta < 0 {
+			sibling.size -= delta
+			node.size += delta
+			delta = 0
+		}
+	}
+	e.layoutWindows()
+}
+
+// equalizeWindows makes all windows the same size (Ctrl-W =).
+func (e *Editor) equalizeWindows() {
+	e.layout.equalize()
+	e.layoutWindows()
+}
+
+// shiftWindows keeps the cursors of the other windows showing the current buffer on the same text
+// after an edit replaced the text from (x0, y0) to (x1, y1) with text ending at (endX, endY), and
+// their top lines on the same lines.
+func (e *Editor) shiftWindows(x0, y0, x1, y1, endX, endY int) {
+	for _, w := range e.windows() {
+		if w == e.Window || w.Buffer != e.Buffer {
+			continue
+		}
+		c := cursor{x: w.cursorX, y: w.cursorY}.moved(x0, y0, x1, y1, endX, endY)
+		if w.offsetY > y0 {
+			w.offsetY = max(w.offsetY+endY-y1, y0)
+		}
+		w.cursorY = min(c.y, e.text.LineCount()-1)
+		w.cursorX = min(c.x, e.text.LineLen(w.cursorY))
+	}
+}
+
+// handleWindowKey runs the window command of the key typed after Ctrl-W.
+// Parameters:
+// - ev: The key typed after Ctrl-W; Ctrl-letter keys work like the letter.
+// - count: The count typed before Ctrl-W, or 0.
+func (e *Editor) handleWindowKey(ev *tcell.EventKey, count int) {
+	r := ev.Rune()
+	if key := ev.Key(); key >= tcell.KeyCtrlA && key <= tcell.KeyCtrlZ {
+		r = 'a' + rune(key-tcell.KeyCtrlA)
+	} else if key != tcell.KeyRune {
+		return
+	}
+	n := max(count, 1)
+	var err error
+	switch r {
+	case 's', 'S':
+		err = e.splitWindow(false)
+	case 'v':
+		err = e.splitWindow(true)
+	case 'w':
+		e.cycleWindow(n)
+	case 'W':
+		e.cycleWindow(-n)
+	case 'h':
+		e.moveToWindow(-1, 0)
+	case 'l':
+		e.moveToWindow(1, 0)
+	case 'k':
+		e.moveToWindow(0, -1)
+	case 'j':
+		e.moveToWindow(0, 1)
+	case 'c':
+		err = e.closeWindow(e.Window)
+	case 'q':
+		err = e.executeQuitCommand(false)
+	case 'o':
+		e.onlyWindow()
+	case '+':
+		e.resizeWindow(false, n, true)
+	case '-':
+		e.resizeWindow(false, -n, true)
+	case '>':
+		e.resizeWindow(true, n, true)
+	case '<':
+		e.resizeWindow(true, -n, true)
+	case '=':
+		e.equalizeWindows()
+	}
+	if err != nil {
+		e.showStatus("Error: " + err.Error())
+	}
+}
+
+// executeWindowCommand processes the window commands: :split, :vsplit, :close, :only,
+// :resize and :vertical resize.
+// Parameters:
+// - name: The command name, e.g. "sp" or "vs".
+// - args: The arguments: a file to open in the new window for :split and :vsplit,
+// or the new size ("N", "+N" or "-N") for :resize.
+// Returns:
+// - error: An error if the window cannot be split or closed, or the arguments are invalid.
+func (e *Editor) executeWindowCommand(name string, args []string) error {
+	switch name {
+	case "sp", "split", "vs", "vsp", "vsplit":
+		if err := e.splitWindow(strings.HasPrefix(name, "v")); err != nil {
+			return err
+		}
+		if len(args) > 0 {
+			return e.openFile(strings.Join(args, " "))
+		}
+	case "clo", "close", "clo!", "close!":
+		return e.closeWindow(e.Window)
+	case "on", "only", "on!", "only!":
+		e.onlyWindow()
+	case "res", "resize":
+		return e.executeResizeCommand(false, args)
+	case "vert", "vertical":
+		if len(args) == 0 || (args[0] != "res" && args[0] != "resize") {
+			return errors.New(errorUnknownCommand + ": " + strings.Join(append([]string{name}, args...), " "))
+		}
+		return e.executeResizeCommand(true, args[1:])
+	}
+	return nil
+}
+
+// executeResizeCommand sets the height or width of the current window from a :resize argument:
+// "N" sets it, "+N" and "-N" change it, and no argument makes it as large as possible.
+func (e *Editor) executeResizeCommand(vertical bool, args []string) error {
+	if len(args) > 1 {
+		return errors.New(errorInvalidArgument + ": " + strings.Join(args, " "))
+	}
+	if len(args) == 0 {
+		e.resizeWindow(vertical, max(e.w, e.h), false)
+		return nil
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil {
+		return errors.New(errorInvalidArgument + ": " + args[0])
+	}
+	e.resizeWindow(vertical, n, strings.ContainsAny(args[0][:1], "+-"))
+	return nil
+}
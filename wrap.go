@@ -0,0 +1,209 @@
+package main
+
+import "unicode"
+
+// row is a screen row of a line: the whole line, or when lines wrap, the part of it that fits in the row.
+type row struct {
+	start, end int // Rune range of the line shown in the row
+	column     int // Virtual column of the start of the row within the line
+}
+
+// rows splits a line into the screen rows that show it. Without wrapping, the line takes a single row.
+// With wrapping, each row holds the characters that fit in textWidth columns, less the width of the
+// wrap indicator on the rows after the first. With linebreak, rows end after their last blank rather
+// than in the middle of a word.
+// Parameters:
+// - line: The line to split.
+// - textWidth: The number of columns the window has for text.
+func (w *Window) rows(line []rune, textWidth int) []row {
+	if !w.wrapLines {
+		return []row{{start: 0, end: len(line)}}
+	}
+	chars := clusters(line, w.spacesPerTab)
+	startOf := func(i int) int {
+		if i < len(chars) {
+			return chars[i].start
+		}
+		return len(line)
+	}
+
+	var result []row
+	first, column := 0, 0 // First character of the row being filled, and its column
+	used, breakAt := 0, 0 // Columns used in the row, and the character after its last blank
+	width := textWidth
+	for i := 0; i < len(chars); i++ {
+		if used+chars[i].width > width && i > first {
+			// The character does not fit: end the row, before the word it is in with linebreak
+			end := i
+			if w.lineBreak && breakAt > first {
+				end = breakAt
+			}
+			result = append(result, row{start: startOf(first), end: startOf(end), column: column})
+			for _, c := range chars[first:end] {
+				column += c.width
+			}
+			first, used, breakAt = end, 0, 0
+			width = max(textWidth-w.showBreakWidth(), 1)
+			i = end - 1 // Fill the next row from its first character
+			continue
+		}
+		used += chars[i].width
+		if unicode.IsSpace(line[chars[i].start]) {
+			breakAt = i + 1
+		}
+	}
+	return append(result, row{start: startOf(first), end: len(line), column: column})
+}
+
+// rowAt returns the index of the row showing the character at x; positions past the end of the
+// line are on the last row.
+func rowAt(rows []row, x int) int {
+	for i := len(rows) - 1; i > 0; i-- {
+		if x >= rows[i].start {
+			return i
+		}
+	}
+	return 0
+}
+
+// showBreakWidth returns the number of columns of the wrap indicator.
+func (w *Window) showBreakWidth() int {
+	width := 0
+	for _, c := range clusters([]rune(w.showBreak), 1) {
+		width += c.width
+	}
+	return width
+}
+
+// rowIndent returns the number of columns before the text of a row: the width of the wrap indicator
+// on the rows a wrapped line continues on, and none on its first row.
+func (w *Window) rowIndent(i int) int {
+	if i > 0 {
+		return w.showBreakWidth()
+	}
+	return 0
+}
+
+// rowColumn returns the screen column of the character at x within its row, counted from the left
+// of the window's text and without horizontal scrolling.
+func (w *Window) rowColumn(line []rune, rows []row, i, x int) int {
+	return w.bufferToVirtualX(line, x) - rows[i].column + w.rowIndent(i)
+}
+
+// rowX returns the position of the character shown at a screen column of a row, or of the last
+// character of the row if it is shorter. Only the last row of a line ends past its last character.
+func (w *Window) rowX(line []rune, rows []row, i, column int) int {
+	x := w.virtualToBufferX(line, rows[i].column+max(column-w.rowIndent(i), 0))
+	if i < len(rows)-1 {
+		x = min(x, prevCharX(line, rows[i].end))
+	}
+	return x
+}
+
+// textWidth returns the number of columns a window has for text, after its line numbers.
+func (e *Editor) textWidth(w *Window) int {
+	return w.left + w.width - e.textLeft(w)
+}
+
+// cursorScreenPosition returns the screen position of the cursor of a window.
+func (e *Editor) cursorScreenPosition(w *Window) (int, int) {
+	line := w.text.Line(w.cursorY)
+	textWidth := e.textWidth(w)
+	rows := w.rows(line, textWidth)
+	i := rowAt(rows, w.cursorX)
+	x := e.textLeft(w) + w.rowColumn(line, rows, i, w.cursorX) - w.offsetX
+	y := w.top + w.cursorY - w.offsetY + i
+	if w.wrapLines {
+		// The cursor at the end of a full row stays on its last column
+		x = min(x, e.textLeft(w)+textWidth-1)
+		for lineIndex := w.offsetY; lineIndex < w.cursorY; lineIndex++ {
+			y += len(w.rows(w.text.Line(lineIndex), textWidth)) - 1
+		}
+	}
+	return x, y
+}
+
+// moveByRow moves the cursor to the screen row below or above it when lines wrap, keeping its
+// screen column where the row is long enough. The row can be on the same line or on the next or
+// previous one; from the end of a line, the cursor moves to the end of the other line.
+// Parameters:
+// - down: True to move down, false to move up.
+func (e *Editor) moveByRow(down bool) {
+	line := e.text.Line(e.cursorY)
+	rows := e.rows(line, e.textWidth(e.Window))
+	i := rowAt(rows, e.cursorX)
+	column := e.rowColumn(line, rows, i, e.cursorX)
+	eol := e.cursorX > 0 && e.cursorX == len(line)
+	switch {
+	case down && i < len(rows)-1:
+		e.cursorX = e.rowX(line, rows, i+1, column)
+	case !down && i > 0:
+		e.cursorX = e.rowX(line, rows, i-1, column)
+	case down && e.cursorY < e.text.LineCount()-1, !down && e.cursorY > 0:
+		if down {
+			e.cursorY++
+		} else {
+			e.cursorY--
+		}
+		line = e.text.Line(e.cursorY)
+		rows = e.rows(line, e.textWidth(e.Window))
+		i = 0
+		if !down {
+			i = len(rows) - 1
+		}
+		if eol {
+			e.cursorX = len(line)
+		} else {
+			e.cursorX = e.rowX(line, rows, i, column)
+		}
+	}
+	e.dirty = true // Mark as dirty to trigger a redraw
+}
+
+// scrollToWrappedCursor adjusts the scroll position of a window whose lines wrap so the cursor is
+// visible. Wrapped lines never scroll horizontally, and the window scrolls by whole lines until the
+// rows from its top line down to the row of the cursor fit in it.
+// Returns: True if the scroll position changed.
+func (e *Editor) scrollToWrappedCursor(w *Window) bool {
+	offsetX, offsetY := w.offsetX, w.offsetY
+	w.offsetX = 0
+	w.offsetY = min(w.offsetY, w.cursorY)
+
+	textWidth := e.textWidth(w)
+	height := rowAt(w.rows(w.text.Line(w.cursorY), textWidth), w.cursorX) + 1
+	for y := w.cursorY - 1; y >= w.offsetY; y-- {
+		height += len(w.rows(w.text.Line(y), textWidth))
+		if height > w.textHeight() {
+			w.offsetY = y + 1
+			break
+		}
+	}
+	return w.offsetX != offsetX || w.offsetY != offsetY
+}
+
+// pageLines returns the number of lines a page scroll moves over: the lines that fit in the window
+// from its top line down, or the lines above its top line that fit in it; at least one.
+// Parameters:
+// - forward: True to count the lines from the top line down, false to count the lines above it.
+func (e *Editor) pageLines(w *Window, forward bool) int {
+	if !w.wrapLines {
+		return max(w.textHeight(), 1)
+	}
+	textWidth := e.textWidth(w)
+	lines, height := 0, 0
+	for {
+		y := w.offsetY + lines
+		if !forward {
+			y = w.offsetY - lines - 1
+		}
+		if y < 0 || y >= w.text.LineCount() {
+			break
+		}
+		height += len(w.rows(w.text.Line(y), textWidth))
+		if height > w.textHeight() {
+			break
+		}
+		lines++
+	}
+	return max(lines, 1)
+}
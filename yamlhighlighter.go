@@ -0,0 +1,131 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Lexer states carried between lines of YAML documents.
+// Inside a block scalar the state also records the indentation of the line that introduced it:
+// the scalar continues while lines are blank or indented deeper than that.
+const (
+	yamlStateCode        LexState = iota // Plain content
+	yamlStateBlockScalar                 // Inside a | or > block scalar; indentation is added to the state
+)
+
+var yamlConstants = wordSet("true false yes no on off null True False Yes No On Off Null TRUE FALSE NULL ~")
+
+// YAMLHighlighter implements syntax highlighting for YAML files.
+type YAMLHighlighter struct {
+	styles syntaxStyles
+}
+
+// NewYAMLHighlighter initializes a new YAMLHighlighter with default styles.
+func NewYAMLHighlighter(styles syntaxStyles) *YAMLHighlighter {
+	return &YAMLHighlighter{styles: styles}
+}
+
+// HighlightLine returns the styled spans of a given YAML line.
+func (yh *YAMLHighlighter) HighlightLine(src []rune, state LexState) ([]StyleSpan, LexState) {
+	l := newLineLexer(src)
+	indent := l.skipWhile(func(r rune) bool { return r == ' ' })
+
+	if state >= yamlStateBlockScalar {
+		if l.eof() || indent > int(state-yamlStateBlockScalar) {
+			l.pos = 0
+			l.emitRest(yh.styles.str)
+			return l.spans, state
+		}
+		state = yamlStateCode
+	}
+
+	if indent == 0 && (l.hasPrefix("---") || l.hasPrefix("...")) && strings.TrimSpace(string(l.rest()[3:])) == "" {
+		l.emitRest(yh.styles.keyword) // Document markers
+		return l.spans, state
+	}
+
+	depth := 0     // Nesting of flow collections
+	value := false // Whether a value was seen since the last key or indicator
+	for !l.eof() {
+		start := l.pos
+		r := l.peek(0)
+		switch {
+		case r == '#' && (start == 0 || unicode.IsSpace(l.src[start-1])):
+			l.emitRest(yh.styles.comment)
+		case r == '-' && !value && (l.peek(1) == ' ' || l.pos+1 == len(l.src)):
+			l.pos++
+			l.emit(start, yh.styles.operator) // Sequence entry
+		case r == '"' || r == '\'':
+			l.pos++
+			l.quoted(string(r), r == '"')
+			end := l.pos
+			l.skipWhile(unicode.IsSpace)
+			if l.peek(0) == ':' {
+				l.spans = appendSpan(l.spans, start, end, yh.styles.key)
+			} else {
+				l.spans = appendSpan(l.spans, start, end, yh.styles.str)
+				value = true
+			}
+		case (r == '|' || r == '>') && !value && depth == 0:
+			// Block scalar header such as | or >-; its content starts on the next line
+			l.skipWhile(func(r rune) bool { return !unicode.IsSpace(r) })
+			l.emit(start, yh.styles.operator)
+			value = true
+			state = yamlStateBlockScalar + LexState(indent)
+		case r == '&' || r == '*' || r == '!':
+			l.skipWhile(func(r rune) bool { return !unicode.IsSpace(r) && !strings.ContainsRune(",[]{}", r) })
+			l.emit(start, yh.styles.variable) // Anchors, aliases and tags
+		case strings.ContainsRune("[]{},", r):
+			switch r {
+			case '[', '{':
+				depth++
+			case ']', '}':
+				depth = max(depth-1, 0)
+			}
+			l.pos++
+			l.emit(start, yh.styles.operator)
+			value = false
+		case r == ':':
+			l.pos++
+			l.emit(start, yh.styles.operator)
+			value = false
+		case unicode.IsSpace(r):
+			l.skipWhile(unicode.IsSpace)
+		default:
+			// Plain scalar, ending at a ': ', ' #' or, inside flow collections, a flow indicator
+			for !l.eof() {
+				c := l.peek(0)
+				if c == ':' && (l.peek(1) == 0 || unicode.IsSpace(l.peek(1)) || (depth > 0 && strings.ContainsRune(",[]{}", l.peek(1)))) ||
+					c == '#' && unicode.IsSpace(l.peek(-1)) || depth > 0 && strings.ContainsRune(",[]{}", c) {
+					break
+				}
+				l.pos++
+			}
+			scalar := strings.TrimRightFunc(string(l.src[start:l.pos]), unicode.IsSpace)
+			end := start + len([]rune(scalar))
+			switch {
+			case l.peek(0) == ':':
+				l.spans = appendSpan(l.spans, start, end, yh.styles.key)
+			case yamlConstants[scalar]:
+				l.spans = appendSpan(l.spans, start, end, yh.styles.constant)
+			case isYAMLNumber(scalar):
+				l.spans = appendSpan(l.spans, start, end, yh.styles.number)
+			}
+			value = l.peek(0) != ':'
+		}
+	}
+	return l.spans, state
+}
+
+// isYAMLNumber reports whether a plain scalar is a number such as 42, -1.5, 0x1F or .inf.
+func isYAMLNumber(s string) bool {
+	s = strings.TrimLeft(s, "+-")
+	switch strings.ToLower(s) {
+	case "":
+		return false
+	case ".inf", ".nan":
+		return true
+	}
+	l := newLineLexer([]rune(s))
+	return l.number() && l.eof()
+}